@@ -0,0 +1,457 @@
+// Package api serves a JSON API to control a running client over HTTP. Every request must carry
+// the API token as "Authorization: Bearer <token>".
+//
+//	GET    /torrents                        lists the torrents
+//	POST   /torrents                        adds a torrent, see below
+//	GET    /torrents/<info hash>            describes a torrent
+//	DELETE /torrents/<info hash>            stops and removes a torrent
+//	POST   /torrents/<info hash>/pause      pauses a torrent
+//	POST   /torrents/<info hash>/resume     starts a paused torrent again
+//	GET    /torrents/<info hash>/files      lists the files of a torrent and their priorities
+//	PUT    /torrents/<info hash>/files/<i>  changes the priority of a file
+//	GET    /torrents/<info hash>/peers      lists the connected peers
+//	GET    /torrents/<info hash>/trackers   lists the trackers and how announces went
+//	GET    /torrents/<info hash>/limits     returns the torrent's rate limits
+//	PUT    /torrents/<info hash>/limits     changes the torrent's rate limits
+//	GET    /limits                          returns the client-wide rate limits
+//	PUT    /limits                          changes the client-wide rate limits
+//
+// A torrent is added from a .torrent file sent as the body with Content-Type
+// application/x-bittorrent, from a multipart form with the file in its "torrent" field or a magnet
+// link in its "magnet" field, or from a JSON object with a "magnet" link. It's started right away
+// unless the "paused" query parameter, form field or JSON field is true.
+//
+// Errors are answered with a JSON object holding an "error" message.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saicheems/gotorrent/client"
+)
+
+// maxTorrentSize bounds the size of uploaded .torrent files.
+const maxTorrentSize = 10 << 20
+
+// Torrent describes a torrent.
+type Torrent struct {
+	InfoHash string `json:"info_hash"`
+	Name     string `json:"name"`
+	// State is running or paused.
+	State string `json:"state"`
+	// Error is why the last session of the torrent failed, if it did.
+	Error string `json:"error,omitempty"`
+	// Length and Completed are 0 until the metadata of a magnet link is known.
+	Length       int64   `json:"length"`
+	Completed    int64   `json:"completed"`
+	Progress     float64 `json:"progress"`
+	Downloaded   int64   `json:"downloaded"`
+	Uploaded     int64   `json:"uploaded"`
+	DownloadRate int64   `json:"download_rate"`
+	UploadRate   int64   `json:"upload_rate"`
+	Peers        int     `json:"peers"`
+}
+
+// File describes a file of a torrent.
+type File struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Priority string `json:"priority"`
+}
+
+// Peer describes a connected peer.
+type Peer struct {
+	Addr           string `json:"addr"`
+	Client         string `json:"client,omitempty"`
+	ClientVersion  string `json:"client_version,omitempty"`
+	AmChoking      bool   `json:"am_choking"`
+	AmInterested   bool   `json:"am_interested"`
+	PeerChoking    bool   `json:"peer_choking"`
+	PeerInterested bool   `json:"peer_interested"`
+	HashFailures   int    `json:"hash_failures"`
+}
+
+// Tracker describes the announces to a tracker. The times are omitted if they're unknown.
+type Tracker struct {
+	URL          string     `json:"url"`
+	LastAnnounce *time.Time `json:"last_announce,omitempty"`
+	NextAnnounce *time.Time `json:"next_announce,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	Peers        int        `json:"peers"`
+	Seeders      int        `json:"seeders"`
+	Leechers     int        `json:"leechers"`
+}
+
+// Limits are upload and download limits in bytes per second, 0 for no limit.
+type Limits struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// errorResponse is the body of an error response.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler serves the API for a client.
+type Handler struct {
+	c     *client.Client
+	token string
+}
+
+// NewHandler returns a handler serving the API for c to requests carrying token. An empty token
+// refuses every request.
+func NewHandler(c *client.Client, token string) *Handler {
+	return &Handler{c: c, token: token}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gotorrent"`)
+		writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "limits":
+		h.serveLimits(w, r, nil)
+	case len(parts) == 1 && parts[0] == "torrents":
+		switch r.Method {
+		case "GET":
+			h.listTorrents(w)
+		case "POST":
+			h.addTorrent(w, r)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	case len(parts) >= 2 && parts[0] == "torrents":
+		t, ok := h.torrent(parts[1])
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("no such torrent"))
+			return
+		}
+		h.serveTorrent(w, r, t, parts[2:])
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// authorized returns whether r carries the API token.
+func (h *Handler) authorized(r *http.Request) bool {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") {
+		return false
+	}
+	token = token[len("Bearer "):]
+	return h.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+// torrent returns the torrent with the hex encoded info hash.
+func (h *Handler) torrent(hash string) (*client.Torrent, bool) {
+	infoHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, false
+	}
+	return h.c.Torrent(string(infoHash))
+}
+
+// serveTorrent serves the requests about a single torrent. rest is what follows the info hash in
+// the path.
+func (h *Handler) serveTorrent(w http.ResponseWriter, r *http.Request, t *client.Torrent, rest []string) {
+	if len(rest) == 0 {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, torrentInfo(t))
+		case "DELETE":
+			if err := t.Stop(); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+		return
+	}
+	switch {
+	case len(rest) == 1 && (rest[0] == "pause" || rest[0] == "resume"):
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		if rest[0] == "pause" {
+			t.Pause()
+		} else if err := t.Start(context.Background()); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, torrentInfo(t))
+	case len(rest) == 1 && rest[0] == "files":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, files(t))
+	case len(rest) == 2 && rest[0] == "files":
+		h.setPriority(w, r, t, rest[1])
+	case len(rest) == 1 && rest[0] == "peers":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, peers(t))
+	case len(rest) == 1 && rest[0] == "trackers":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, trackers(t))
+	case len(rest) == 1 && rest[0] == "limits":
+		h.serveLimits(w, r, t)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// listTorrents lists every torrent.
+func (h *Handler) listTorrents(w http.ResponseWriter) {
+	torrents := make([]Torrent, 0)
+	for _, t := range h.c.Torrents() {
+		torrents = append(torrents, torrentInfo(t))
+	}
+	writeJSON(w, http.StatusOK, torrents)
+}
+
+// addTorrent adds a torrent as described in the package documentation.
+func (h *Handler) addTorrent(w http.ResponseWriter, r *http.Request) {
+	paused, _ := strconv.ParseBool(r.URL.Query().Get("paused"))
+	var t *client.Torrent
+	var err error
+	ct := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(ct, "application/x-bittorrent"):
+		t, err = h.c.AddTorrentReader(io.LimitReader(r.Body, maxTorrentSize))
+	case strings.HasPrefix(ct, "multipart/form-data"):
+		if err := r.ParseMultipartForm(maxTorrentSize); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if p, err := strconv.ParseBool(r.FormValue("paused")); err == nil {
+			paused = p
+		}
+		if magnet := r.FormValue("magnet"); magnet != "" {
+			t, err = h.c.AddMagnet(magnet)
+			break
+		}
+		f, _, ferr := r.FormFile("torrent")
+		if ferr != nil {
+			writeError(w, http.StatusBadRequest, errors.New(`form needs a "torrent" file or a "magnet" link`))
+			return
+		}
+		defer f.Close()
+		t, err = h.c.AddTorrentReader(f)
+	case strings.HasPrefix(ct, "application/json"):
+		var req struct {
+			Magnet string `json:"magnet"`
+			Paused bool   `json:"paused"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxTorrentSize)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Magnet == "" {
+			writeError(w, http.StatusBadRequest, errors.New(`a "magnet" link is required`))
+			return
+		}
+		paused = paused || req.Paused
+		t, err = h.c.AddMagnet(req.Magnet)
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", ct))
+		return
+	}
+	switch {
+	case err == client.ErrDuplicateTorrent:
+		writeError(w, http.StatusConflict, err)
+		return
+	case err == client.ErrClientClosed:
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !paused {
+		if err := t.Start(context.Background()); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	w.Header().Set("Location", "torrents/"+hex.EncodeToString([]byte(t.InfoHash())))
+	writeJSON(w, http.StatusCreated, torrentInfo(t))
+}
+
+// setPriority changes the priority of the file of t at index to the "priority" of the JSON object
+// in the body.
+func (h *Handler) setPriority(w http.ResponseWriter, r *http.Request, t *client.Torrent, index string) {
+	if r.Method != "PUT" {
+		methodNotAllowed(w, "PUT")
+		return
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		writeError(w, http.StatusNotFound, client.ErrNoSuchFile)
+		return
+	}
+	var req struct {
+		Priority string `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p, err := client.ParsePriority(req.Priority)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch err := t.SetFilePriority(i, p); err {
+	case nil:
+	case client.ErrNoSuchFile:
+		writeError(w, http.StatusNotFound, err)
+		return
+	case client.ErrNoMetadata:
+		writeError(w, http.StatusConflict, err)
+		return
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, files(t)[i])
+}
+
+// serveLimits reads and changes the rate limits of t, or the client-wide ones if t is nil.
+func (h *Handler) serveLimits(w http.ResponseWriter, r *http.Request, t *client.Torrent) {
+	get, set := h.c.RateLimits, h.c.SetRateLimits
+	if t != nil {
+		get, set = t.RateLimits, t.SetRateLimits
+	}
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var l Limits
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if l.Upload < 0 || l.Download < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limits can't be negative"))
+			return
+		}
+		set(l.Upload, l.Download)
+	default:
+		methodNotAllowed(w, "GET, PUT")
+		return
+	}
+	up, down := get()
+	writeJSON(w, http.StatusOK, Limits{Upload: up, Download: down})
+}
+
+// torrentInfo describes t.
+func torrentInfo(t *client.Torrent) Torrent {
+	s := t.Stats()
+	info := Torrent{
+		InfoHash:     hex.EncodeToString([]byte(t.InfoHash())),
+		Name:         t.Name(),
+		State:        "paused",
+		Length:       s.Length,
+		Completed:    s.BytesCompleted,
+		Downloaded:   s.Downloaded,
+		Uploaded:     s.Uploaded,
+		DownloadRate: s.DownloadRate,
+		UploadRate:   s.UploadRate,
+		Peers:        s.Peers,
+	}
+	if s.Running {
+		info.State = "running"
+	}
+	if err := t.Err(); err != nil {
+		info.Error = err.Error()
+	}
+	if s.Length > 0 {
+		info.Progress = float64(s.BytesCompleted) / float64(s.Length)
+	}
+	return info
+}
+
+// files describes the files of t, none until its metadata is known.
+func files(t *client.Torrent) []File {
+	files := make([]File, 0)
+	priorities := t.FilePriorities()
+	for i, f := range t.Files() {
+		files = append(files, File{Index: i, Path: strings.Join(f.Path, "/"), Length: f.Length, Priority: priorities[i].String()})
+	}
+	return files
+}
+
+// peers describes the connected peers of t.
+func peers(t *client.Torrent) []Peer {
+	peers := make([]Peer, 0)
+	for _, p := range t.Peers() {
+		peers = append(peers, Peer{
+			Addr:           p.Addr.String(),
+			Client:         p.Client,
+			ClientVersion:  p.ClientVersion,
+			AmChoking:      p.AmChoking,
+			AmInterested:   p.AmInterested,
+			PeerChoking:    p.PeerChoking,
+			PeerInterested: p.PeerInterested,
+			HashFailures:   p.HashFailures,
+		})
+	}
+	return peers
+}
+
+// trackers describes the trackers of t.
+func trackers(t *client.Torrent) []Tracker {
+	trackers := make([]Tracker, 0)
+	for _, tr := range t.Trackers() {
+		info := Tracker{URL: tr.URL, Peers: tr.Peers, Seeders: tr.Seeders, Leechers: tr.Leechers}
+		if last := tr.LastAnnounce; !last.IsZero() {
+			info.LastAnnounce = &last
+		}
+		if next := tr.NextAnnounce; !next.IsZero() {
+			info.NextAnnounce = &next
+		}
+		if tr.Err != nil {
+			info.Error = tr.Err.Error()
+		}
+		trackers = append(trackers, info)
+	}
+	return trackers
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
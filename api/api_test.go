@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/saicheems/gotorrent/client"
+	"github.com/saicheems/gotorrent/internal/testclient"
+	"github.com/saicheems/gotorrent/internal/testtorrent"
+	"github.com/stretchr/testify/assert"
+)
+
+const token = "secret"
+
+// do sends a request with the API token and decodes the JSON response into v, if it's not nil.
+func do(t *testing.T, method, url, contentType string, body []byte, v interface{}) *http.Response {
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+func TestAuth(t *testing.T) {
+	assert := assert.New(t)
+	c, err := client.NewClient(&client.Config{ListenAddr: "127.0.0.1:0"})
+	assert.Nil(err)
+	defer c.Close()
+	for _, tc := range []struct {
+		token, header string
+		code          int
+	}{
+		{token, "", http.StatusUnauthorized},
+		{token, "Bearer wrong", http.StatusUnauthorized},
+		{token, token, http.StatusUnauthorized},
+		{token, "Bearer " + token, http.StatusOK},
+		{"", "Bearer ", http.StatusUnauthorized},
+	} {
+		ts := httptest.NewServer(NewHandler(c, tc.token))
+		req, _ := http.NewRequest("GET", ts.URL+"/torrents", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if assert.Nil(err) {
+			resp.Body.Close()
+			assert.Equal(tc.code, resp.StatusCode, tc.header)
+		}
+		ts.Close()
+	}
+}
+
+func TestTorrents(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 100000)
+	rand.Read(data)
+	c, seeded := testclient.Seed(t, "seeded.bin", data)
+	defer c.Close()
+	hash := hex.EncodeToString([]byte(seeded.InfoHash()))
+	ts := httptest.NewServer(NewHandler(c, token))
+	defer ts.Close()
+	url := ts.URL + "/torrents/" + hash
+
+	var list []Torrent
+	assert.Equal(http.StatusOK, do(t, "GET", ts.URL+"/torrents", "", nil, &list).StatusCode)
+	if assert.Equal(1, len(list)) {
+		assert.Equal(Torrent{InfoHash: hash, Name: "seeded.bin", State: "running", Length: 100000, Completed: 100000, Progress: 1}, list[0])
+	}
+
+	var tor Torrent
+	assert.Equal(http.StatusOK, do(t, "POST", url+"/pause", "", nil, &tor).StatusCode)
+	assert.Equal("paused", tor.State)
+	assert.Equal(http.StatusOK, do(t, "POST", url+"/resume", "", nil, &tor).StatusCode)
+	assert.Equal("running", tor.State)
+	assert.Equal(http.StatusMethodNotAllowed, do(t, "GET", url+"/pause", "", nil, nil).StatusCode)
+
+	var files []File
+	assert.Equal(http.StatusOK, do(t, "GET", url+"/files", "", nil, &files).StatusCode)
+	assert.Equal([]File{{Index: 0, Path: "seeded.bin", Length: 100000, Priority: "normal"}}, files)
+	var f File
+	assert.Equal(http.StatusOK, do(t, "PUT", url+"/files/0", "application/json", []byte(`{"priority":"high"}`), &f).StatusCode)
+	assert.Equal("high", f.Priority)
+	assert.Equal([]client.Priority{client.PriorityHigh}, mustTorrent(t, c, hash).FilePriorities())
+	assert.Equal(http.StatusBadRequest, do(t, "PUT", url+"/files/0", "application/json", []byte(`{"priority":"urgent"}`), nil).StatusCode)
+	assert.Equal(http.StatusNotFound, do(t, "PUT", url+"/files/1", "application/json", []byte(`{"priority":"low"}`), nil).StatusCode)
+
+	var limits Limits
+	assert.Equal(http.StatusOK, do(t, "PUT", url+"/limits", "application/json", []byte(`{"upload":1000,"download":2000}`), &limits).StatusCode)
+	assert.Equal(Limits{Upload: 1000, Download: 2000}, limits)
+	up, down := mustTorrent(t, c, hash).RateLimits()
+	assert.Equal([]int64{1000, 2000}, []int64{up, down})
+	assert.Equal(http.StatusOK, do(t, "PUT", ts.URL+"/limits", "application/json", []byte(`{"upload":3000}`), &limits).StatusCode)
+	assert.Equal(Limits{Upload: 3000}, limits)
+	assert.Equal(http.StatusOK, do(t, "GET", ts.URL+"/limits", "", nil, &limits).StatusCode)
+	assert.Equal(Limits{Upload: 3000}, limits)
+	assert.Equal(http.StatusBadRequest, do(t, "PUT", ts.URL+"/limits", "application/json", []byte(`{"upload":-1}`), nil).StatusCode)
+
+	var peers []Peer
+	assert.Equal(http.StatusOK, do(t, "GET", url+"/peers", "", nil, &peers).StatusCode)
+	assert.Equal([]Peer{}, peers)
+	var trackers []Tracker
+	assert.Equal(http.StatusOK, do(t, "GET", url+"/trackers", "", nil, &trackers).StatusCode)
+	assert.Equal([]Tracker{}, trackers)
+
+	assert.Equal(http.StatusNoContent, do(t, "DELETE", url, "", nil, nil).StatusCode)
+	assert.Equal(http.StatusNotFound, do(t, "GET", url, "", nil, nil).StatusCode)
+	assert.Equal(0, len(c.Torrents()))
+	for _, path := range []string{"/torrents/nothex", "/torrents/" + strings.Repeat("00", 20), "/nothing"} {
+		assert.Equal(http.StatusNotFound, do(t, "GET", ts.URL+path, "", nil, nil).StatusCode, path)
+	}
+}
+
+func mustTorrent(t *testing.T, c *client.Client, hash string) *client.Torrent {
+	infoHash, _ := hex.DecodeString(hash)
+	tor, ok := c.Torrent(string(infoHash))
+	if !ok {
+		t.Fatalf("no torrent %s", hash)
+	}
+	return tor
+}
+
+func TestAddTorrent(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gotorrent")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	c, err := client.NewClient(&client.Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+	ts := httptest.NewServer(NewHandler(c, token))
+	defer ts.Close()
+
+	// A .torrent file as the body.
+	raw, infoHash := testtorrent.Make("raw.bin", make([]byte, 1000), 1<<14, "")
+	rawHash := hex.EncodeToString([]byte(infoHash))
+	var tor Torrent
+	resp := do(t, "POST", ts.URL+"/torrents?paused=true", "application/x-bittorrent", raw, &tor)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	assert.Equal("torrents/"+rawHash, resp.Header.Get("Location"))
+	assert.Equal(Torrent{InfoHash: rawHash, Name: "raw.bin", State: "paused", Length: 1000}, tor)
+	assert.Equal(http.StatusConflict, do(t, "POST", ts.URL+"/torrents", "application/x-bittorrent", raw, nil).StatusCode)
+	assert.Equal(http.StatusBadRequest, do(t, "POST", ts.URL+"/torrents", "application/x-bittorrent", []byte("garbage"), nil).StatusCode)
+
+	// A .torrent file uploaded in a form.
+	form, infoHash := testtorrent.Make("form.bin", make([]byte, 2000), 1<<14, "")
+	formHash := hex.EncodeToString([]byte(infoHash))
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("torrent", "form.torrent")
+	fw.Write(form)
+	mw.WriteField("paused", "true")
+	mw.Close()
+	assert.Equal(http.StatusCreated, do(t, "POST", ts.URL+"/torrents", mw.FormDataContentType(), body.Bytes(), &tor).StatusCode)
+	assert.Equal(Torrent{InfoHash: formHash, Name: "form.bin", State: "paused", Length: 2000}, tor)
+
+	// A magnet link in JSON. Its files aren't known until the metadata is fetched.
+	magnetHash := strings.Repeat("ab", 20)
+	magnet := `{"magnet":"magnet:?xt=urn:btih:` + magnetHash + `&dn=magnet.bin","paused":true}`
+	assert.Equal(http.StatusCreated, do(t, "POST", ts.URL+"/torrents", "application/json", []byte(magnet), &tor).StatusCode)
+	assert.Equal(Torrent{InfoHash: magnetHash, Name: "magnet.bin", State: "paused"}, tor)
+	var files []File
+	assert.Equal(http.StatusOK, do(t, "GET", ts.URL+"/torrents/"+magnetHash+"/files", "", nil, &files).StatusCode)
+	assert.Equal([]File{}, files)
+	assert.Equal(http.StatusConflict, do(t, "PUT", ts.URL+"/torrents/"+magnetHash+"/files/0", "application/json", []byte(`{"priority":"low"}`), nil).StatusCode)
+	assert.Equal(http.StatusBadRequest, do(t, "POST", ts.URL+"/torrents", "application/json", []byte(`{}`), nil).StatusCode)
+	assert.Equal(http.StatusUnsupportedMediaType, do(t, "POST", ts.URL+"/torrents", "text/plain", nil, nil).StatusCode)
+
+	var list []Torrent
+	do(t, "GET", ts.URL+"/torrents", "", nil, &list)
+	assert.Equal(3, len(list))
+}
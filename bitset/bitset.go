@@ -1,6 +1,11 @@
 // Package bitset implements a bitset structure to be used for bittorrent.
 package bitset
 
+import "errors"
+
+// ErrInvalidLength is returned by NewFromBytes when the data doesn't describe exactly n bits.
+var ErrInvalidLength = errors.New("bitset: data doesn't match bit length")
+
 type BitSet struct {
 	length int
 	data   []byte
@@ -14,6 +19,20 @@ func New(n int) *BitSet {
 	return b
 }
 
+// NewFromBytes returns a BitSet of n bits backed by a copy of data, as sent in a bitfield message.
+// The data must be exactly long enough to hold n bits and any spare bits at the end must be zero.
+func NewFromBytes(n int, data []byte) (*BitSet, error) {
+	b := New(n)
+	if len(data) != len(b.data) {
+		return nil, ErrInvalidLength
+	}
+	copy(b.data, data)
+	if n%8 != 0 && b.data[len(b.data)-1]&(0xff>>uint(n%8)) != 0 {
+		return nil, ErrInvalidLength
+	}
+	return b, nil
+}
+
 func (b *BitSet) checkRange(n int) {
 	if n < 0 || n >= b.length {
 		panic("index out of range")
@@ -45,6 +64,29 @@ func (b *BitSet) Bytes() []byte {
 	return b.data
 }
 
+// Len returns the number of bits in the set.
+func (b *BitSet) Len() int {
+	return b.length
+}
+
+// Count returns the number of bits set to 1.
+func (b *BitSet) Count() int {
+	count := 0
+	for _, v := range b.data {
+		for ; v != 0; v &= v - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// Clone returns an independent copy of the set.
+func (b *BitSet) Clone() *BitSet {
+	c := New(b.length)
+	copy(c.data, b.data)
+	return c
+}
+
 // FirstZeroBit returns the index of the first zeroed bit in the set.
 // TODO: Mega inefficient, redo!!
 func (b *BitSet) FirstZeroBit() int {
@@ -41,3 +41,27 @@ func TestCheck(t *testing.T) {
 	b.Set(8)
 	assert.Equal(t, true, b.Check(8), "they should be equal")
 }
+
+func TestNewFromBytes(t *testing.T) {
+	b, err := NewFromBytes(9, []byte{65, 128})
+	assert.Nil(t, err)
+	assert.Equal(t, true, b.Check(1), "they should be equal")
+	assert.Equal(t, true, b.Check(8), "they should be equal")
+	assert.Equal(t, 3, b.Count(), "they should be equal")
+
+	_, err = NewFromBytes(9, []byte{65})
+	assert.Equal(t, ErrInvalidLength, err, "they should be equal")
+	// Spare bits past the end must be zero.
+	_, err = NewFromBytes(9, []byte{0, 64})
+	assert.Equal(t, ErrInvalidLength, err, "they should be equal")
+}
+
+func TestClone(t *testing.T) {
+	b := New(9)
+	b.Set(3)
+	c := b.Clone()
+	c.Set(4)
+	assert.Equal(t, 1, b.Count(), "they should be equal")
+	assert.Equal(t, 2, c.Count(), "they should be equal")
+	assert.Equal(t, 9, c.Len(), "they should be equal")
+}
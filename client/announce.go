@@ -0,0 +1,187 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/saicheems/gotorrent/torrent"
+)
+
+const (
+	// announceRetry is how long to wait before retrying a failed announce.
+	announceRetry = 5 * time.Second
+	// stoppedTimeout bounds how long shutdown waits on the stopped announce.
+	stoppedTimeout = 5 * time.Second
+	// metadataLeft is reported as the bytes left for a magnet link whose size isn't known yet.
+	metadataLeft = 1 << 14
+)
+
+// announcer periodically announces to the tracker and passes the peers it returns on to addrs.
+// When ctx is cancelled it sends a final stopped announce if the tracker knows about us.
+func (t *Torrent) announcer(ctx context.Context, addrs chan<- string) {
+	cfg := t.client.config
+	addr := cfg.ListenAddr
+	if ln := t.client.ListenAddr(); ln != nil {
+		addr = ln.String()
+	}
+	meta := t.MetaInfo()
+	tr := torrent.NewFromMetaInfo(cfg.PeerID, localPort(addr), meta)
+	tr.AnnounceURL = t.client.announceURL(meta)
+	if tr.AnnounceURL == "" {
+		return
+	}
+	// Only a download that finishes while we're running is reported as completed. The files may not
+	// be open yet, so whether they were already complete is only known once they are.
+	var completed <-chan struct{}
+	if t.left() > 0 {
+		completed = t.completeChan()
+	}
+	log := t.log.With("subsystem", "tracker", "url", tr.AnnounceURL)
+	started := false
+	for {
+		log.Debug("announcing", "event", tr.Event)
+		t.fillAnnounce(tr)
+		wait := cfg.AnnouncePeriod
+		start := time.Now()
+		annResp, err := torrent.AnnounceClient(ctx, t.client.http, tr.GetAnnounceURL())
+		if ctx.Err() == nil {
+			t.client.announceLatency.Observe(time.Since(start).Seconds())
+			atomic.AddInt64(&t.announces, 1)
+		}
+		if err == nil && annResp.FailureReason != "" {
+			err = fmt.Errorf("tracker failure: %s", annResp.FailureReason)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warn("announce failed", "err", err)
+				atomic.AddInt64(&t.announceFailures, 1)
+				t.announced(tr.AnnounceURL, nil, err, time.Now().Add(announceRetry))
+			}
+			wait = announceRetry
+		} else {
+			started = true
+			tr.Event = ""
+			if min := time.Duration(annResp.MinInterval) * time.Second; min > wait {
+				wait = min
+			}
+			t.announced(tr.AnnounceURL, annResp, nil, time.Now().Add(wait))
+			for _, addr := range annResp.PeerAddresses() {
+				select {
+				case addrs <- addr:
+				case <-ctx.Done():
+				}
+			}
+		}
+		next := time.After(wait)
+	waiting:
+		for {
+			select {
+			case <-next:
+				break waiting
+			case <-completed:
+				completed = nil
+				if !t.openedComplete() {
+					tr.Event = "completed"
+					break waiting
+				}
+			case <-ctx.Done():
+				if started {
+					t.announceStopped(tr)
+				}
+				return
+			}
+		}
+	}
+}
+
+// TrackerInfo describes the announces to a torrent's tracker.
+type TrackerInfo struct {
+	URL string
+	// LastAnnounce is when the tracker last answered, zero if it never has.
+	LastAnnounce time.Time
+	// NextAnnounce is when we announce next, zero if the torrent isn't running.
+	NextAnnounce time.Time
+	// Err is why the last announce failed, nil if it went through.
+	Err error
+	// Peers is the number of peers the tracker handed out last. Seeders and Leechers are the
+	// numbers of complete and incomplete peers it reported.
+	Peers    int
+	Seeders  int
+	Leechers int
+}
+
+// Trackers returns the state of the torrent's tracker, or nil if it has none.
+func (t *Torrent) Trackers() []TrackerInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := t.tracker
+	if info.URL == "" {
+		info.URL = t.client.announceURL(t.meta)
+	}
+	if info.URL == "" {
+		return nil
+	}
+	if t.cancel == nil {
+		info.NextAnnounce = time.Time{}
+	}
+	return []TrackerInfo{info}
+}
+
+// announceURL returns the URL of the tracker a torrent with metainfo m announces to, empty if
+// there's none.
+func (c *Client) announceURL(m *torrent.MetaInfo) string {
+	if m.Announce != "" {
+		return m.Announce
+	}
+	return c.config.Tracker
+}
+
+// announced records the outcome of an announce to url and when the next one is due.
+func (t *Torrent) announced(url string, resp *torrent.AnnounceResponse, err error, next time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tracker.URL = url
+	t.tracker.NextAnnounce = next
+	t.tracker.Err = err
+	if err != nil {
+		return
+	}
+	t.tracker.LastAnnounce = time.Now()
+	t.tracker.Peers = len(resp.PeerAddresses())
+	t.tracker.Seeders, t.tracker.Leechers = resp.Complete, resp.Incomplete
+}
+
+// openedComplete returns whether every wanted piece was already on disk when the files were opened.
+func (t *Torrent) openedComplete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.completeAtOpen
+}
+
+// announceStopped tells the tracker we're leaving the swarm.
+func (t *Torrent) announceStopped(tr *torrent.Torrent) {
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+	defer cancel()
+	t.fillAnnounce(tr)
+	tr.Event = "stopped"
+	torrent.AnnounceClient(ctx, t.client.http, tr.GetAnnounceURL())
+}
+
+// localPort returns the ":port" part of a listen address, which is what the tracker is told.
+func localPort(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ":" + port
+}
+
+// fillAnnounce copies the current transfer totals into tr.
+func (t *Torrent) fillAnnounce(tr *torrent.Torrent) {
+	tr.Downloaded = atomic.LoadInt64(&t.downloaded)
+	tr.Uploaded = atomic.LoadInt64(&t.uploaded)
+	tr.Left = t.left()
+}
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Ban records a peer address we refuse connections to and from.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// Bans returns every banned address, oldest ban first.
+func (c *Client) Bans() []Ban {
+	c.banMu.Lock()
+	defer c.banMu.Unlock()
+	return c.banList()
+}
+
+// banList returns the bans sorted by time. c.banMu must be held.
+func (c *Client) banList() []Ban {
+	bans := make([]Ban, 0, len(c.bans))
+	for _, b := range c.bans {
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if !bans[i].Time.Equal(bans[j].Time) {
+			return bans[i].Time.Before(bans[j].Time)
+		}
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// Ban refuses connections to and from ip from now on and disconnects the peers at it. The ban list
+// is saved to the configured BanFile, the error is from saving it. Banning an address that's
+// already banned does nothing.
+func (c *Client) Ban(ip net.IP, reason string) error {
+	key := ip.String()
+	c.banMu.Lock()
+	if _, ok := c.bans[key]; ok {
+		c.banMu.Unlock()
+		return nil
+	}
+	c.log.Warn("banned peer", "peer", key, "reason", reason)
+	c.bans[key] = Ban{IP: key, Reason: reason, Time: time.Now()}
+	err := c.saveBans()
+	c.banMu.Unlock()
+	for _, t := range c.Torrents() {
+		t.disconnect(key)
+	}
+	return err
+}
+
+// Unban lifts the ban on ip. The error is from saving the ban list.
+func (c *Client) Unban(ip net.IP) error {
+	c.banMu.Lock()
+	defer c.banMu.Unlock()
+	delete(c.bans, ip.String())
+	return c.saveBans()
+}
+
+// banned returns whether ip is banned.
+func (c *Client) banned(ip net.IP) bool {
+	c.banMu.Lock()
+	defer c.banMu.Unlock()
+	_, ok := c.bans[ip.String()]
+	return ok
+}
+
+// loadBans reads the ban list from the configured BanFile. A missing file is an empty list.
+func (c *Client) loadBans() error {
+	c.bans = make(map[string]Ban)
+	if c.config.BanFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.config.BanFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("%s: %v", c.config.BanFile, err)
+	}
+	for _, b := range bans {
+		ip := net.ParseIP(b.IP)
+		if ip == nil {
+			return fmt.Errorf("%s: invalid address %q", c.config.BanFile, b.IP)
+		}
+		b.IP = ip.String()
+		c.bans[b.IP] = b
+	}
+	return nil
+}
+
+// saveBans writes the ban list to the configured BanFile, if there is one. The file is replaced
+// in one go so a crash never leaves half a list behind. c.banMu must be held.
+func (c *Client) saveBans() error {
+	path := c.config.BanFile
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.banList(), "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// disconnect drops every peer at ip.
+func (t *Torrent) disconnect(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for p := range t.peers {
+		if p.ip == ip {
+			p.cancel()
+		}
+	}
+}
+
+// hashFailed counts a piece that failed verification against every peer that sent a block of it,
+// and bans the ones that have reached the client's BanThreshold. Peers that are already banned
+// aren't counted.
+func (t *Torrent) hashFailed(ips []string) {
+	threshold := t.client.config.BanThreshold
+	for _, ip := range ips {
+		if t.client.banned(net.ParseIP(ip)) {
+			continue
+		}
+		t.mu.Lock()
+		t.hashFailures[ip]++
+		n := t.hashFailures[ip]
+		t.mu.Unlock()
+		if n < threshold {
+			continue
+		}
+		reason := fmt.Sprintf("sent data for %d pieces that failed verification", n)
+		if err := t.client.Ban(net.ParseIP(ip), reason); err != nil {
+			t.log.Error("couldn't save bans", "err", err)
+		}
+	}
+}
+
+// blockRecord is a block of a piece that failed verification and the peer it came from.
+type blockRecord struct {
+	ip   string
+	hash [sha1.Size]byte
+}
+
+// smartBan finds out which peer sent the corrupt block of a piece that failed verification. It
+// remembers who sent each block of the pieces being downloaded, and the hashes of the blocks of
+// pieces that failed. Once such a piece verifies, peers whose blocks differ from the good ones are
+// the ones that sent bad data. It's owned by the writer.
+type smartBan struct {
+	sources map[int][]string              // Who sent each block of an active piece.
+	failed  map[int]map[int][]blockRecord // Blocks of failed pieces by piece and block number.
+}
+
+func newSmartBan() *smartBan {
+	return &smartBan{sources: make(map[int][]string), failed: make(map[int]map[int][]blockRecord)}
+}
+
+// received records that ip sent block b of a piece with numBlocks blocks. ip is empty for blocks
+// that don't come from a peer, like those from web seeds.
+func (sb *smartBan) received(b block, numBlocks int, ip string) {
+	src, ok := sb.sources[b.index]
+	if !ok {
+		src = make([]string, numBlocks)
+		sb.sources[b.index] = src
+	}
+	src[b.begin/blockSize] = ip
+}
+
+// suspect returns whether a piece has failed verification before.
+func (sb *smartBan) suspect(index int) bool {
+	_, ok := sb.failed[index]
+	return ok
+}
+
+// fail records the hashes of the blocks of a piece that failed verification, and returns every
+// peer that sent any of them. hashes may be nil if the piece couldn't be read back.
+func (sb *smartBan) fail(index int, hashes [][sha1.Size]byte) []string {
+	src := sb.sources[index]
+	delete(sb.sources, index)
+	records := sb.failed[index]
+	if records == nil {
+		records = make(map[int][]blockRecord)
+		sb.failed[index] = records
+	}
+	seen := make(map[string]bool)
+	var ips []string
+	for i, ip := range src {
+		if ip == "" {
+			continue
+		}
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+		if i < len(hashes) {
+			records[i] = append(records[i], blockRecord{ip: ip, hash: hashes[i]})
+		}
+	}
+	return ips
+}
+
+// pass forgets a piece that verified, and returns the peers that sent blocks of it differing from
+// the good hashes in an earlier attempt.
+func (sb *smartBan) pass(index int, hashes [][sha1.Size]byte) []string {
+	records := sb.failed[index]
+	delete(sb.sources, index)
+	delete(sb.failed, index)
+	seen := make(map[string]bool)
+	var ips []string
+	for i, rs := range records {
+		for _, r := range rs {
+			if i < len(hashes) && r.hash != hashes[i] && !seen[r.ip] {
+				seen[r.ip] = true
+				ips = append(ips, r.ip)
+			}
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// drop forgets who sent the blocks of a piece, which is either done or starting over.
+func (sb *smartBan) drop(index int) {
+	delete(sb.sources, index)
+}
@@ -0,0 +1,299 @@
+// Package client implements an embeddable BitTorrent client. A Client holds the settings shared by
+// every torrent, and each torrent added to it is controlled through its own Torrent handle.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saicheems/gotorrent/ipfilter"
+	"github.com/saicheems/gotorrent/metrics"
+	"github.com/saicheems/gotorrent/proxy"
+	"github.com/saicheems/gotorrent/ratelimit"
+	"github.com/saicheems/gotorrent/torrent"
+	"github.com/saicheems/gotorrent/utp"
+)
+
+// maxTorrentFileSize bounds the size of .torrent files fetched by AddTorrentURL.
+const maxTorrentFileSize = 10 << 20
+
+var (
+	// ErrClientClosed is returned when adding a torrent to a closed Client.
+	ErrClientClosed = errors.New("client closed")
+	// ErrDuplicateTorrent is returned when adding a torrent that was already added, along with the
+	// torrent that's already in the client.
+	ErrDuplicateTorrent = errors.New("torrent already added")
+	// ErrInvalidPeerID is returned by NewClient when the configured peer ID isn't 20 bytes.
+	ErrInvalidPeerID = errors.New("peer id must be 20 bytes")
+	// ErrProxyRequired is returned by NewClient when ProxyOnly is set without a Proxy.
+	ErrProxyRequired = errors.New("proxy only mode needs a proxy")
+	// ErrUnsafePath is returned for torrents with file paths that would escape the download
+	// directory, and for files on disk that are reached through a symlink.
+	ErrUnsafePath = errors.New("unsafe path")
+	// ErrPathInUse is returned when opening a torrent whose files would be stored where another
+	// torrent of the client stores its own.
+	ErrPathInUse = errors.New("path in use by another torrent")
+)
+
+// Client manages a set of torrents. Every torrent shares the client's peer ID, its listener for
+// incoming connections and its limit on the total number of connections.
+type Client struct {
+	config    Config
+	log       *slog.Logger
+	connSlots chan struct{}
+	closing   chan struct{} // Closed when the client is closed.
+
+	uploadLimit   *ratelimit.Limiter
+	downloadLimit *ratelimit.Limiter
+
+	dialer   proxy.Dialer // Dials peers, trackers and web seeds.
+	http     *http.Client // Talks to trackers and web seeds.
+	utpProxy sync.Once    // Sets up proxyUTP.
+
+	mu       sync.Mutex
+	torrents map[string]*Torrent
+	ln       net.Listener
+	utp      *utp.Socket // Shares the listener's port, nil if uTP is disabled.
+	proxyUTP *utp.Socket // Dials uTP through a SOCKS5 proxy.
+	closed   bool
+	// maxUploadRate and maxDownloadRate are the limits outside the rate schedule, starting out
+	// as configured.
+	maxUploadRate   int64
+	maxDownloadRate int64
+	filter          *ipfilter.Filter
+	blocked         int64 // Connections refused by the filter or bans, accessed atomically.
+
+	rootsMu sync.Mutex
+	roots   map[string]*Torrent // Torrents by the lower cased name they're stored under, see claimRoot.
+
+	banMu sync.Mutex // Guards bans and the ban file.
+	bans  map[string]Ban
+
+	announceLatency *metrics.Histogram
+	writeLatency    *metrics.Histogram
+}
+
+// NewClient returns a Client using the settings in cfg. A nil cfg means DefaultConfig.
+func NewClient(cfg *Config) (*Client, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	c := new(Client)
+	c.config = cfg.withDefaults()
+	if c.config.PeerID == "" {
+		c.config.PeerID = GeneratePeerID()
+	}
+	if len(c.config.PeerID) != 20 {
+		return nil, ErrInvalidPeerID
+	}
+	c.log = c.config.Logger
+	if err := c.setProxy(); err != nil {
+		return nil, err
+	}
+	c.torrents = make(map[string]*Torrent)
+	c.roots = make(map[string]*Torrent)
+	c.connSlots = make(chan struct{}, c.config.MaxTotalConnections)
+	if err := c.ReloadBlocklists(); err != nil {
+		return nil, err
+	}
+	if err := c.loadBans(); err != nil {
+		return nil, err
+	}
+	c.closing = make(chan struct{})
+	c.announceLatency = metrics.NewHistogram(announceBuckets...)
+	c.writeLatency = metrics.NewHistogram(writeBuckets...)
+	c.maxUploadRate, c.maxDownloadRate = c.config.MaxUploadRate, c.config.MaxDownloadRate
+	c.uploadLimit = ratelimit.NewLimiter(0)
+	c.downloadLimit = ratelimit.NewLimiter(0)
+	c.applyRates(time.Now())
+	if len(c.config.RateSchedule) > 0 {
+		go c.rateScheduler()
+	}
+	return c, nil
+}
+
+// reserved returns the reserved handshake bytes advertising the extensions we support.
+func (c *Client) reserved() torrent.Reserved {
+	var r torrent.Reserved
+	r.SetExtensions()
+	r.SetFast()
+	return r
+}
+
+// Config returns the configuration the client is running with.
+func (c *Client) Config() Config {
+	return c.config
+}
+
+// AddTorrentFile adds the torrent described by the .torrent file at path.
+func (c *Client) AddTorrentFile(path string) (*Torrent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return c.AddTorrentReader(f)
+}
+
+// AddTorrentReader adds the torrent described by the bencoded metainfo read from r.
+func (c *Client) AddTorrentReader(r io.Reader) (*Torrent, error) {
+	m, info, err := torrent.ParseRaw(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.add(m, info)
+}
+
+// AddTorrentURL adds the torrent described by the .torrent file at url, which is fetched through
+// the configured proxy, if any.
+func (c *Client) AddTorrentURL(ctx context.Context, url string) (*Torrent, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return c.AddTorrentReader(io.LimitReader(resp.Body, maxTorrentFileSize))
+}
+
+// AddMetaInfo adds the torrent described by m. Since the original encoding of the info dictionary
+// isn't known, the metadata won't be shared with peers fetching it for a magnet link.
+func (c *Client) AddMetaInfo(m *torrent.MetaInfo) (*Torrent, error) {
+	return c.add(m, nil)
+}
+
+// AddMagnet adds the torrent described by a magnet link. Its metadata is fetched from peers once
+// the torrent is started.
+func (c *Client) AddMagnet(uri string) (*Torrent, error) {
+	m, err := torrent.ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	return c.add(m.MetaInfo(), nil)
+}
+
+func (c *Client) add(m *torrent.MetaInfo, info []byte) (*Torrent, error) {
+	t, err := newTorrent(c, m, info)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if existing, ok := c.torrents[m.InfoHash]; ok {
+		return existing, ErrDuplicateTorrent
+	}
+	c.torrents[m.InfoHash] = t
+	return t, nil
+}
+
+// claimRoot records that t stores its files under root, the file or directory named after the
+// torrent in the download directory. Case is ignored in case the filesystem does. It fails with
+// ErrPathInUse if another torrent already stores its files there.
+func (c *Client) claimRoot(root string, t *Torrent) error {
+	c.rootsMu.Lock()
+	defer c.rootsMu.Unlock()
+	key := strings.ToLower(root)
+	if owner, ok := c.roots[key]; ok && owner != t {
+		return fmt.Errorf("%w: %s", ErrPathInUse, root)
+	}
+	c.roots[key] = t
+	return nil
+}
+
+// releaseRoot forgets the root claimed by t, if any.
+func (c *Client) releaseRoot(t *Torrent) {
+	c.rootsMu.Lock()
+	defer c.rootsMu.Unlock()
+	for key, owner := range c.roots {
+		if owner == t {
+			delete(c.roots, key)
+		}
+	}
+}
+
+// remove forgets a stopped torrent so it can be added again.
+func (c *Client) remove(t *Torrent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.torrents[t.infoHash] == t {
+		delete(c.torrents, t.infoHash)
+	}
+}
+
+// Torrent returns the torrent with the given info hash.
+func (c *Client) Torrent(infoHash string) (*Torrent, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.torrents[infoHash]
+	return t, ok
+}
+
+// Torrents returns every torrent in the client.
+func (c *Client) Torrents() []*Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
+
+// Close stops every torrent, disconnecting their peers, telling trackers we've stopped and flushing
+// their data to disk, and closes the listener. The client can't be used afterwards.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		close(c.closing)
+	}
+	c.closed = true
+	ln, us, pu := c.ln, c.utp, c.proxyUTP
+	c.ln, c.utp, c.proxyUTP = nil, nil, nil
+	c.mu.Unlock()
+	var firstErr error
+	if ln != nil {
+		firstErr = ln.Close()
+	}
+	if us != nil {
+		us.Close()
+	}
+	if pu != nil {
+		pu.Close()
+	}
+	for _, t := range c.Torrents() {
+		if err := t.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// peerIDPrefix starts the peer IDs we generate, identifying the client in the Azureus style.
+const peerIDPrefix = "-GT0001-"
+
+// GeneratePeerID returns a 20 character string to serve as the PeerID of the client. It's
+// peerIDPrefix followed by random bytes.
+func GeneratePeerID() string {
+	peerId := make([]byte, 20-len(peerIDPrefix))
+	rand.Read(peerId)
+	return peerIDPrefix + string(peerId)
+}
@@ -0,0 +1,1214 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/saicheems/gotorrent/bitset"
+	"github.com/saicheems/gotorrent/internal/testtorrent"
+	"github.com/saicheems/gotorrent/metrics"
+	"github.com/saicheems/gotorrent/mse"
+	"github.com/saicheems/gotorrent/torrent"
+	"github.com/saicheems/gotorrent/utp"
+	"github.com/stretchr/testify/assert"
+)
+
+const seederID = "-seeder-seeder-seede"
+
+// freeAddr returns a loopback address that nothing is listening on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// newTracker returns a tracker that hands out the seeder's address to everyone but the seeder.
+func newTracker(seederAddr string) *httptest.Server {
+	host, port, _ := net.SplitHostPort(seederAddr)
+	p, _ := strconv.Atoi(port)
+	compact := string(net.ParseIP(host).To4()) + string([]byte{byte(p >> 8), byte(p)})
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers := compact
+		if r.URL.Query().Get("peer_id") == seederID {
+			peers = ""
+		}
+		bencode.Marshal(w, map[string]interface{}{"interval": 1800, "peers": peers})
+	}))
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gotorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDownload(t *testing.T) {
+	assert := assert.New(t)
+	seederAddr := freeAddr(t)
+	tracker := newTracker(seederAddr)
+	defer tracker.Close()
+	seedDir := tempDir(t)
+	defer os.RemoveAll(seedDir)
+	seeder, err := NewClient(&Config{ListenAddr: seederAddr, PeerID: seederID, DownloadDir: seedDir})
+	assert.Nil(err)
+	defer seeder.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// The seeder seeds every torrent from a single listener.
+	type testTorrent struct {
+		data     []byte
+		metainfo []byte
+		infoHash string
+		seed     *Torrent
+	}
+	torrents := make(map[string]*testTorrent)
+	for _, name := range []string{"reader.bin", "magnet.bin"} {
+		tt := &testTorrent{data: make([]byte, 100000)}
+		rand.Read(tt.data)
+		tt.metainfo, tt.infoHash = testtorrent.Make(name, tt.data, 1<<15, tracker.URL)
+		torrents[name] = tt
+		ioutil.WriteFile(filepath.Join(seedDir, name), tt.data, 0644)
+		tt.seed, err = seeder.AddTorrentReader(bytes.NewReader(tt.metainfo))
+		assert.Nil(err)
+		assert.Nil(tt.seed.Start(context.Background()))
+		assert.Nil(tt.seed.Wait(ctx))
+	}
+
+	// The leecher downloads both at once, one of them from a magnet link.
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	lr, err := c.AddTorrentReader(bytes.NewReader(torrents["reader.bin"].metainfo))
+	assert.Nil(err)
+	lm, err := c.AddMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%s&tr=%s", hex.EncodeToString([]byte(torrents["magnet.bin"].infoHash)), tracker.URL))
+	assert.Nil(err)
+	for name, lt := range map[string]*Torrent{"reader.bin": lr, "magnet.bin": lm} {
+		assert.Nil(lt.Start(ctx), name)
+	}
+	for name, lt := range map[string]*Torrent{"reader.bin": lr, "magnet.bin": lm} {
+		assert.Nil(lt.Wait(ctx), name)
+		out, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Equal(torrents[name].data, out, name)
+		assert.Equal(int64(100000), lt.Stats().BytesCompleted, name)
+	}
+	// The seeder knows the leecher's client from its peer ID and extension handshake.
+	peers := torrents["reader.bin"].seed.Peers()
+	if assert.Equal(1, len(peers)) {
+		assert.Equal("gotorrent", peers[0].Client)
+		assert.Equal("0.0.0.1", peers[0].ClientVersion)
+		assert.Equal(clientVersion, peers[0].ExtensionVersion)
+		assert.True(peers[0].Reserved.SupportsFast())
+		assert.Equal(c.Config().PeerID, peers[0].ID)
+	}
+	assert.NotNil(c.ListenAddr())
+	assert.Nil(c.Close())
+	assert.Equal(ErrTorrentStopped, lr.Start(ctx))
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+// serveFiles returns a web server serving files under a directory called name.
+func serveFiles(t *testing.T, name string, files []testtorrent.File) *httptest.Server {
+	dir := tempDir(t)
+	for _, f := range files {
+		path := filepath.Join(append([]string{dir, name}, f.Path...)...)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, f.Data, 0644)
+	}
+	ts := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return ts
+}
+
+func TestWebSeed(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+
+	// A multi-file torrent served by a plain file server, with pieces spanning files.
+	files := []testtorrent.File{
+		{Path: []string{"a.txt"}, Data: randomData(50000)},
+		{Path: []string{"sub dir", "b.bin"}, Data: randomData(70001)},
+		{Path: []string{"empty"}},
+		{Path: []string{"c"}, Data: randomData(3)},
+	}
+	fileServer := serveFiles(t, "multi", files)
+	defer fileServer.Close()
+	metainfo, _ := testtorrent.MakeMultiFile("multi", files, 1<<14, map[string]interface{}{"url-list": []string{fileServer.URL + "/"}})
+	multi, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+
+	// A single file torrent served by a seeding script that is busy at first.
+	data := randomData(100000)
+	single, infoHash := testtorrent.Make("single.bin", data, 1<<15, "")
+	busy := true
+	var mu sync.Mutex
+	script := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := r.URL.Query()
+		if busy {
+			busy = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "1")
+			return
+		}
+		piece, _ := strconv.Atoi(q.Get("piece"))
+		var begin, end int
+		_, err := fmt.Sscanf(q.Get("ranges"), "%d-%d", &begin, &end)
+		if q.Get("info_hash") != infoHash || err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(data[piece<<15+begin : piece<<15+end+1])
+	}))
+	defer script.Close()
+	var m map[string]interface{}
+	bencode.Unmarshal(bytes.NewReader(single), &m)
+	m["httpseeds"] = []interface{}{script.URL + "/seed?x=1"}
+	var buf bytes.Buffer
+	bencode.Marshal(&buf, m)
+	st, err := c.AddTorrentReader(&buf)
+	assert.Nil(err)
+
+	assert.Nil(multi.Start(ctx))
+	assert.Nil(st.Start(ctx))
+	assert.Nil(multi.Wait(ctx))
+	assert.Nil(st.Wait(ctx))
+	for _, f := range files {
+		out, err := ioutil.ReadFile(filepath.Join(append([]string{dir, "multi"}, f.Path...)...))
+		assert.Nil(err)
+		assert.Equal(len(f.Data), len(out), f.Path)
+		assert.True(bytes.Equal(f.Data, out), f.Path)
+	}
+	out, _ := ioutil.ReadFile(filepath.Join(dir, "single.bin"))
+	assert.Equal(data, out)
+	assert.Equal(int64(100000), st.Stats().Downloaded)
+}
+
+func TestWebSeedURL(t *testing.T) {
+	assert := assert.New(t)
+	single := &torrent.InfoDict{Name: "a b.iso", Length: 10}
+	multi := &torrent.InfoDict{Name: "dir", Files: []torrent.FileDict{{Length: 1, Path: []string{"x", "y#1"}}}}
+	for _, tc := range []struct {
+		url  string
+		info *torrent.InfoDict
+		want string
+	}{
+		{"http://host/files/", single, "http://host/files/a%20b.iso"},
+		{"http://host/files/name.iso", single, "http://host/files/name.iso"},
+		{"http://host/files/", multi, "http://host/files/dir/x/y%231"},
+		{"http://host/files", multi, "http://host/files/dir/x/y%231"},
+	} {
+		ws := &webSeed{url: tc.url}
+		assert.Equal(tc.want, ws.fileURL(tc.info, tc.info.FileList()[0]), tc.url)
+	}
+}
+
+func TestWebSeedResponse(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0"})
+	assert.Nil(err)
+	defer c.Close()
+	metainfo, _ := testtorrent.Make("a.bin", randomData(100), 1<<14, "")
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	var contentRange, retryAfter string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Range", contentRange)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(make([]byte, 10))
+	}))
+	defer server.Close()
+	ws := newWebSeed(tor, server.URL, false)
+	get := func() error {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Range", "bytes=10-19")
+		return ws.get(context.Background(), req, make([]byte, 10), false)
+	}
+
+	// Partial content has to be the range that was asked for.
+	contentRange = "bytes 10-19/100"
+	assert.Nil(get())
+	for _, contentRange = range []string{"bytes 0-9/100", "bytes 10-19", ""} {
+		assert.Equal(errWebSeedRange, get(), contentRange)
+	}
+
+	// Servers can't keep us away for longer than webSeedMaxRetry.
+	for retry, want := range map[string]time.Duration{"30": 30 * time.Second, "86400": webSeedMaxRetry, "99999999999999999": webSeedMaxRetry} {
+		retryAfter = retry
+		err := get()
+		if we, ok := err.(*webSeedError); assert.True(ok, retry) {
+			assert.Equal(want, we.retryAfter, retry)
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	assert := assert.New(t)
+	metainfo, infoHash := testtorrent.Make("test.bin", []byte("data"), 1<<15, "")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(tor.Start(context.Background()))
+
+	handshake := func(infoHash string) error {
+		conn, err := net.Dial("tcp", c.ListenAddr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = torrent.Handshake(conn, infoHash, "abcdefghijklmnopqrst", torrent.Reserved{})
+		return err
+	}
+	// Unknown torrents are rejected without an answer.
+	assert.Equal(io.EOF, handshake("abcdefghijklmnopqrst"))
+	assert.Nil(handshake(infoHash))
+}
+
+func TestEncryptionPolicy(t *testing.T) {
+	assert := assert.New(t)
+	metainfo, infoHash := testtorrent.Make("test.bin", []byte("data"), 1<<15, "")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// handshake connects to c, encrypting the connection if provide is set.
+	handshake := func(c *Client, provide mse.CryptoMethod, infoHash string) error {
+		conn, err := net.Dial("tcp", c.ListenAddr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if provide != 0 {
+			ec, err := mse.Initiate(conn, []byte(infoHash), provide)
+			if err != nil {
+				return err
+			}
+			conn = ec
+		}
+		_, err = torrent.Handshake(conn, infoHash, "abcdefghijklmnopqrst", torrent.Reserved{})
+		return err
+	}
+	for _, policy := range []EncryptionPolicy{EncryptionPreferred, EncryptionRequired, EncryptionDisabled} {
+		c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir, Encryption: policy})
+		assert.Nil(err)
+		tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+		assert.Nil(err)
+		assert.Nil(tor.Start(context.Background()))
+
+		assert.Equal(policy != EncryptionRequired, handshake(c, 0, infoHash) == nil, "plaintext, policy %d", policy)
+		assert.Equal(policy != EncryptionDisabled, handshake(c, mse.RC4, infoHash) == nil, "rc4, policy %d", policy)
+		assert.Equal(policy == EncryptionPreferred, handshake(c, mse.Plaintext, infoHash) == nil, "mse plaintext, policy %d", policy)
+		assert.NotNil(handshake(c, mse.RC4, "abcdefghijklmnopqrst"), "unknown skey, policy %d", policy)
+		assert.Nil(c.Close())
+	}
+}
+
+func TestTransport(t *testing.T) {
+	assert := assert.New(t)
+	newClient := func(disableUTP bool) *Client {
+		c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DisableUTP: disableUTP})
+		assert.Nil(err)
+		assert.Nil(c.listen())
+		return c
+	}
+	a, b, tcpOnly := newClient(false), newClient(false), newClient(true)
+	defer a.Close()
+	defer b.Close()
+	defer tcpOnly.Close()
+
+	conn, err := b.connect(context.Background(), a.ListenAddr().String())
+	assert.Nil(err)
+	assert.IsType(&utp.Conn{}, conn)
+	conn.Close()
+	conn, err = tcpOnly.connect(context.Background(), a.ListenAddr().String())
+	assert.Nil(err)
+	assert.IsType(&net.TCPConn{}, conn)
+	conn.Close()
+}
+
+func TestConnectionLimit(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewClient(&Config{MaxTotalConnections: 1})
+	assert.Nil(err)
+	assert.True(c.acquireConn())
+	assert.False(c.acquireConn())
+	c.releaseConn()
+	assert.True(c.acquireConn())
+}
+
+func TestSilentPeer(t *testing.T) {
+	assert := assert.New(t)
+	// The peer accepts connections and never says a word.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			accepted <- conn
+		}
+	}()
+	tracker := newTracker(ln.Addr().String())
+	defer tracker.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, policy := range []EncryptionPolicy{EncryptionDisabled, EncryptionPreferred} {
+		c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir, DisableUTP: true, Encryption: policy})
+		assert.Nil(err)
+		metainfo, _ := testtorrent.Make("silent.bin", randomData(1000), 1<<14, tracker.URL)
+		tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+		assert.Nil(err)
+		assert.Nil(tor.Start(context.Background()))
+		select {
+		case <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("peer wasn't dialed")
+		}
+		// Pausing doesn't wait on the handshake.
+		paused := make(chan struct{})
+		go func() {
+			tor.Pause()
+			close(paused)
+		}()
+		select {
+		case <-paused:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("pause blocked on a silent peer with %v", policy)
+		}
+		c.Close()
+	}
+}
+
+func TestAddTorrent(t *testing.T) {
+	assert := assert.New(t)
+	metainfo, infoHash := testtorrent.Make("test.bin", []byte("data"), 1<<15, "")
+	c, err := NewClient(nil)
+	assert.Nil(err)
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Equal(infoHash, tor.InfoHash())
+	assert.Equal("test.bin", tor.Name())
+	dup, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Equal(ErrDuplicateTorrent, err)
+	assert.Equal(tor, dup)
+	got, ok := c.Torrent(infoHash)
+	assert.True(ok)
+	assert.Equal(tor, got)
+
+	assert.Nil(tor.Stop())
+	assert.Equal(0, len(c.Torrents()))
+	assert.Equal(ErrTorrentStopped, tor.Wait(context.Background()))
+
+	assert.Nil(c.Close())
+	_, err = c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Equal(ErrClientClosed, err)
+
+	_, err = NewClient(&Config{PeerID: "short"})
+	assert.Equal(ErrInvalidPeerID, err)
+}
+
+func TestAddTorrentURL(t *testing.T) {
+	assert := assert.New(t)
+	metainfo, infoHash := testtorrent.Make("test.bin", []byte("data"), 1<<15, "")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/test.torrent" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(metainfo)
+	}))
+	defer ts.Close()
+	c, err := NewClient(nil)
+	assert.Nil(err)
+	defer c.Close()
+	tor, err := c.AddTorrentURL(context.Background(), ts.URL+"/test.torrent")
+	if assert.Nil(err) {
+		assert.Equal(infoHash, tor.InfoHash())
+	}
+	_, err = c.AddTorrentURL(context.Background(), ts.URL+"/missing.torrent")
+	assert.NotNil(err)
+}
+
+func TestRemove(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	files := []testtorrent.File{{Path: []string{"a.bin"}, Data: randomData(1000)}, {Path: []string{"sub", "b.bin"}, Data: randomData(2000)}}
+	metainfo, _ := testtorrent.MakeMultiFile("multi", files, 1<<15, nil)
+	for _, f := range files {
+		path := filepath.Join(append([]string{dir, "multi"}, f.Path...)...)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, f.Data, 0644)
+	}
+	// Files that aren't the torrent's stay.
+	ioutil.WriteFile(filepath.Join(dir, "other.bin"), nil, 0644)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.False(tor.Added().IsZero())
+	assert.Nil(tor.Start(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(tor.Wait(ctx))
+	assert.Nil(tor.Remove())
+	assert.Equal(0, len(c.Torrents()))
+	_, err = os.Stat(filepath.Join(dir, "multi"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "other.bin"))
+	assert.Nil(err)
+
+	// A torrent that never started hasn't used the files named like its own.
+	metainfo, _ = testtorrent.Make("other.bin", randomData(100), 1<<14, "")
+	tor, err = c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(tor.Remove())
+	_, err = os.Stat(filepath.Join(dir, "other.bin"))
+	assert.Nil(err)
+
+	// Nor has one that started next to a different file of the same name.
+	other := randomData(50)
+	ioutil.WriteFile(filepath.Join(dir, "other.bin"), other, 0644)
+	tor, err = c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(tor.Start(context.Background()))
+	for i := 0; i < 100 && tor.Stats().NumPieces == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(tor.Remove())
+	got, err := ioutil.ReadFile(filepath.Join(dir, "other.bin"))
+	assert.Nil(err)
+	assert.Equal(other, got)
+}
+
+func TestParseRate(t *testing.T) {
+	assert := assert.New(t)
+	for s, want := range map[string]int64{"0": 0, "500": 500, "100K": 100 << 10, "1.5m": 3 << 19, "2G": 2 << 30} {
+		got, err := ParseRate(s)
+		assert.Nil(err, s)
+		assert.Equal(want, got, s)
+	}
+	for _, s := range []string{"", "K", "-1", "10X"} {
+		_, err := ParseRate(s)
+		assert.NotNil(err, s)
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	assert := assert.New(t)
+	r, err := ParseRateRule("mon-fri 09:00-17:30 100K/1M")
+	assert.Nil(err)
+	assert.Equal(RateRule{
+		Days:            []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start:           9 * time.Hour,
+		End:             17*time.Hour + 30*time.Minute,
+		MaxUploadRate:   100 << 10,
+		MaxDownloadRate: 1 << 20,
+	}, r)
+	night, err := ParseRateRule("sat,sun 22:00-06:00 0/10K")
+	assert.Nil(err)
+	for _, s := range []string{"09:00-17:00", "mon-xyz 09:00-17:00 1/1", "9-17 1/1", "09:00-17:00 1"} {
+		_, err := ParseRateRule(s)
+		assert.NotNil(err, s)
+	}
+
+	// 2024-01-01 was a Monday.
+	monday := func(hour int) time.Time { return time.Date(2024, 1, 1, hour, 0, 0, 0, time.Local) }
+	c, err := NewClient(&Config{MaxUploadRate: 5000, RateSchedule: []RateRule{r, night}})
+	assert.Nil(err)
+	defer c.Close()
+	c.applyRates(monday(10))
+	up, down := c.RateLimits()
+	assert.Equal(int64(100<<10), up)
+	assert.Equal(int64(1<<20), down)
+	c.applyRates(monday(20))
+	up, down = c.RateLimits()
+	assert.Equal(int64(5000), up)
+	assert.Equal(int64(0), down)
+	c.applyRates(monday(-1)) // Sunday 23:00.
+	up, down = c.RateLimits()
+	assert.Equal(int64(0), up)
+	assert.Equal(int64(10<<10), down)
+	c.SetRateLimits(7000, 8000)
+	c.applyRates(monday(20))
+	up, down = c.RateLimits()
+	assert.Equal(int64(7000), up)
+	assert.Equal(int64(8000), down)
+}
+
+func TestRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewClient(&Config{MaxUploadRate: 1 << 20})
+	assert.Nil(err)
+	defer c.Close()
+	metainfo, _ := testtorrent.Make("test.bin", []byte("data"), 1<<15, "")
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	// The torrent's own limit is the tighter one here.
+	tor.SetRateLimits(20000, 0)
+	up, down := tor.RateLimits()
+	assert.Equal(int64(20000), up)
+	assert.Equal(int64(0), down)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	go io.Copy(ioutil.Discard, b)
+	conn := tor.limitConn(context.Background(), a)
+	start := time.Now()
+	// A second's worth goes out right away, the rest at the limit.
+	n, err := conn.Write(make([]byte, 30000))
+	assert.Nil(err)
+	assert.Equal(30000, n)
+	elapsed := time.Since(start)
+	assert.True(elapsed > 400*time.Millisecond && elapsed < 2*time.Second, "took %v", elapsed)
+
+	go b.Write(make([]byte, 100))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Reads aren't limited, so a cancelled context doesn't matter.
+	_, err = tor.limitConn(ctx, a).Read(make([]byte, 100))
+	assert.Nil(err)
+}
+
+func TestSelectFiles(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+
+	// a.txt fills pieces 0 and 1, b.bin shares piece 4 with c.txt.
+	files := []testtorrent.File{
+		{Path: []string{"a.txt"}, Data: randomData(2 << 14)},
+		{Path: []string{"sub", "b.bin"}, Data: randomData(40000)},
+		{Path: []string{"c.txt"}, Data: randomData(20000)},
+	}
+	fileServer := serveFiles(t, "multi", files)
+	defer fileServer.Close()
+	metainfo, _ := testtorrent.MakeMultiFile("multi", files, 1<<14, map[string]interface{}{"url-list": []string{fileServer.URL + "/"}})
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Equal(ErrNoSuchFile, tor.SelectFiles("3"))
+	assert.NotNil(tor.SelectFiles("*.iso"))
+	assert.Nil(tor.SelectFiles("sub/*.bin"))
+	assert.Equal([]Priority{PrioritySkip, PriorityNormal, PrioritySkip}, tor.FilePriorities())
+
+	assert.Nil(tor.Start(ctx))
+	assert.Nil(tor.Wait(ctx))
+	out, _ := ioutil.ReadFile(filepath.Join(dir, "multi", "sub", "b.bin"))
+	assert.True(bytes.Equal(files[1].Data, out))
+	assert.Equal(int64(0), tor.left())
+	// Skipped files are only written where they share a piece with a wanted one.
+	_, err = os.Stat(filepath.Join(dir, "multi", "a.txt"))
+	assert.True(os.IsNotExist(err))
+
+	assert.Nil(tor.SetFilePriority(0, PriorityHigh))
+	assert.Equal(int64(2<<14), tor.left())
+	assert.Nil(tor.Wait(ctx))
+	out, _ = ioutil.ReadFile(filepath.Join(dir, "multi", "a.txt"))
+	assert.True(bytes.Equal(files[0].Data, out))
+	assert.Equal(ErrNoSuchFile, tor.SetFilePriority(5, PriorityLow))
+
+	m, err := c.AddMagnet("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567")
+	assert.Nil(err)
+	assert.Equal(ErrNoMetadata, m.SetFilePriority(0, PriorityLow))
+	assert.Nil(m.Files())
+}
+
+func TestParsePriority(t *testing.T) {
+	assert := assert.New(t)
+	for _, p := range []Priority{PrioritySkip, PriorityLow, PriorityNormal, PriorityHigh} {
+		got, err := ParsePriority(p.String())
+		assert.Nil(err)
+		assert.Equal(p, got)
+	}
+	_, err := ParsePriority("urgent")
+	assert.NotNil(err)
+}
+
+func TestReader(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+
+	files := []testtorrent.File{
+		{Path: []string{"a.txt"}, Data: randomData(30000)},
+		{Path: []string{"b.bin"}, Data: randomData(200000)},
+	}
+	fileServer := serveFiles(t, "multi", files)
+	defer fileServer.Close()
+	metainfo, _ := testtorrent.MakeMultiFile("multi", files, 1<<14, map[string]interface{}{"url-list": []string{fileServer.URL + "/"}})
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	// With every file skipped only the pieces readers need are downloaded.
+	assert.Nil(tor.SelectFiles())
+	tor.SetSequential(true)
+	_, err = tor.NewReader(2)
+	assert.Equal(ErrNoSuchFile, err)
+	r, err := tor.NewReader(1)
+	assert.Nil(err)
+	r.SetReadahead(1 << 15)
+
+	// The reader blocks until the torrent is started.
+	got := make(chan []byte)
+	go func() {
+		buf := make([]byte, 1000)
+		n, err := io.ReadFull(r, buf)
+		assert.Nil(err)
+		got <- buf[:n]
+	}()
+	select {
+	case <-got:
+		t.Fatal("read before the torrent started")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Nil(tor.Start(ctx))
+	assert.Equal(files[1].Data[:1000], <-got)
+
+	pos, err := r.Seek(-50000, io.SeekEnd)
+	assert.Nil(err)
+	assert.Equal(int64(150000), pos)
+	rest, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.True(bytes.Equal(files[1].Data[150000:], rest))
+	_, err = r.Seek(-1, io.SeekStart)
+	assert.NotNil(err)
+	_, err = r.Seek(1000, io.SeekStart)
+	assert.Nil(err)
+	rest, err = ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.True(bytes.Equal(files[1].Data[1000:], rest))
+
+	// Closing unblocks a read of a piece that's never coming.
+	r2, err := tor.NewReader(0)
+	assert.Nil(err)
+	tor.Pause()
+	done := make(chan error)
+	go func() {
+		_, err := r2.Read(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(r2.Close())
+	assert.Equal(ErrReaderClosed, <-done)
+	assert.Nil(tor.Stop())
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(io.EOF, err)
+	r.Seek(0, io.SeekStart)
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(ErrTorrentStopped, err)
+}
+
+func TestIPFilter(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	list := filepath.Join(dir, "blocklist.p2p")
+	ioutil.WriteFile(list, []byte("Loopback:127.0.0.0-127.255.255.255\n"), 0644)
+	_, err := NewClient(&Config{Blocklists: []string{filepath.Join(dir, "missing")}})
+	assert.NotNil(err)
+
+	a, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", Blocklists: []string{list}, DisableUTP: true})
+	assert.Nil(err)
+	defer a.Close()
+	assert.Nil(a.listen())
+	b, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DisableUTP: true})
+	assert.Nil(err)
+	defer b.Close()
+	assert.Nil(b.listen())
+
+	// Outgoing connections are refused before dialing.
+	_, err = a.connect(context.Background(), b.ListenAddr().String())
+	assert.Equal(errBlocked, err)
+	assert.Equal(int64(1), a.BlockedConnections())
+	// Incoming ones are closed right after they're accepted.
+	conn, err := b.connect(context.Background(), a.ListenAddr().String())
+	assert.Nil(err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(io.EOF, err)
+	conn.Close()
+	assert.Equal(int64(2), a.BlockedConnections())
+
+	// Reloading picks up changes to the lists.
+	ioutil.WriteFile(list, []byte("# Nothing blocked\n"), 0644)
+	assert.Nil(a.ReloadBlocklists())
+	conn, err = a.connect(context.Background(), b.ListenAddr().String())
+	assert.Nil(err)
+	conn.Close()
+	ioutil.WriteFile(list, []byte("garbage\n"), 0644)
+	assert.NotNil(a.ReloadBlocklists())
+	assert.Equal(int64(2), a.BlockedConnections())
+}
+
+// connectProxy is an HTTP proxy that records the addresses it's asked to CONNECT to.
+type connectProxy struct {
+	*httptest.Server
+	mu      sync.Mutex
+	targets []string
+}
+
+func newConnectProxy() *connectProxy {
+	p := new(connectProxy)
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" || r.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		p.mu.Lock()
+		p.targets = append(p.targets, r.Host)
+		p.mu.Unlock()
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}))
+	return p
+}
+
+func (p *connectProxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func TestProxy(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewClient(&Config{ProxyOnly: true})
+	assert.Equal(ErrProxyRequired, err)
+	_, err = NewClient(&Config{Proxy: "gopher://example.com"})
+	assert.NotNil(err)
+
+	seederAddr := freeAddr(t)
+	tracker := newTracker(seederAddr)
+	defer tracker.Close()
+	data := randomData(50000)
+	metainfo, _ := testtorrent.Make("proxied.bin", data, 1<<14, tracker.URL)
+	seedDir := tempDir(t)
+	defer os.RemoveAll(seedDir)
+	ioutil.WriteFile(filepath.Join(seedDir, "proxied.bin"), data, 0644)
+	seeder, err := NewClient(&Config{ListenAddr: seederAddr, PeerID: seederID, DownloadDir: seedDir, DisableUTP: true})
+	assert.Nil(err)
+	defer seeder.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	st, err := seeder.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(st.Start(ctx))
+	assert.Nil(st.Wait(ctx))
+
+	// The leecher reaches both the tracker and the seeder through the proxy, and doesn't listen.
+	p := newConnectProxy()
+	defer p.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := NewClient(&Config{DownloadDir: dir, Proxy: "http://user:secret@" + p.Listener.Addr().String(), ProxyOnly: true})
+	assert.Nil(err)
+	defer c.Close()
+	lt, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(lt.Start(ctx))
+	assert.Nil(lt.Wait(ctx))
+	out, _ := ioutil.ReadFile(filepath.Join(dir, "proxied.bin"))
+	assert.Equal(data, out)
+	assert.Nil(c.ListenAddr())
+	targets := p.Targets()
+	assert.Contains(targets, tracker.Listener.Addr().String())
+	assert.Contains(targets, seederAddr)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSmartBan(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	banFile := filepath.Join(dir, "bans.json")
+	logs := new(syncBuffer)
+	c, err := NewClient(&Config{DownloadDir: dir, BanThreshold: 2, BanFile: banFile, Logger: slog.New(slog.NewJSONHandler(logs, nil))})
+	assert.Nil(err)
+	defer c.Close()
+	data := randomData(4 * blockSize)
+	metainfo, infoHash := testtorrent.Make("smartban.bin", data, 2*blockSize, "")
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(tor.open())
+	pk := tor.getPicker()
+	all := bitset.New(2)
+	all.Set(0)
+	all.Set(1)
+	blocks := make(chan blockData)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tor.writer(ctx, blocks)
+
+	corrupt := make([]byte, blockSize)
+	send := func(index, n int, from string, bad bool) {
+		b := pk.blockAt(index, n*blockSize)
+		block := data[index*2*blockSize+b.begin:][:blockSize]
+		if bad {
+			block = corrupt
+		}
+		blocks <- blockData{block: b, data: block, from: from}
+	}
+	failures := func(ip string) int {
+		tor.mu.Lock()
+		defer tor.mu.Unlock()
+		return tor.hashFailures[ip]
+	}
+	waitBans := func(n int) []Ban {
+		for i := 0; i < 100 && len(c.Bans()) < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return c.Bans()
+	}
+
+	// 10.0.0.2 corrupts the second block of piece 0. Once the piece is downloaded again from
+	// someone else, its block stands out and it's banned.
+	pk.pick(all, 4)
+	send(0, 0, "10.0.0.1", false)
+	send(0, 1, "10.0.0.2", true)
+	for i := 0; i < 100 && failures("10.0.0.2") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pk.pick(all, 4)
+	send(0, 0, "10.0.0.1", false)
+	send(0, 1, "10.0.0.3", false)
+	bans := waitBans(1)
+	if assert.Equal(1, len(bans)) {
+		assert.Equal("10.0.0.2", bans[0].IP)
+		assert.Equal("sent a corrupt block of piece 0", bans[0].Reason)
+	}
+	assert.True(pk.hasPiece(0))
+	// Log records say what they're about.
+	assert.Contains(logs.String(), fmt.Sprintf(`"msg":"piece failed verification","info_hash":"%x","subsystem":"storage","piece":0}`, infoHash))
+	assert.Contains(logs.String(), `"msg":"banned peer","peer":"10.0.0.2"`)
+
+	// 10.0.0.1 sent data for two failed pieces, which reaches the threshold.
+	send(1, 0, "10.0.0.1", true)
+	send(1, 1, "10.0.0.4", false)
+	bans = waitBans(2)
+	if assert.Equal(2, len(bans)) {
+		assert.Equal("10.0.0.1", bans[1].IP)
+		assert.Equal("sent data for 2 pieces that failed verification", bans[1].Reason)
+	}
+	tor.mu.Lock()
+	assert.Equal(map[string]int{"10.0.0.1": 2, "10.0.0.2": 1, "10.0.0.4": 1}, tor.hashFailures)
+	tor.mu.Unlock()
+
+	// Further failures don't count against a banned peer, or save the bans again.
+	saved, err := ioutil.ReadFile(banFile)
+	assert.Nil(err)
+	assert.Nil(os.Remove(banFile))
+	pk.pick(all, 4)
+	send(1, 0, "10.0.0.1", true)
+	send(1, 1, "10.0.0.5", false)
+	for i := 0; i < 100 && failures("10.0.0.5") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(1, failures("10.0.0.5"))
+	assert.Equal(2, failures("10.0.0.1"))
+	_, err = os.Stat(banFile)
+	assert.True(os.IsNotExist(err))
+	ioutil.WriteFile(banFile, saved, 0644)
+
+	// Bans outlive the client and keep banned peers out.
+	c2, err := NewClient(&Config{BanFile: banFile})
+	assert.Nil(err)
+	defer c2.Close()
+	assert.Equal(len(bans), len(c2.Bans()))
+	_, err = c2.connect(context.Background(), "10.0.0.2:6881")
+	assert.Equal(errBlocked, err)
+	assert.Nil(c2.Unban(net.ParseIP("10.0.0.2")))
+	c3, err := NewClient(&Config{BanFile: banFile})
+	assert.Nil(err)
+	defer c3.Close()
+	if bans := c3.Bans(); assert.Equal(1, len(bans)) {
+		assert.Equal("10.0.0.1", bans[0].IP)
+	}
+	ioutil.WriteFile(banFile, []byte("not json"), 0644)
+	_, err = NewClient(&Config{BanFile: banFile})
+	assert.NotNil(err)
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	seederAddr := freeAddr(t)
+	tracker := newTracker(seederAddr)
+	defer tracker.Close()
+	data := randomData(100000)
+	metainfo, infoHash := testtorrent.Make("metrics.bin", data, 1<<15, tracker.URL)
+	seedDir := tempDir(t)
+	defer os.RemoveAll(seedDir)
+	ioutil.WriteFile(filepath.Join(seedDir, "metrics.bin"), data, 0644)
+	seeder, err := NewClient(&Config{ListenAddr: seederAddr, PeerID: seederID, DownloadDir: seedDir})
+	assert.Nil(err)
+	defer seeder.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	st, err := seeder.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(st.Start(ctx))
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+	lt, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(lt.Start(ctx))
+	assert.Nil(lt.Wait(ctx))
+
+	var buf bytes.Buffer
+	w := metrics.NewWriter(&buf)
+	c.Collect(w)
+	assert.Nil(w.Flush())
+	out := buf.String()
+	labels := fmt.Sprintf(`{info_hash="%s",name="metrics.bin"}`, hex.EncodeToString([]byte(infoHash)))
+	assert.Contains(out, "# TYPE gotorrent_torrent_downloaded_bytes_total counter\n")
+	assert.Contains(out, "gotorrent_torrent_downloaded_bytes_total"+labels+" 100000\n")
+	assert.Contains(out, "gotorrent_torrent_completed_bytes"+labels+" 100000\n")
+	assert.Contains(out, "gotorrent_torrent_peers"+labels+" 1\n")
+	assert.Contains(out, "gotorrent_torrent_picker_active_pieces"+labels+" 0\n")
+	assert.Contains(out, "gotorrent_torrent_hash_failures_total"+labels+" 0\n")
+	assert.Contains(out, "gotorrent_torrent_announce_failures_total"+labels+" 0\n")
+	// Every block of the torrent was written once. The completed announce may be in or not.
+	assert.Contains(out, "gotorrent_disk_write_duration_seconds_count 7\n")
+	assert.Regexp(`\ngotorrent_announce_duration_seconds_count [12]\n`, out)
+	assert.Contains(out, "gotorrent_torrents 1\n")
+
+	// The tracker handed out the seeder.
+	trackers := lt.Trackers()
+	if assert.Equal(1, len(trackers)) {
+		assert.Equal(tracker.URL, trackers[0].URL)
+		assert.Nil(trackers[0].Err)
+		assert.Equal(1, trackers[0].Peers)
+		assert.False(trackers[0].LastAnnounce.IsZero())
+		assert.True(trackers[0].NextAnnounce.After(time.Now()))
+	}
+	assert.True(lt.Stats().Running)
+	lt.Pause()
+	assert.False(lt.Stats().Running)
+	assert.True(lt.Trackers()[0].NextAnnounce.IsZero())
+}
+
+func TestRateMeter(t *testing.T) {
+	assert := assert.New(t)
+	var m rateMeter
+	start := time.Now()
+	at := func(seconds int, down, up int64) rateSample {
+		return rateSample{at: start.Add(time.Duration(seconds) * time.Second), down: down, up: up}
+	}
+	down, up := m.rates(at(0, 100, 100))
+	assert.Equal([]int64{0, 0}, []int64{down, up})
+	for i := 0; i <= 10; i++ {
+		m.add(at(i, int64(i)*1000, int64(i)*10))
+	}
+	// Only the last rateWindow counts.
+	down, up = m.rates(at(10, 10000, 100))
+	assert.Equal([]int64{1000, 10}, []int64{down, up})
+	down, up = m.rates(at(11, 11000, 110))
+	assert.Equal([]int64{1000, 10}, []int64{down, up})
+	m.reset()
+	down, up = m.rates(at(12, 20000, 200))
+	assert.Equal([]int64{0, 0}, []int64{down, up})
+}
+
+func TestReadConfigFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gotorrent")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{
+		"download_dir": "/srv/torrents",
+		"max_connections": 80,
+		"keep_alive_timeout": "2m",
+		"max_upload_rate": "500K",
+		"max_download_rate": 2000,
+		"rate_schedule": ["mon-fri 09:00-17:00 100K/1M"],
+		"encryption": "required",
+		"tracker": "http://tracker.example/announce",
+		"dht": false
+	}`)
+	cfg := DefaultConfig()
+	assert.Nil(ReadConfigFile(path, cfg))
+	assert.Equal("/srv/torrents", cfg.DownloadDir)
+	assert.Equal(80, cfg.MaxConnections)
+	assert.Equal(2*time.Minute, cfg.KeepAliveTimeout)
+	assert.Equal(int64(500<<10), cfg.MaxUploadRate)
+	assert.Equal(int64(2000), cfg.MaxDownloadRate)
+	assert.Equal(1, len(cfg.RateSchedule))
+	assert.Equal(EncryptionRequired, cfg.Encryption)
+	assert.Equal("http://tracker.example/announce", cfg.Tracker)
+	// Settings missing from the file are left alone.
+	assert.Equal(":6881", cfg.ListenAddr)
+	assert.Equal(20*time.Second, cfg.AnnouncePeriod)
+
+	for _, tc := range []struct {
+		file, err string
+	}{
+		{`{"max_connections": 0}`, "max_connections: must be positive, got 0"},
+		{`{"max_connections": "many"}`, "max_connections: expected a whole number"},
+		{`{"request_timeout": "soon"}`, `request_timeout: time: invalid duration "soon"`},
+		{`{"encryption": "always"}`, `encryption: unknown encryption policy "always"`},
+		{`{"rate_schedule": ["mon-fri 09:00 1M/1M"]}`, `rate_schedule: rule 0: invalid rate rule "mon-fri 09:00 1M/1M"`},
+		{`{"pex": true}`, "pex: not supported, only false is allowed"},
+		{`{"max_connection": 10}`, "max_connection: unknown setting"},
+		{"{\n\"listen_addr\": \":6881\",\n}", "line 3: invalid character '}' looking for beginning of object key string"},
+	} {
+		write(tc.file)
+		cfg := DefaultConfig()
+		err := ReadConfigFile(path, cfg)
+		if assert.NotNil(err, tc.file) {
+			assert.Equal(path+": "+tc.err, err.Error())
+		}
+		assert.Equal(DefaultConfig(), cfg, "nothing is applied")
+	}
+	_, ok := ReadConfigFile(filepath.Join(dir, "missing.json"), DefaultConfig()).(*ConfigError)
+	assert.False(ok)
+}
+
+func TestTrackerConfig(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", Tracker: "http://fallback.example/announce"})
+	assert.Nil(err)
+	defer c.Close()
+	hash := strings.Repeat("ab", 20)
+	tor, err := c.AddMagnet("magnet:?xt=urn:btih:" + hash)
+	assert.Nil(err)
+	if trackers := tor.Trackers(); assert.Equal(1, len(trackers)) {
+		assert.Equal("http://fallback.example/announce", trackers[0].URL)
+	}
+	// Torrents naming a tracker keep it.
+	tor, err = c.AddMagnet("magnet:?xt=urn:btih:" + strings.Repeat("cd", 20) + "&tr=http%3A%2F%2Fown.example%2Fannounce")
+	assert.Nil(err)
+	if trackers := tor.Trackers(); assert.Equal(1, len(trackers)) {
+		assert.Equal("http://own.example/announce", trackers[0].URL)
+	}
+}
+
+func TestCompletedAnnounce(t *testing.T) {
+	assert := assert.New(t)
+	var mu sync.Mutex
+	var events []string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		bencode.Marshal(w, map[string]interface{}{"interval": 1800, "peers": ""})
+	}))
+	defer tracker.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	// Big enough that the tracker is usually contacted before the file has been checked.
+	data := randomData(8 << 20)
+	ioutil.WriteFile(filepath.Join(dir, "seed.bin"), data, 0644)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+
+	// A torrent that is already complete on disk doesn't claim to have just completed.
+	metainfo, _ := testtorrent.Make("seed.bin", data, 1<<14, tracker.URL)
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(tor.Start(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(tor.Wait(ctx))
+	for i := 0; i < 100 && tor.Trackers()[0].LastAnnounce.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	tor.Pause()
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal([]string{"started", "stopped"}, events)
+}
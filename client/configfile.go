@@ -0,0 +1,243 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ConfigError is an error in a config file. Key is the setting it's about, empty if the file
+// couldn't be parsed at all.
+type ConfigError struct {
+	Path string
+	Key  string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("%s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Path, e.Key, e.Err)
+}
+
+// DefaultConfigPath returns where the config file is looked for when none is given:
+// gotorrent/config.json in the user's config directory, $XDG_CONFIG_HOME or ~/.config on Linux.
+func DefaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gotorrent", "config.json"), nil
+}
+
+// configKeys are the settings of a config file, each setting the fields of a Config from its JSON
+// value.
+var configKeys = map[string]func(c *Config, raw json.RawMessage) error{
+	"listen_addr":  stringKey(func(c *Config) *string { return &c.ListenAddr }),
+	"peer_id":      stringKey(func(c *Config) *string { return &c.PeerID }),
+	"download_dir": stringKey(func(c *Config) *string { return &c.DownloadDir }),
+
+	"max_connections":       positiveKey(func(c *Config) *int { return &c.MaxConnections }),
+	"max_total_connections": positiveKey(func(c *Config) *int { return &c.MaxTotalConnections }),
+	"max_seek_connections":  positiveKey(func(c *Config) *int { return &c.MaxSeekConnections }),
+	"upload_slots":          positiveKey(func(c *Config) *int { return &c.UploadSlots }),
+	"ban_threshold":         positiveKey(func(c *Config) *int { return &c.BanThreshold }),
+
+	"keep_alive_timeout": durationKey(func(c *Config) *time.Duration { return &c.KeepAliveTimeout }),
+	"announce_period":    durationKey(func(c *Config) *time.Duration { return &c.AnnouncePeriod }),
+	"request_timeout":    durationKey(func(c *Config) *time.Duration { return &c.RequestTimeout }),
+
+	"max_upload_rate":   rateKey(func(c *Config) *int64 { return &c.MaxUploadRate }),
+	"max_download_rate": rateKey(func(c *Config) *int64 { return &c.MaxDownloadRate }),
+	"readahead":         rateKey(func(c *Config) *int64 { return &c.Readahead }),
+	"rate_schedule": func(c *Config, raw json.RawMessage) error {
+		var rules []string
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			return errors.New("expected a list of rules")
+		}
+		c.RateSchedule = nil
+		for i, s := range rules {
+			r, err := ParseRateRule(s)
+			if err != nil {
+				return fmt.Errorf("rule %d: %v", i, err)
+			}
+			c.RateSchedule = append(c.RateSchedule, r)
+		}
+		return nil
+	},
+
+	"encryption": func(c *Config, raw json.RawMessage) error {
+		var name string
+		if err := json.Unmarshal(raw, &name); err != nil {
+			return errors.New("expected a string")
+		}
+		p, err := ParseEncryptionPolicy(name)
+		if err != nil {
+			return err
+		}
+		c.Encryption = p
+		return nil
+	},
+	"disable_utp": boolKey(func(c *Config) *bool { return &c.DisableUTP }),
+	"proxy":       stringKey(func(c *Config) *string { return &c.Proxy }),
+	"proxy_only":  boolKey(func(c *Config) *bool { return &c.ProxyOnly }),
+	"blocklists":  stringsKey(func(c *Config) *[]string { return &c.Blocklists }),
+	"ban_file":    stringKey(func(c *Config) *string { return &c.BanFile }),
+	"tracker":     stringKey(func(c *Config) *string { return &c.Tracker }),
+
+	// Peer discovery beyond trackers isn't implemented, so these can only be turned off.
+	"dht": unsupportedKey,
+	"pex": unsupportedKey,
+	"lsd": unsupportedKey,
+}
+
+func stringKey(field func(*Config) *string) func(*Config, json.RawMessage) error {
+	return func(c *Config, raw json.RawMessage) error {
+		if err := json.Unmarshal(raw, field(c)); err != nil {
+			return errors.New("expected a string")
+		}
+		return nil
+	}
+}
+
+func stringsKey(field func(*Config) *[]string) func(*Config, json.RawMessage) error {
+	return func(c *Config, raw json.RawMessage) error {
+		var v []string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return errors.New("expected a list of strings")
+		}
+		*field(c) = v
+		return nil
+	}
+}
+
+func boolKey(field func(*Config) *bool) func(*Config, json.RawMessage) error {
+	return func(c *Config, raw json.RawMessage) error {
+		if err := json.Unmarshal(raw, field(c)); err != nil {
+			return errors.New("expected true or false")
+		}
+		return nil
+	}
+}
+
+func positiveKey(field func(*Config) *int) func(*Config, json.RawMessage) error {
+	return func(c *Config, raw json.RawMessage) error {
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return errors.New("expected a whole number")
+		}
+		if n <= 0 {
+			return fmt.Errorf("must be positive, got %d", n)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// durationKey reads a duration written as accepted by time.ParseDuration, e.g. "90s".
+func durationKey(field func(*Config) *time.Duration) func(*Config, json.RawMessage) error {
+	return func(c *Config, raw json.RawMessage) error {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return errors.New(`expected a duration such as "90s"`)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("must be positive, got %s", s)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// rateKey reads a number of bytes, either a number or a string as accepted by ParseRate, e.g.
+// "500K".
+func rateKey(field func(*Config) *int64) func(*Config, json.RawMessage) error {
+	return func(c *Config, raw json.RawMessage) error {
+		var n int64
+		if err := json.Unmarshal(raw, &n); err == nil {
+			if n < 0 {
+				return fmt.Errorf("can't be negative, got %d", n)
+			}
+			*field(c) = n
+			return nil
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return errors.New(`expected a number or a string such as "500K"`)
+		}
+		n, err := ParseRate(s)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func unsupportedKey(c *Config, raw json.RawMessage) error {
+	var on bool
+	if err := json.Unmarshal(raw, &on); err != nil {
+		return errors.New("expected true or false")
+	}
+	if on {
+		return errors.New("not supported, only false is allowed")
+	}
+	return nil
+}
+
+// ReadConfigFile applies the settings in the JSON config file at path to c. Settings missing from
+// the file are left alone. The file is an object whose keys are named after the fields of Config
+// in snake case, e.g.
+//
+//	{
+//		"download_dir": "/srv/torrents",
+//		"max_connections": 80,
+//		"keep_alive_timeout": "2m",
+//		"max_upload_rate": "500K",
+//		"rate_schedule": ["mon-fri 09:00-17:00 100K/1M"],
+//		"encryption": "required"
+//	}
+//
+// Errors are a *ConfigError naming the key that's wrong. Nothing is applied if there's one.
+func ReadConfigFile(path string, c *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(data[:se.Offset], []byte("\n"))
+			err = fmt.Errorf("line %d: %v", line, se)
+		}
+		return &ConfigError{Path: path, Err: err}
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	updated := *c
+	for _, name := range names {
+		set, ok := configKeys[name]
+		if !ok {
+			return &ConfigError{Path: path, Key: name, Err: errors.New("unknown setting")}
+		}
+		if err := set(&updated, keys[name]); err != nil {
+			return &ConfigError{Path: path, Key: name, Err: err}
+		}
+	}
+	*c = updated
+	return nil
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/saicheems/gotorrent/mse"
+)
+
+var (
+	errPlaintext = errors.New("plaintext connection refused by encryption policy")
+	errEncrypted = errors.New("encrypted connection refused by encryption policy")
+)
+
+// dial connects to the peer at addr for the torrent with infoHash and runs the encryption
+// handshake the policy asks for. With encryption preferred, peers that fail the encryption
+// handshake are dialed again in plaintext. Cancelling ctx abandons the attempt.
+func (c *Client) dial(ctx context.Context, addr string, infoHash string) (net.Conn, error) {
+	policy := c.config.Encryption
+	conn, err := c.connect(ctx, addr)
+	if err != nil || policy == EncryptionDisabled {
+		return conn, err
+	}
+	provide := mse.RC4
+	if policy == EncryptionPreferred {
+		provide |= mse.Plaintext
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	ec, err := mse.Initiate(conn, []byte(infoHash), provide)
+	if stop() && err == nil {
+		conn.SetDeadline(time.Time{})
+		return ec, nil
+	}
+	conn.Close()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if policy == EncryptionRequired || ctx.Err() != nil {
+		return nil, err
+	}
+	// Peers without encryption support hang up on the encryption handshake.
+	return c.connect(ctx, addr)
+}
+
+// acceptEncryption looks at how an incoming connection starts and runs the encryption handshake
+// if the peer began one, refusing whatever the policy doesn't allow. The returned connection is
+// ready for the BitTorrent handshake.
+func (c *Client) acceptEncryption(conn net.Conn) (net.Conn, error) {
+	policy := c.config.Encryption
+	sniffed, plain, err := mse.Sniff(conn)
+	if err != nil {
+		return nil, err
+	}
+	if plain {
+		if policy == EncryptionRequired {
+			return nil, errPlaintext
+		}
+		return sniffed, nil
+	}
+	if policy == EncryptionDisabled {
+		return nil, errEncrypted
+	}
+	ec, err := mse.Receive(sniffed, c.skey, c.chooseCrypto)
+	if err != nil {
+		return nil, err
+	}
+	return ec, nil
+}
+
+// skey returns the info hash of the torrent an encrypted connection is for, given the hash
+// identifying it in the handshake, or nil if we don't have that torrent.
+func (c *Client) skey(req2 []byte) []byte {
+	for _, t := range c.Torrents() {
+		infoHash := []byte(t.InfoHash())
+		if bytes.Equal(mse.SKeyHash(infoHash), req2) {
+			return infoHash
+		}
+	}
+	return nil
+}
+
+// chooseCrypto picks RC4 whenever the peer provides it, and plaintext only if the policy allows.
+func (c *Client) chooseCrypto(provide mse.CryptoMethod) mse.CryptoMethod {
+	if provide&mse.RC4 != 0 {
+		return mse.RC4
+	}
+	if c.config.Encryption == EncryptionPreferred {
+		return provide & mse.Plaintext
+	}
+	return 0
+}
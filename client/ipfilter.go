@@ -0,0 +1,67 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/saicheems/gotorrent/ipfilter"
+)
+
+// errBlocked is returned when dialing an address the IP filter blocks or that is banned.
+var errBlocked = errors.New("address blocked")
+
+// ReloadBlocklists reads the configured blocklists again and replaces the IP filter with them.
+// The old filter stays in place if any of them can't be read.
+func (c *Client) ReloadBlocklists() error {
+	var filters []*ipfilter.Filter
+	for _, path := range c.config.Blocklists {
+		f, err := ipfilter.ParseFile(path)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, f)
+	}
+	c.SetIPFilter(ipfilter.Merge(filters...))
+	return nil
+}
+
+// SetIPFilter replaces the filter of addresses we refuse connections to and from. A nil filter
+// blocks nothing. Peers that are already connected aren't affected.
+func (c *Client) SetIPFilter(f *ipfilter.Filter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filter = f
+}
+
+// BlockedConnections returns how many connections the IP filter and the ban list have refused,
+// incoming and outgoing.
+func (c *Client) BlockedConnections() int64 {
+	return atomic.LoadInt64(&c.blocked)
+}
+
+// blockedAddr returns whether the host of addr is blocked, counting it if it is.
+func (c *Client) blockedAddr(addr net.Addr) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return c.blockedHost(host)
+}
+
+// blockedHost returns whether the IP filter blocks host or it's banned, counting it if it is. Host
+// names aren't resolved, so only literal addresses are ever blocked.
+func (c *Client) blockedHost(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	c.mu.Lock()
+	f := c.filter
+	c.mu.Unlock()
+	if !f.Blocked(ip) && !c.banned(ip) {
+		return false
+	}
+	atomic.AddInt64(&c.blocked, 1)
+	return true
+}
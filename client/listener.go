@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/saicheems/gotorrent/torrent"
+	"github.com/saicheems/gotorrent/utp"
+)
+
+const (
+	// handshakeTimeout bounds how long a peer has to complete its handshake.
+	handshakeTimeout = 10 * time.Second
+	// utpConnectTimeout is how long a uTP connection attempt may take before we fall back to
+	// TCP.
+	utpConnectTimeout = 3 * time.Second
+	// connectTimeout bounds dialing a peer over TCP, including the handshake with a proxy.
+	connectTimeout = 10 * time.Second
+)
+
+// listen starts accepting incoming connections for every torrent in the client, if it isn't
+// already.
+func (c *Client) listen() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	if c.ln != nil || c.config.ProxyOnly {
+		// Incoming connections don't come through the proxy.
+		return nil
+	}
+	ln, err := net.Listen("tcp", c.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	if !c.config.DisableUTP {
+		// uTP uses the UDP port with the same number, which matters when the TCP port was
+		// picked by the system.
+		us, err := utp.Listen("udp", ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		c.utp = us
+		go c.acceptLoop(us)
+	}
+	c.ln = ln
+	go c.acceptLoop(ln)
+	return nil
+}
+
+// connect opens a connection to the peer at addr, over uTP if it's enabled and the peer answers
+// in time, and over TCP otherwise. Both go through the proxy if there is one. Addresses the IP
+// filter blocks are refused.
+func (c *Client) connect(ctx context.Context, addr string) (net.Conn, error) {
+	if host, _, err := net.SplitHostPort(addr); err == nil && c.blockedHost(host) {
+		return nil, errBlocked
+	}
+	if us := c.utpDialer(); us != nil {
+		utpCtx, cancel := context.WithTimeout(ctx, utpConnectTimeout)
+		conn, err := us.DialContext(utpCtx, addr)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	return c.dialer.DialContext(ctx, "tcp", addr)
+}
+
+// ListenAddr returns the address the client accepts peers on, or nil if it isn't listening yet.
+// The listener is opened when the first torrent is started.
+func (c *Client) ListenAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ln == nil {
+		return nil
+	}
+	return c.ln.Addr()
+}
+
+// acceptLoop accepts connections until the listener is closed. TCP and uTP listeners share it.
+func (c *Client) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if c.blockedAddr(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go c.dispatch(conn)
+	}
+}
+
+// dispatch reads the handshake of an incoming connection, decrypting it first if the peer asked
+// for encryption, and hands the connection to the torrent with the info hash the peer asked for.
+// Connections for torrents we don't have are closed without an answer, the torrent itself sends
+// our half of the handshake once it takes the peer on.
+func (c *Client) dispatch(raw net.Conn) {
+	raw.SetDeadline(time.Now().Add(handshakeTimeout))
+	conn, err := c.acceptEncryption(raw)
+	if err != nil {
+		raw.Close()
+		return
+	}
+	h, err := torrent.ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	t, ok := c.Torrent(h.InfoHash)
+	if !ok {
+		conn.Close()
+		return
+	}
+	t.accept(conn, h)
+}
+
+// acquireConn reserves one of the connection slots shared by every torrent. It returns false if
+// they're all taken.
+func (c *Client) acquireConn() bool {
+	select {
+	case c.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseConn frees a slot reserved by acquireConn.
+func (c *Client) releaseConn() {
+	<-c.connSlots
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/saicheems/gotorrent/torrent"
+)
+
+const (
+	// maxMetadataSize is the largest info dictionary we're willing to fetch for a magnet link.
+	maxMetadataSize = 1 << 24
+	// metadataTimeout bounds how long a single peer gets to deliver the metadata.
+	metadataTimeout = 30 * time.Second
+)
+
+// errNoMetadata is returned when a peer can't or won't share the metadata.
+var errNoMetadata = errors.New("peer can't share metadata")
+
+// fetchMetadata downloads the info dictionary of a magnet link from the peers handed out on addrs.
+// Several peers are asked at once and the first to deliver metadata matching the info hash wins.
+// The addresses of the peers that were asked are returned too, so they can be connected to again.
+func (t *Torrent) fetchMetadata(ctx context.Context, addrs <-chan string) ([]byte, *torrent.InfoDict, []string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		info []byte
+		d    *torrent.InfoDict
+	}
+	results := make(chan result)
+	failed := make(chan string)
+	tried := make(map[string]bool)
+	for {
+		// Stop taking addresses while we're already talking to enough peers.
+		var in <-chan string
+		if len(tried) < t.client.config.MaxSeekConnections {
+			in = addrs
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, nil, ctx.Err()
+		case addr := <-in:
+			if tried[addr] {
+				continue
+			}
+			tried[addr] = true
+			go func() {
+				info, d, err := t.requestMetadata(ctx, addr)
+				if err != nil {
+					select {
+					case failed <- addr:
+					case <-ctx.Done():
+					}
+					return
+				}
+				select {
+				case results <- result{info, d}:
+				case <-ctx.Done():
+				}
+			}()
+		case addr := <-failed:
+			// Forget the peer so it's tried again if the tracker hands it out again.
+			delete(tried, addr)
+		case r := <-results:
+			known := make([]string, 0, len(tried))
+			for addr := range tried {
+				known = append(known, addr)
+			}
+			return r.info, r.d, known, nil
+		}
+	}
+}
+
+// requestMetadata fetches the metadata from the peer at addr using the ut_metadata extension.
+func (t *Torrent) requestMetadata(ctx context.Context, addr string) ([]byte, *torrent.InfoDict, error) {
+	conn, err := t.client.dial(ctx, addr, t.infoHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	// Closing the connection is the only way to interrupt a blocked read.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(metadataTimeout))
+	ph, err := torrent.Handshake(conn, t.infoHash, t.client.config.PeerID, t.client.reserved())
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ph.Reserved.SupportsExtensions() {
+		return nil, nil, errNoMetadata
+	}
+	h := torrent.ExtendedHandshake{M: map[string]int{"ut_metadata": utMetadataID}, V: clientVersion}
+	if err := torrent.SendMessage(conn, h.Message()); err != nil {
+		return nil, nil, err
+	}
+	// The torrent's size isn't known yet, so allow a bitfield for the largest torrent whose
+	// metadata we would accept.
+	mr := torrent.NewMessageReader(conn, torrent.MaxMessageLength(maxMetadataSize/20, maxRequestLength))
+	// Wait for the peer's extension handshake to learn its ID for ut_metadata and the size.
+	var theirs *torrent.ExtendedHandshake
+	for theirs == nil {
+		m, err := readExtended(mr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m.ID == torrent.ExtendedHandshakeID {
+			if theirs, err = torrent.ParseExtendedHandshake(m.Payload); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	id, size := theirs.M["ut_metadata"], theirs.MetadataSize
+	if id == 0 || size <= 0 || size > maxMetadataSize {
+		return nil, nil, errNoMetadata
+	}
+	numPieces := (size + torrent.MetadataPieceSize - 1) / torrent.MetadataPieceSize
+	for i := 0; i < numPieces; i++ {
+		req := torrent.MetadataMessage{Type: torrent.MetadataRequest, Piece: i}
+		if err := torrent.SendMessage(conn, torrent.Extended{ID: uint8(id), Payload: req.Payload()}); err != nil {
+			return nil, nil, err
+		}
+	}
+	info := make([]byte, size)
+	got := make([]bool, numPieces)
+	for remaining := numPieces; remaining > 0; {
+		m, err := readExtended(mr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m.ID != utMetadataID {
+			continue
+		}
+		mm, err := torrent.ParseMetadataMessage(m.Payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mm.Type == torrent.MetadataReject {
+			return nil, nil, errNoMetadata
+		}
+		if mm.Type != torrent.MetadataData || mm.Piece >= numPieces || got[mm.Piece] {
+			continue
+		}
+		begin := mm.Piece * torrent.MetadataPieceSize
+		end := begin + torrent.MetadataPieceSize
+		if end > size {
+			end = size
+		}
+		if len(mm.Data) != end-begin {
+			return nil, nil, errNoMetadata
+		}
+		copy(info[begin:end], mm.Data)
+		got[mm.Piece] = true
+		remaining--
+	}
+	d, err := torrent.ParseInfo(info, t.infoHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateInfo(d); err != nil {
+		return nil, nil, err
+	}
+	return info, d, nil
+}
+
+// readExtended reads messages off mr until an extension protocol message arrives.
+func readExtended(mr *torrent.MessageReader) (torrent.Extended, error) {
+	for {
+		msg, err := mr.ReadMessage()
+		var unknown *torrent.UnknownMessageError
+		if errors.As(err, &unknown) {
+			continue
+		}
+		if err != nil {
+			return torrent.Extended{}, err
+		}
+		if m, ok := msg.(torrent.Extended); ok {
+			return m, nil
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// rateWindow is how far back transfer rates are averaged over.
+	rateWindow = 5 * time.Second
+	// rateInterval is how often the transfer totals are sampled for the rates.
+	rateInterval = time.Second
+)
+
+// rateSample holds the transfer totals of a torrent at some point in time.
+type rateSample struct {
+	at       time.Time
+	down, up int64
+}
+
+// rateMeter estimates the transfer rates of a torrent from samples of its totals.
+type rateMeter struct {
+	mu      sync.Mutex
+	samples []rateSample // Oldest first, covering about rateWindow.
+}
+
+// add records the totals at at and forgets samples that have fallen out of the window.
+func (m *rateMeter) add(s rateSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, s)
+	for len(m.samples) > 1 && s.at.Sub(m.samples[0].at) > rateWindow {
+		m.samples = m.samples[1:]
+	}
+}
+
+// rates returns the bytes per second transferred between the oldest sample and now, given the
+// current totals.
+func (m *rateMeter) rates(now rateSample) (down, up int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.samples) == 0 {
+		return 0, 0
+	}
+	first := m.samples[0]
+	elapsed := now.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return int64(float64(now.down-first.down) / elapsed), int64(float64(now.up-first.up) / elapsed)
+}
+
+// reset forgets every sample, so the rates are 0 until the next ones are in.
+func (m *rateMeter) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = nil
+}
+
+// totals returns the current transfer totals of the torrent.
+func (t *Torrent) totals() rateSample {
+	return rateSample{at: time.Now(), down: atomic.LoadInt64(&t.downloaded), up: atomic.LoadInt64(&t.uploaded)}
+}
+
+// meter samples the transfer totals for the rates until ctx is cancelled. The rates drop to 0
+// once it returns.
+func (t *Torrent) meter(ctx context.Context) {
+	defer t.rates.reset()
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+	t.rates.add(t.totals())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.rates.add(t.totals())
+		}
+	}
+}
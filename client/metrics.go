@@ -0,0 +1,115 @@
+package client
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync/atomic"
+
+	"github.com/saicheems/gotorrent/metrics"
+)
+
+// Bucket bounds of the latency histograms, in seconds.
+var (
+	announceBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	writeBuckets    = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+)
+
+// torrentMetric is a per torrent metric, read from a sample of the torrent when it's scraped.
+type torrentMetric struct {
+	name, typ, help string
+	value           func(s *torrentSample) float64
+}
+
+// torrentSample is a snapshot of a torrent taken once per scrape, so every metric of a torrent
+// agrees with the others.
+type torrentSample struct {
+	Stats
+	peers                    []PeerInfo
+	amChoking, peerChoking   int
+	activePieces, requested  int
+	announces, announceFails int64
+	hashFailures             int64
+}
+
+var torrentMetrics = []torrentMetric{
+	{"gotorrent_torrent_downloaded_bytes_total", metrics.Counter, "Bytes of piece data received from peers and web seeds.",
+		func(s *torrentSample) float64 { return float64(s.Downloaded) }},
+	{"gotorrent_torrent_uploaded_bytes_total", metrics.Counter, "Bytes of piece data sent to peers.",
+		func(s *torrentSample) float64 { return float64(s.Uploaded) }},
+	{"gotorrent_torrent_completed_bytes", metrics.Gauge, "Bytes in verified pieces.",
+		func(s *torrentSample) float64 { return float64(s.BytesCompleted) }},
+	{"gotorrent_torrent_length_bytes", metrics.Gauge, "Total length of the torrent's files.",
+		func(s *torrentSample) float64 { return float64(s.Length) }},
+	{"gotorrent_torrent_peers", metrics.Gauge, "Connected peers.",
+		func(s *torrentSample) float64 { return float64(len(s.peers)) }},
+	{"gotorrent_torrent_peers_choked", metrics.Gauge, "Connected peers we're choking.",
+		func(s *torrentSample) float64 { return float64(s.amChoking) }},
+	{"gotorrent_torrent_peers_choking", metrics.Gauge, "Connected peers choking us.",
+		func(s *torrentSample) float64 { return float64(s.peerChoking) }},
+	{"gotorrent_torrent_picker_active_pieces", metrics.Gauge, "Pieces being downloaded.",
+		func(s *torrentSample) float64 { return float64(s.activePieces) }},
+	{"gotorrent_torrent_picker_requested_blocks", metrics.Gauge, "Blocks requested and not received yet.",
+		func(s *torrentSample) float64 { return float64(s.requested) }},
+	{"gotorrent_torrent_hash_failures_total", metrics.Counter, "Pieces that failed verification.",
+		func(s *torrentSample) float64 { return float64(s.hashFailures) }},
+	{"gotorrent_torrent_announces_total", metrics.Counter, "Announces to the tracker.",
+		func(s *torrentSample) float64 { return float64(s.announces) }},
+	{"gotorrent_torrent_announce_failures_total", metrics.Counter, "Announces to the tracker that failed.",
+		func(s *torrentSample) float64 { return float64(s.announceFails) }},
+}
+
+// sample takes a snapshot of the torrent for the metrics.
+func (t *Torrent) sample() *torrentSample {
+	s := &torrentSample{Stats: t.Stats(), peers: t.Peers()}
+	for _, p := range s.peers {
+		if p.AmChoking {
+			s.amChoking++
+		}
+		if p.PeerChoking {
+			s.peerChoking++
+		}
+	}
+	if pk := t.getPicker(); pk != nil {
+		s.activePieces, s.requested = pk.queueDepth()
+	}
+	s.announces = atomic.LoadInt64(&t.announces)
+	s.announceFails = atomic.LoadInt64(&t.announceFailures)
+	s.hashFailures = atomic.LoadInt64(&t.piecesFailed)
+	return s
+}
+
+// Collect writes the client's metrics: transfer totals, peers and picker state of every torrent,
+// tracker and verification failures, and the latency of announces and disk writes. It makes the
+// client a metrics.Collector, so metrics.Handler serves them.
+func (c *Client) Collect(w *metrics.Writer) {
+	torrents := c.Torrents()
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].infoHash < torrents[j].infoHash })
+	samples := make([]*torrentSample, len(torrents))
+	labels := make([][]metrics.Label, len(torrents))
+	for i, t := range torrents {
+		samples[i] = t.sample()
+		labels[i] = []metrics.Label{
+			{Name: "info_hash", Value: hex.EncodeToString([]byte(t.infoHash))},
+			{Name: "name", Value: t.Name()},
+		}
+	}
+	w.Header("gotorrent_torrents", metrics.Gauge, "Torrents in the client.")
+	w.Value("gotorrent_torrents", float64(len(torrents)))
+	for _, m := range torrentMetrics {
+		w.Header(m.name, m.typ, m.help)
+		for i := range torrents {
+			w.Value(m.name, m.value(samples[i]), labels[i]...)
+		}
+	}
+	w.Header("gotorrent_announce_duration_seconds", metrics.HistogramType, "Time taken by announces to trackers.")
+	w.Histogram("gotorrent_announce_duration_seconds", c.announceLatency)
+	w.Header("gotorrent_disk_write_duration_seconds", metrics.HistogramType, "Time taken by writes of blocks to disk.")
+	w.Histogram("gotorrent_disk_write_duration_seconds", c.writeLatency)
+	w.Header("gotorrent_blocked_connections_total", metrics.Counter, "Connections refused by the IP filter or bans.")
+	w.Value("gotorrent_blocked_connections_total", float64(c.BlockedConnections()))
+	c.banMu.Lock()
+	bans := len(c.bans)
+	c.banMu.Unlock()
+	w.Header("gotorrent_banned_peers", metrics.Gauge, "Banned peer addresses.")
+	w.Value("gotorrent_banned_peers", float64(bans))
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/saicheems/gotorrent/torrent"
+)
+
+// maxComponentLength is the longest file or directory name most filesystems allow, in bytes.
+const maxComponentLength = 255
+
+// reservedChars can't be used in file names on some filesystems, and are replaced.
+const reservedChars = `<>:"|?*`
+
+// reservedNames are device names on Windows, which files can't be named after even with an
+// extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeName returns the name a file or directory named s in a torrent is stored under. Names
+// that would climb out of or name another directory are refused. Reserved and control characters
+// are replaced with underscores, device names get one in front, and names too long for the
+// filesystem are shortened, keeping the extension.
+func sanitizeName(s string) (string, error) {
+	if s == "" || s == "." || s == ".." || strings.ContainsAny(s, "/\\\x00") {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, s)
+	}
+	s = strings.ToValidUTF8(s, "_")
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(reservedChars, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	base := s
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(base)] {
+		s = "_" + s
+	}
+	return withSuffix(s, ""), nil
+}
+
+// withSuffix returns name with suffix added before its extension, shortening the rest of the name
+// as needed to stay within maxComponentLength.
+func withSuffix(name, suffix string) string {
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		// That's no extension worth keeping.
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	if max := maxComponentLength - len(suffix) - len(ext); len(base) > max {
+		base = base[:max]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+	}
+	return base + suffix + ext
+}
+
+// filePaths returns the paths, relative to the download directory, that the files of info are
+// stored at. Names are sanitized by sanitizeName. Files that would then end up at the same path,
+// ignoring case in case the filesystem does, or where another file needs a directory, are told
+// apart by numbering the later ones, e.g. "a (1).txt".
+func filePaths(info *torrent.InfoDict) ([][]string, error) {
+	files := info.FileList()
+	paths := make([][]string, len(files))
+	taken := make(map[string]bool) // Lower cased paths of files and directories.
+	isFile := make(map[string]bool)
+	for i, f := range files {
+		path := make([]string, len(f.Path))
+		for j, name := range f.Path {
+			clean, err := sanitizeName(name)
+			if err != nil {
+				return nil, err
+			}
+			path[j] = clean
+			last := j == len(f.Path)-1
+			// A directory may be shared with other files but not sit where a file is, a file
+			// can't share its path with anything.
+			conflicts := func() bool {
+				key := strings.ToLower(filepath.Join(path[:j+1]...))
+				return isFile[key] || (last && taken[key])
+			}
+			for n := 1; conflicts(); n++ {
+				path[j] = withSuffix(clean, fmt.Sprintf(" (%d)", n))
+			}
+			key := strings.ToLower(filepath.Join(path[:j+1]...))
+			taken[key] = true
+			if last {
+				isFile[key] = true
+			}
+		}
+		paths[i] = path
+	}
+	return paths, nil
+}
+
+// checkSymlinks returns an error if any of the directories along path below dir, or the file at
+// path itself, is a symlink, which could lead outside dir. Parts that don't exist yet are fine.
+func checkSymlinks(dir string, path []string) error {
+	p := dir
+	for _, name := range path {
+		p = filepath.Join(p, name)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s is a symlink", ErrUnsafePath, p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saicheems/gotorrent/internal/testtorrent"
+	"github.com/saicheems/gotorrent/torrent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeName(t *testing.T) {
+	assert := assert.New(t)
+	for name, want := range map[string]string{
+		"movie.mkv":                       "movie.mkv",
+		"Title: Part 2?.txt":              "Title_ Part 2_.txt",
+		"a<b>c|d*e\"f":                    "a_b_c_d_e_f",
+		"bell\x07tab\t":                   "bell_tab_",
+		"con":                             "_con",
+		"Aux.txt":                         "_Aux.txt",
+		"console":                         "console",
+		"...":                             "...",
+		"bad\xffutf8":                     "bad_utf8",
+		strings.Repeat("a", 300) + ".mkv": strings.Repeat("a", 251) + ".mkv",
+		strings.Repeat("é", 200):          strings.Repeat("é", 127),
+	} {
+		got, err := sanitizeName(name)
+		assert.Nil(err, name)
+		assert.Equal(want, got, name)
+		assert.True(len(got) <= maxComponentLength, name)
+	}
+	for _, name := range []string{"", ".", "..", "../../.bashrc", "/etc/passwd", `..\..\x`, "a/b", "nul\x00byte"} {
+		_, err := sanitizeName(name)
+		assert.True(errors.Is(err, ErrUnsafePath), name)
+	}
+}
+
+func TestFilePaths(t *testing.T) {
+	assert := assert.New(t)
+	info := &torrent.InfoDict{Name: "top", Files: []torrent.FileDict{
+		{Path: []string{"a:b.txt"}},
+		{Path: []string{"a_b.txt"}},
+		{Path: []string{"A_B.TXT"}},
+		{Path: []string{"dir"}},
+		{Path: []string{"dir", "inner.txt"}},
+		{Path: []string{"dir", "other.txt"}},
+	}}
+	paths, err := filePaths(info)
+	assert.Nil(err)
+	assert.Equal([][]string{
+		{"top", "a_b.txt"},
+		{"top", "a_b (1).txt"},
+		{"top", "A_B (2).TXT"},
+		{"top", "dir"},
+		{"top", "dir (1)", "inner.txt"},
+		{"top", "dir (1)", "other.txt"},
+	}, paths)
+
+	// A file sitting where a directory already is gets renamed too.
+	info.Files = []torrent.FileDict{{Path: []string{"dir", "inner.txt"}}, {Path: []string{"dir"}}}
+	paths, err = filePaths(info)
+	assert.Nil(err)
+	assert.Equal([][]string{{"top", "dir", "inner.txt"}, {"top", "dir (1)"}}, paths)
+
+	for _, path := range [][]string{{".."}, {"sub", "..", "..", "x"}, {"/abs"}, {""}} {
+		info.Files = []torrent.FileDict{{Path: path}}
+		_, err := filePaths(info)
+		assert.True(errors.Is(err, ErrUnsafePath), "%q", path)
+	}
+}
+
+func TestExistingFiles(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	data := randomData(3 << 14)
+	info := &torrent.InfoDict{Name: "a.bin", Length: int64(len(data)), PieceLength: 1 << 14, Pieces: testtorrent.PieceHashes(data, 1<<14)}
+	path := filepath.Join(dir, "a.bin")
+	for _, tc := range []struct {
+		name   string
+		exists []byte
+		want   string
+	}{
+		{"interrupted download", data[:1<<14+100], "a.bin"},
+		{"unrelated file", randomData(len(data)), "a (1).bin"},
+		{"longer file", append(append([]byte(nil), data...), 0), "a (1).bin"},
+	} {
+		ioutil.WriteFile(path, tc.exists, 0644)
+		s, err := openStorage(dir, info)
+		if assert.Nil(err, tc.name) {
+			assert.Equal(filepath.Join(dir, tc.want), s.files[0].path, tc.name)
+			s.Close()
+		}
+		got, _ := ioutil.ReadFile(path)
+		assert.Equal(tc.exists, got, tc.name)
+	}
+
+	// Numbers taken on disk are skipped too.
+	ioutil.WriteFile(filepath.Join(dir, "a (1).bin"), nil, 0644)
+	s, err := openStorage(dir, info)
+	if assert.Nil(err) {
+		assert.Equal(filepath.Join(dir, "a (2).bin"), s.files[0].path)
+		s.Close()
+	}
+}
+
+func TestUnsafeTorrent(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: filepath.Join(dir, "downloads")})
+	assert.Nil(err)
+	defer c.Close()
+
+	metainfo, _ := testtorrent.Make("../../.bashrc", randomData(100), 1<<14, "")
+	_, err = c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.True(errors.Is(err, ErrUnsafePath), "%v", err)
+	files := []testtorrent.File{{Path: []string{"..", "escape.bin"}, Data: randomData(100)}}
+	metainfo, _ = testtorrent.MakeMultiFile("multi", files, 1<<14, nil)
+	_, err = c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.True(errors.Is(err, ErrUnsafePath), "%v", err)
+	assert.Equal(0, len(c.Torrents()))
+
+	// Reserved characters are replaced on disk, but the torrent keeps its names.
+	data := randomData(1000)
+	metainfo, _ = testtorrent.Make("what?.bin", data, 1<<14, "")
+	os.MkdirAll(filepath.Join(dir, "downloads"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "downloads", "what_.bin"), data, 0644)
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Equal("what?.bin", tor.Name())
+	assert.Nil(tor.Start(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(tor.Wait(ctx))
+}
+
+func TestSymlinkedFile(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	outside := tempDir(t)
+	defer os.RemoveAll(outside)
+	// The torrent's directory leads outside the download directory.
+	assert.Nil(os.Symlink(outside, filepath.Join(dir, "multi")))
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+	files := []testtorrent.File{{Path: []string{"a.bin"}, Data: randomData(1000)}, {Path: []string{"empty"}}}
+	metainfo, _ := testtorrent.MakeMultiFile("multi", files, 1<<14, nil)
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(tor.Start(context.Background()))
+	for i := 0; i < 100 && tor.Err() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(errors.Is(tor.Err(), ErrUnsafePath), "%v", tor.Err())
+	entries, _ := ioutil.ReadDir(outside)
+	assert.Equal(0, len(entries))
+}
+
+func TestRemoveSymlinked(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	outside := tempDir(t)
+	defer os.RemoveAll(outside)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+	files := []testtorrent.File{{Path: []string{"a.bin"}, Data: randomData(1000)}, {Path: []string{"sub", "b.bin"}, Data: randomData(1000)}}
+	metainfo, _ := testtorrent.MakeMultiFile("multi", files, 1<<14, nil)
+	for _, f := range files {
+		path := filepath.Join(append([]string{dir, "multi"}, f.Path...)...)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, f.Data, 0644)
+	}
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(tor.Start(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(tor.Wait(ctx))
+
+	// The directory is swapped for a symlink leading outside the download directory.
+	ioutil.WriteFile(filepath.Join(outside, "b.bin"), nil, 0644)
+	assert.Nil(os.RemoveAll(filepath.Join(dir, "multi", "sub")))
+	assert.Nil(os.Symlink(outside, filepath.Join(dir, "multi", "sub")))
+	err = tor.Remove()
+	assert.True(errors.Is(err, ErrUnsafePath), "%v", err)
+	_, err = os.Stat(filepath.Join(outside, "b.bin"))
+	assert.Nil(err)
+	_, err = os.Stat(filepath.Join(dir, "multi", "a.bin"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestPathInUse(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	data := randomData(1000)
+	ioutil.WriteFile(filepath.Join(dir, "same.bin"), data, 0644)
+	c, err := NewClient(&Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+
+	metainfo, _ := testtorrent.Make("same.bin", data, 1<<14, "")
+	first, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(first.Start(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(first.Wait(ctx))
+
+	// Another torrent named the same, differing only in case, can't write over its files.
+	metainfo, _ = testtorrent.Make("SAME.bin", randomData(1000), 1<<14, "")
+	second, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	assert.Nil(err)
+	assert.Nil(second.Start(context.Background()))
+	for i := 0; i < 100 && second.Err() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(errors.Is(second.Err(), ErrPathInUse), "%v", second.Err())
+	// The failed session is over, so it can be started again.
+	for i := 0; i < 100 && second.Stats().Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(second.Stats().Running)
+	// Removing it leaves the first torrent's files alone.
+	assert.Nil(second.Remove())
+	got, err := ioutil.ReadFile(filepath.Join(dir, "same.bin"))
+	assert.Nil(err)
+	assert.Equal(data, got)
+
+	// Once the first torrent is stopped, the name is free again.
+	assert.Nil(first.Stop())
+	assert.Nil(c.claimRoot("same.bin", second))
+}
@@ -0,0 +1,670 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/saicheems/gotorrent/bitset"
+	"github.com/saicheems/gotorrent/torrent"
+)
+
+const (
+	// maxRequests is the number of block requests we keep outstanding with a peer.
+	maxRequests = 16
+	// maxRequestLength is the largest block we'll serve to a peer.
+	maxRequestLength = 1 << 17
+	// utMetadataID is the extended message ID we receive ut_metadata messages with.
+	utMetadataID = 1
+	// clientVersion is sent in the extension handshake.
+	clientVersion = "gotorrent"
+	// allowedFastCount is the number of pieces Fast Extension peers may request while choked.
+	allowedFastCount = 10
+)
+
+// errProtocol is returned when a peer breaks the protocol, which gets it disconnected.
+var errProtocol = errors.New("peer protocol violation")
+
+// peer holds the state of a connection to a peer. All fields are owned by the peer's goroutine
+// except wake, which anyone may signal on.
+type peer struct {
+	t        *Torrent
+	conn     net.Conn
+	ip       string // The peer's address, which bans apply to.
+	id       string
+	reserved torrent.Reserved
+	fast     bool // Both sides support the Fast Extension.
+	ctx      context.Context
+	cancel   context.CancelFunc // Disconnects the peer.
+	log      *slog.Logger
+	msgOut   chan torrent.Message
+	wake     chan struct{}
+
+	bitfield       *bitset.BitSet // Pieces the peer has.
+	sentHave       *bitset.BitSet // Pieces the peer knows we have.
+	peerChoking    bool
+	peerInterested bool
+	amChoking      bool
+	amInterested   bool
+	uploadSlot     bool
+	requests       map[block]time.Time // Outstanding requests and when they were sent.
+	utMetadata     int                 // The peer's ID for ut_metadata, 0 if unsupported.
+	allowedFast    []int               // Pieces the peer lets us request while it chokes us.
+	grantedFast    []int               // Pieces we let the peer request while we choke it.
+
+	infoMu sync.Mutex // Guards info, which is read by other goroutines.
+	info   PeerInfo
+}
+
+// PeerInfo describes a connected peer.
+type PeerInfo struct {
+	Addr net.Addr
+	ID   string
+	// Client and ClientVersion identify the peer's client from its peer ID. Both are empty if the
+	// ID isn't in a style we know.
+	Client        string
+	ClientVersion string
+	// Reserved holds the reserved bytes of the peer's handshake, which advertise its capabilities.
+	Reserved torrent.Reserved
+	// ExtensionVersion is the client version the peer sent in its extension handshake, if any.
+	ExtensionVersion string
+	// HashFailures is the number of pieces that failed verification the peer sent data for.
+	HashFailures int
+	// AmChoking and AmInterested are our choke and interest state towards the peer, PeerChoking
+	// and PeerInterested the peer's towards us.
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+}
+
+// Info returns what we know about the peer.
+func (p *peer) Info() PeerInfo {
+	p.infoMu.Lock()
+	defer p.infoMu.Unlock()
+	return p.info
+}
+
+// updateInfo copies the choke and interest state into the peer's info.
+func (p *peer) updateInfo() {
+	p.infoMu.Lock()
+	defer p.infoMu.Unlock()
+	p.info.AmChoking, p.info.AmInterested = p.amChoking, p.amInterested
+	p.info.PeerChoking, p.info.PeerInterested = p.peerChoking, p.peerInterested
+}
+
+// notify wakes the peer up without blocking. Wakeups coalesce.
+func (p *peer) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// peerManager starts a service that connects to peers as they come in and spins up peer handling
+// threads. If we're connected to the maximum number of peers configured, either for this torrent
+// or for the whole client, the service will reject or close incoming connections. Peers in known
+// are dialed right away, further ones are taken from addrs. It blocks until ctx is cancelled and
+// every peer has shut down.
+func (t *Torrent) peerManager(ctx context.Context, known []string, addrs <-chan string, incoming <-chan incomingPeer, blocks chan blockData) {
+	cfg := t.client.config
+	totalConnections := 0
+	peerQuit := make(chan string) // Channel peers signal on with their address when they die.
+	connected := make(map[string]bool)
+
+	var peers sync.WaitGroup
+	startPeer := func(in incomingPeer, addr string) {
+		totalConnections++
+		peers.Add(1)
+		go func() {
+			defer peers.Done()
+			defer func() {
+				t.client.releaseConn()
+				// The manager stops listening for quits once it's shutting down.
+				select {
+				case peerQuit <- addr:
+				case <-ctx.Done():
+				}
+			}()
+			if in.conn == nil {
+				var err error
+				in.conn, err = t.client.dial(ctx, addr, t.infoHash)
+				if err != nil {
+					return
+				}
+			}
+			t.handlePeer(ctx, in, addr, blocks)
+		}()
+	}
+	dial := func(addr string) {
+		if totalConnections < cfg.MaxSeekConnections && !connected[addr] && t.client.acquireConn() {
+			// Dial in the background so a slow peer doesn't stall the manager.
+			connected[addr] = true
+			startPeer(incomingPeer{}, addr)
+		}
+	}
+	for _, addr := range known {
+		dial(addr)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			peers.Wait()
+			return
+		case addr := <-peerQuit:
+			totalConnections--
+			delete(connected, addr)
+		case in := <-incoming:
+			if totalConnections < cfg.MaxConnections && t.client.acquireConn() {
+				startPeer(in, in.conn.RemoteAddr().String())
+			} else {
+				in.conn.Close()
+			}
+		case addr := <-addrs:
+			dial(addr)
+		}
+	}
+}
+
+// handlePeer runs the protocol with a connected peer at addr until the connection fails or ctx is
+// cancelled. Peers we dialed are sent our handshake first, peers that connected to us have already
+// sent theirs and only need an answer.
+func (t *Torrent) handlePeer(parent context.Context, in incomingPeer, addr string, blocks chan blockData) {
+	cfg := t.client.config
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	conn := in.conn
+	defer conn.Close()
+	// Closing the connection unblocks whatever is waiting on it once we're shutting down.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	h := in.handshake
+	var err error
+	if h == nil {
+		h, err = torrent.Handshake(conn, t.infoHash, cfg.PeerID, t.client.reserved())
+	} else {
+		err = torrent.SendHandshake(conn, t.infoHash, cfg.PeerID, t.client.reserved())
+	}
+	if err != nil || h.PeerID == cfg.PeerID {
+		// Trackers sometimes hand out our own address.
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	conn = t.limitConn(ctx, conn)
+	pk := t.getPicker()
+	p := &peer{
+		t:           t,
+		conn:        conn,
+		ip:          addrIP(addr),
+		id:          h.PeerID,
+		reserved:    h.Reserved,
+		fast:        h.Reserved.SupportsFast(),
+		ctx:         ctx,
+		cancel:      cancel,
+		log:         t.log.With("subsystem", "peer", "peer", addr),
+		msgOut:      make(chan torrent.Message, maxRequests),
+		wake:        make(chan struct{}, 1),
+		bitfield:    bitset.New(pk.numPieces()),
+		sentHave:    pk.haveSnapshot(),
+		peerChoking: true,
+		amChoking:   true,
+		requests:    make(map[block]time.Time),
+	}
+	p.info = PeerInfo{Addr: conn.RemoteAddr(), ID: h.PeerID, Reserved: h.Reserved}
+	p.info.Client, p.info.ClientVersion, _ = torrent.ParsePeerID(h.PeerID)
+	p.updateInfo()
+	t.addPeer(p)
+	defer p.close()
+	msgIn := make(chan torrent.Message)
+	maxLength := torrent.MaxMessageLength(pk.numPieces(), maxRequestLength)
+	go readMessages(ctx, conn, cfg.KeepAliveTimeout, maxLength, msgIn)
+	go sendMessages(ctx, cancel, conn, cfg.KeepAliveTimeout, p.msgOut)
+	if !p.send(p.haveMessage()) {
+		return
+	}
+	if p.fast {
+		p.grantedFast = torrent.AllowedFastSet(allowedFastCount, remoteIP(conn), t.infoHash, pk.numPieces())
+		for _, index := range p.grantedFast {
+			if !p.send(torrent.AllowedFast{Index: uint32(index)}) {
+				return
+			}
+		}
+	}
+	if h.Reserved.SupportsExtensions() {
+		eh := torrent.ExtendedHandshake{M: map[string]int{"ut_metadata": utMetadataID}, V: clientVersion}
+		eh.MetadataSize = len(t.infoBytes())
+		if !p.send(eh.Message()) {
+			return
+		}
+	}
+	requestTimer := time.NewTimer(cfg.RequestTimeout)
+	defer requestTimer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-msgIn:
+			if !ok {
+				return
+			}
+			if err := p.handle(msg, blocks); err != nil {
+				p.log.Info("dropping peer", "err", err)
+				return
+			}
+		case <-p.wake:
+			p.sendHaves()
+		case <-requestTimer.C:
+			p.expireRequests()
+		}
+		p.updateInterest()
+		p.updateChoke()
+		p.fillRequests()
+		p.updateInfo()
+		resetTimer(requestTimer, p.nextExpiry())
+	}
+}
+
+// haveMessage returns the message that tells the peer which pieces we have when the connection is
+// set up. Fast Extension peers get the short forms when we have all or nothing.
+func (p *peer) haveMessage() torrent.Message {
+	if p.fast {
+		switch p.sentHave.Count() {
+		case 0:
+			return torrent.HaveNone{}
+		case p.sentHave.Len():
+			return torrent.HaveAll{}
+		}
+	}
+	return torrent.Bitfield{Data: p.sentHave.Clone().Bytes()}
+}
+
+// addrIP returns the host of a host:port address in its canonical form. The address of a peer
+// dialed through a proxy is the one we asked for rather than the connection's.
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// remoteIP returns the IP address of the other end of conn, or nil if it doesn't have one.
+func remoteIP(conn net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// send queues a message for the peer. It returns false if the peer is shutting down.
+func (p *peer) send(m torrent.Message) bool {
+	select {
+	case p.msgOut <- m:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// handle processes a message from the peer.
+func (p *peer) handle(msg torrent.Message, blocks chan blockData) error {
+	pk := p.t.getPicker()
+	p.log.Debug("received message", "type", reflect.TypeOf(msg))
+	switch m := msg.(type) {
+	case torrent.Choke:
+		p.peerChoking = true
+		if p.fast {
+			// Fast Extension peers reject each request they drop, and keep serving the
+			// allowed fast ones.
+			break
+		}
+		// A choke discards every request we had outstanding.
+		for b := range p.requests {
+			pk.release(b)
+			delete(p.requests, b)
+		}
+	case torrent.Unchoke:
+		p.peerChoking = false
+	case torrent.Interested:
+		p.peerInterested = true
+	case torrent.NotInterested:
+		p.peerInterested = false
+	case torrent.Have:
+		if int(m.PieceIndex) >= pk.numPieces() {
+			return errProtocol
+		}
+		if !p.bitfield.Check(int(m.PieceIndex)) {
+			p.bitfield.Set(int(m.PieceIndex))
+			pk.peerHave(int(m.PieceIndex))
+		}
+	case torrent.Bitfield:
+		bf, err := bitset.NewFromBytes(pk.numPieces(), m.Data)
+		if err != nil {
+			return err
+		}
+		p.setBitfield(bf)
+	case torrent.HaveAll:
+		if !p.fast {
+			return errProtocol
+		}
+		bf := bitset.New(pk.numPieces())
+		for i := 0; i < bf.Len(); i++ {
+			bf.Set(i)
+		}
+		p.setBitfield(bf)
+	case torrent.HaveNone:
+		if !p.fast {
+			return errProtocol
+		}
+		p.setBitfield(bitset.New(pk.numPieces()))
+	case torrent.Request:
+		return p.serve(m)
+	case torrent.Piece:
+		b := block{index: int(m.Index), begin: int(m.Begin), length: len(m.Block)}
+		if b.index >= pk.numPieces() || b.length == 0 || int64(b.begin)+int64(b.length) > int64(pk.pieceSize(b.index)) {
+			return errProtocol
+		}
+		delete(p.requests, b)
+		atomic.AddInt64(&p.t.downloaded, int64(len(m.Block)))
+		select {
+		case blocks <- blockData{block: b, data: m.Block, from: p.ip}:
+		case <-p.ctx.Done():
+		}
+	case torrent.Cancel:
+		// Requests are served as soon as they arrive, so there's nothing to cancel.
+	case torrent.SuggestPiece:
+		// Suggestions are only hints, rarest first does better for us.
+		if !p.fast {
+			return errProtocol
+		}
+	case torrent.RejectRequest:
+		if !p.fast {
+			return errProtocol
+		}
+		// Rejects for requests that already expired are harmless, so only outstanding
+		// ones are released for someone else to pick up.
+		b := block{index: int(m.Index), begin: int(m.Begin), length: int(m.Length)}
+		if _, ok := p.requests[b]; ok {
+			pk.release(b)
+			delete(p.requests, b)
+		}
+	case torrent.AllowedFast:
+		if !p.fast {
+			return errProtocol
+		}
+		index := int(m.Index)
+		if index < pk.numPieces() && !torrent.ContainsPiece(p.allowedFast, index) {
+			p.allowedFast = append(p.allowedFast, index)
+		}
+	case torrent.Extended:
+		return p.handleExtended(m)
+	}
+	return nil
+}
+
+// setBitfield replaces what we know the peer has.
+func (p *peer) setBitfield(bf *bitset.BitSet) {
+	pk := p.t.getPicker()
+	pk.addAvailability(p.bitfield, -1)
+	p.bitfield = bf
+	pk.addAvailability(p.bitfield, 1)
+}
+
+// serve answers a block request from the peer.
+func (p *peer) serve(r torrent.Request) error {
+	pk := p.t.getPicker()
+	if int(r.Index) >= pk.numPieces() || r.Length > maxRequestLength ||
+		int64(r.Begin)+int64(r.Length) > int64(pk.pieceSize(int(r.Index))) {
+		return errProtocol
+	}
+	// Requests from choked peers and for pieces we don't have are ignored, Fast Extension peers
+	// are told so. Choked peers may still have the pieces we granted them.
+	choked := p.amChoking && !torrent.ContainsPiece(p.grantedFast, int(r.Index))
+	if choked || !pk.hasPiece(int(r.Index)) {
+		if p.fast {
+			p.send(torrent.RejectRequest{Index: r.Index, Begin: r.Begin, Length: r.Length})
+		}
+		return nil
+	}
+	buf := make([]byte, r.Length)
+	off := int64(r.Index)*pk.pieceLength + int64(r.Begin)
+	if _, err := p.t.getStorage().ReadAt(buf, off); err != nil {
+		return err
+	}
+	if p.send(torrent.Piece{Index: r.Index, Begin: r.Begin, Block: buf}) {
+		atomic.AddInt64(&p.t.uploaded, int64(r.Length))
+	}
+	return nil
+}
+
+// handleExtended processes an extension protocol message.
+func (p *peer) handleExtended(m torrent.Extended) error {
+	switch m.ID {
+	case torrent.ExtendedHandshakeID:
+		h, err := torrent.ParseExtendedHandshake(m.Payload)
+		if err != nil {
+			return err
+		}
+		p.utMetadata = h.M["ut_metadata"]
+		p.infoMu.Lock()
+		p.info.ExtensionVersion = h.V
+		p.infoMu.Unlock()
+	case utMetadataID:
+		mm, err := torrent.ParseMetadataMessage(m.Payload)
+		if err != nil {
+			return err
+		}
+		if mm.Type != torrent.MetadataRequest || p.utMetadata == 0 {
+			return nil
+		}
+		reply := torrent.MetadataMessage{Type: torrent.MetadataReject, Piece: mm.Piece}
+		info := p.t.infoBytes()
+		if begin := mm.Piece * torrent.MetadataPieceSize; begin < len(info) {
+			end := begin + torrent.MetadataPieceSize
+			if end > len(info) {
+				end = len(info)
+			}
+			reply = torrent.MetadataMessage{Type: torrent.MetadataData, Piece: mm.Piece, TotalSize: len(info), Data: info[begin:end]}
+		}
+		p.send(torrent.Extended{ID: uint8(p.utMetadata), Payload: reply.Payload()})
+	}
+	return nil
+}
+
+// sendHaves tells the peer about pieces we've finished since we last told it.
+func (p *peer) sendHaves() {
+	have := p.t.getPicker().haveSnapshot()
+	for i := 0; i < have.Len(); i++ {
+		if have.Check(i) && !p.sentHave.Check(i) {
+			p.sentHave.Set(i)
+			if !p.send(torrent.Have{PieceIndex: uint32(i)}) {
+				return
+			}
+		}
+	}
+}
+
+// updateInterest tells the peer whether it has anything we want.
+func (p *peer) updateInterest() {
+	interested := p.t.getPicker().interesting(p.bitfield)
+	if interested == p.amInterested {
+		return
+	}
+	p.amInterested = interested
+	if interested {
+		p.send(torrent.Interested{})
+	} else {
+		p.send(torrent.NotInterested{})
+	}
+}
+
+// updateChoke unchokes the peer if it's interested and an upload slot is free, and chokes it again
+// once it loses interest.
+func (p *peer) updateChoke() {
+	if p.peerInterested && p.amChoking {
+		select {
+		case p.t.uploadSlots <- struct{}{}:
+			p.uploadSlot = true
+			p.amChoking = false
+			p.send(torrent.Unchoke{})
+		default:
+		}
+	} else if !p.peerInterested && !p.amChoking {
+		p.releaseSlot()
+		p.amChoking = true
+		p.send(torrent.Choke{})
+	}
+}
+
+// releaseSlot gives up the peer's upload slot and lets waiting peers have a go at it.
+func (p *peer) releaseSlot() {
+	if !p.uploadSlot {
+		return
+	}
+	p.uploadSlot = false
+	<-p.t.uploadSlots
+	p.t.wakePeers()
+}
+
+// fillRequests keeps the request pipeline to the peer full. While the peer chokes us only the
+// pieces it allowed us to request are asked for.
+func (p *peer) fillRequests() {
+	if !p.amInterested || len(p.requests) >= maxRequests {
+		return
+	}
+	peerHas := p.bitfield
+	if p.peerChoking {
+		if len(p.allowedFast) == 0 {
+			return
+		}
+		peerHas = bitset.New(p.bitfield.Len())
+		for _, index := range p.allowedFast {
+			if p.bitfield.Check(index) {
+				peerHas.Set(index)
+			}
+		}
+	}
+	now := time.Now()
+	for _, b := range p.t.getPicker().pick(peerHas, maxRequests-len(p.requests)) {
+		p.requests[b] = now
+		if !p.send(torrent.Request{Index: uint32(b.index), Begin: uint32(b.begin), Length: uint32(b.length)}) {
+			return
+		}
+	}
+}
+
+// expireRequests gives up on requests the peer has taken too long to answer so that they can be
+// requested from someone else.
+func (p *peer) expireRequests() {
+	pk := p.t.getPicker()
+	deadline := time.Now().Add(-p.t.client.config.RequestTimeout)
+	for b, sent := range p.requests {
+		if sent.Before(deadline) {
+			pk.release(b)
+			delete(p.requests, b)
+		}
+	}
+}
+
+// nextExpiry returns how long until the oldest outstanding request times out.
+func (p *peer) nextExpiry() time.Duration {
+	timeout := p.t.client.config.RequestTimeout
+	next := timeout
+	for _, sent := range p.requests {
+		if d := time.Until(sent.Add(timeout)); d < next {
+			next = d
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+// close releases everything the peer held on to once it has disconnected.
+func (p *peer) close() {
+	pk := p.t.getPicker()
+	for b := range p.requests {
+		pk.release(b)
+	}
+	pk.addAvailability(p.bitfield, -1)
+	p.t.removePeer(p)
+	p.releaseSlot()
+	// Other peers may want to pick up what this one left unfinished.
+	p.t.wakePeers()
+}
+
+// readMessages reads messages of at most maxLength bytes off the connection and delivers them on
+// msgIn. Messages with unknown IDs are skipped. msgIn is closed when the connection fails, a
+// malformed message arrives or the peer has been silent for longer than timeout.
+func readMessages(ctx context.Context, conn net.Conn, timeout time.Duration, maxLength uint32, msgIn chan torrent.Message) {
+	defer close(msgIn)
+	mr := torrent.NewMessageReader(conn, maxLength)
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		msg, err := mr.ReadMessage()
+		var unknown *torrent.UnknownMessageError
+		if errors.As(err, &unknown) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case msgIn <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendMessages delivers messages that come in on the message channel. Messages are buffered while
+// more are queued and flushed once the channel is empty. It also sends keep-alive messages if
+// nothing has been sent for timeout. A failed write cancels the peer.
+func sendMessages(ctx context.Context, cancel context.CancelFunc, conn net.Conn, timeout time.Duration, msgOut chan torrent.Message) {
+	defer cancel()
+	mw := torrent.NewMessageWriter(conn)
+	keepAlive := time.NewTimer(timeout)
+	defer keepAlive.Stop()
+	for {
+		var m torrent.Message
+		select {
+		case <-ctx.Done():
+			return
+		case m = <-msgOut:
+		case <-keepAlive.C:
+			m = torrent.KeepAlive{}
+		}
+		if err := mw.WriteMessage(m); err != nil {
+			return
+		}
+		if len(msgOut) > 0 {
+			continue
+		}
+		if err := mw.Flush(); err != nil {
+			return
+		}
+		resetTimer(keepAlive, timeout)
+	}
+}
+
+// resetTimer stops t, drains it if it already fired and rearms it to fire after d.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
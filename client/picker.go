@@ -0,0 +1,362 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/saicheems/gotorrent/bitset"
+)
+
+// blockSize is the size of the blocks pieces are requested in.
+const blockSize = 1 << 14
+
+// block identifies a block within a piece.
+type block struct {
+	index  int
+	begin  int
+	length int
+}
+
+type blockState uint8
+
+const (
+	blockWanted blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// picker decides which blocks to request from which peers. Pieces just ahead of readers come first,
+// then pieces are picked by priority and rarest first, or in order in sequential mode. Pieces that
+// are already partially downloaded are finished before new ones are started. Skipped pieces are
+// only picked if a reader needs them. It is shared by every peer of a torrent.
+type picker struct {
+	mu           sync.Mutex
+	pieceLength  int64
+	totalLength  int64
+	have         *bitset.BitSet
+	availability []int
+	active       map[int][]blockState
+	priority     []Priority // Nil if every piece has normal priority.
+	sequential   bool
+	urgent       map[interface{}]pieceRange // The pieces each reader needs next.
+}
+
+// pieceRange is a range of pieces from first to last inclusive.
+type pieceRange struct {
+	first, last int
+}
+
+func newPicker(have *bitset.BitSet, pieceLength int64, totalLength int64) *picker {
+	pk := new(picker)
+	pk.pieceLength = pieceLength
+	pk.totalLength = totalLength
+	pk.have = have
+	pk.availability = make([]int, have.Len())
+	pk.active = make(map[int][]blockState)
+	pk.urgent = make(map[interface{}]pieceRange)
+	return pk
+}
+
+// numPieces returns the number of pieces in the torrent.
+func (pk *picker) numPieces() int {
+	return pk.have.Len()
+}
+
+// pieceSize returns the length of the piece at index. Only the last piece may be short.
+func (pk *picker) pieceSize(index int) int {
+	if index == pk.numPieces()-1 {
+		return int(pk.totalLength - int64(index)*pk.pieceLength)
+	}
+	return int(pk.pieceLength)
+}
+
+// blockAt returns the block of piece index starting at begin.
+func (pk *picker) blockAt(index int, begin int) block {
+	length := pk.pieceSize(index) - begin
+	if length > blockSize {
+		length = blockSize
+	}
+	return block{index: index, begin: begin, length: length}
+}
+
+// setPriorities changes the priorities of the pieces. Nil gives every piece normal priority.
+func (pk *picker) setPriorities(priority []Priority) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pk.priority = priority
+}
+
+// setSequential switches between picking new pieces in order and rarest first.
+func (pk *picker) setSequential(sequential bool) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pk.sequential = sequential
+}
+
+// setUrgent marks the pieces from first to last as needed next by key, replacing the range it
+// marked before. It returns whether the range changed.
+func (pk *picker) setUrgent(key interface{}, first, last int) bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	r := pieceRange{first, last}
+	if old, ok := pk.urgent[key]; ok && old == r {
+		return false
+	}
+	pk.urgent[key] = r
+	return true
+}
+
+// clearUrgent forgets the pieces key needed.
+func (pk *picker) clearUrgent(key interface{}) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	delete(pk.urgent, key)
+}
+
+// isUrgent returns whether a reader needs the piece at index next. pk.mu must be held.
+func (pk *picker) isUrgent(index int) bool {
+	for _, r := range pk.urgent {
+		if r.first <= index && index <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// piecePriority returns the priority of the piece at index. pk.mu must be held.
+func (pk *picker) piecePriority(index int) Priority {
+	if pk.priority == nil {
+		return PriorityNormal
+	}
+	return pk.priority[index]
+}
+
+// wanted returns whether we want the piece at index and don't have it yet. pk.mu must be held.
+func (pk *picker) wanted(index int) bool {
+	return !pk.have.Check(index) && (pk.piecePriority(index) != PrioritySkip || pk.isUrgent(index))
+}
+
+// pick returns up to n blocks to request from a peer that has the pieces in peerHas and marks them
+// as requested.
+func (pk *picker) pick(peerHas *bitset.BitSet, n int) []block {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	var blocks []block
+	// Urgent pieces are finished first.
+	for _, urgent := range []bool{true, false} {
+		for index, states := range pk.active {
+			if len(blocks) == n {
+				return blocks
+			}
+			if pk.isUrgent(index) == urgent && peerHas.Check(index) && pk.wanted(index) {
+				blocks = pk.pickFrom(index, states, blocks, n)
+			}
+		}
+	}
+	for len(blocks) < n {
+		index := pk.rarest(peerHas)
+		if index < 0 {
+			break
+		}
+		states := make([]blockState, (pk.pieceSize(index)+blockSize-1)/blockSize)
+		pk.active[index] = states
+		blocks = pk.pickFrom(index, states, blocks, n)
+	}
+	return blocks
+}
+
+func (pk *picker) pickFrom(index int, states []blockState, blocks []block, n int) []block {
+	for i, state := range states {
+		if len(blocks) == n {
+			break
+		}
+		if state == blockWanted {
+			states[i] = blockRequested
+			blocks = append(blocks, pk.blockAt(index, i*blockSize))
+		}
+	}
+	return blocks
+}
+
+// rarest returns the next piece in peerHas to download out of those we want and aren't downloading
+// yet, or -1 if there isn't one. The first urgent piece wins, then the least available of the
+// highest priority pieces, or the first of them in sequential mode.
+func (pk *picker) rarest(peerHas *bitset.BitSet) int {
+	best := -1
+	bestUrgent := false
+	for i := 0; i < pk.numPieces(); i++ {
+		if !pk.wanted(i) || !peerHas.Check(i) {
+			continue
+		}
+		if _, ok := pk.active[i]; ok {
+			continue
+		}
+		urgent := pk.isUrgent(i)
+		if urgent {
+			if !bestUrgent {
+				best, bestUrgent = i, true
+			}
+			continue
+		}
+		if bestUrgent {
+			continue
+		}
+		if best < 0 || pk.piecePriority(i) > pk.piecePriority(best) ||
+			!pk.sequential && pk.piecePriority(i) == pk.piecePriority(best) && pk.availability[i] < pk.availability[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// release returns a requested block to the pool so it can be requested from another peer.
+func (pk *picker) release(b block) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	states, ok := pk.active[b.index]
+	if !ok || b.begin%blockSize != 0 || b.begin/blockSize >= len(states) {
+		return
+	}
+	if states[b.begin/blockSize] == blockRequested {
+		states[b.begin/blockSize] = blockWanted
+	}
+}
+
+// receive marks a block as received. It returns false if the block isn't one we want, in which
+// case it should be discarded.
+func (pk *picker) receive(b block) bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	states, ok := pk.active[b.index]
+	if !ok || b.begin%blockSize != 0 || b.begin/blockSize >= len(states) {
+		return false
+	}
+	if b != pk.blockAt(b.index, b.begin) || states[b.begin/blockSize] == blockReceived {
+		return false
+	}
+	states[b.begin/blockSize] = blockReceived
+	return true
+}
+
+// complete returns whether every block of an active piece has been received.
+func (pk *picker) complete(index int) bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	states, ok := pk.active[index]
+	if !ok {
+		return false
+	}
+	for _, state := range states {
+		if state != blockReceived {
+			return false
+		}
+	}
+	return true
+}
+
+// finish retires an active piece. If the piece verified it's marked as had, otherwise it will be
+// picked again from scratch.
+func (pk *picker) finish(index int, verified bool) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	delete(pk.active, index)
+	if verified {
+		pk.have.Set(index)
+	}
+}
+
+// addAvailability adds delta to the availability of every piece in peerHas.
+func (pk *picker) addAvailability(peerHas *bitset.BitSet, delta int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i := range pk.availability {
+		if peerHas.Check(i) {
+			pk.availability[i] += delta
+		}
+	}
+}
+
+// peerHave records that a peer announced a single piece.
+func (pk *picker) peerHave(index int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pk.availability[index]++
+}
+
+// interesting returns whether peerHas contains any piece we want.
+func (pk *picker) interesting(peerHas *bitset.BitSet) bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i := 0; i < pk.numPieces(); i++ {
+		if peerHas.Check(i) && pk.wanted(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPiece returns whether we have the piece at index.
+func (pk *picker) hasPiece(index int) bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	return pk.have.Check(index)
+}
+
+// haveSnapshot returns a copy of the pieces we have.
+func (pk *picker) haveSnapshot() *bitset.BitSet {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	return pk.have.Clone()
+}
+
+// bytesCompleted returns the number of bytes in pieces we have.
+func (pk *picker) bytesCompleted() int64 {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	var n int64
+	for i := 0; i < pk.numPieces(); i++ {
+		if pk.have.Check(i) {
+			n += int64(pk.pieceSize(i))
+		}
+	}
+	return n
+}
+
+// bytesLeft returns the number of bytes in pieces we want but don't have.
+func (pk *picker) bytesLeft() int64 {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	var n int64
+	for i := 0; i < pk.numPieces(); i++ {
+		if pk.wanted(i) {
+			n += int64(pk.pieceSize(i))
+		}
+	}
+	return n
+}
+
+// queueDepth returns the number of pieces being downloaded and of their blocks that have been
+// requested but not received.
+func (pk *picker) queueDepth() (pieces, requested int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for _, states := range pk.active {
+		for _, state := range states {
+			if state == blockRequested {
+				requested++
+			}
+		}
+	}
+	return len(pk.active), requested
+}
+
+// done returns whether we have every piece we want.
+func (pk *picker) done() bool {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i := 0; i < pk.numPieces(); i++ {
+		if pk.wanted(i) {
+			return false
+		}
+	}
+	return true
+}
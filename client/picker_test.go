@@ -0,0 +1,117 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/saicheems/gotorrent/bitset"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickerPick(t *testing.T) {
+	assert := assert.New(t)
+	// Three pieces of two blocks each, the last one short.
+	pk := newPicker(bitset.New(3), 2*blockSize, 5*blockSize+10)
+	assert.Equal(blockSize+10, pk.pieceSize(2))
+
+	peerHas := bitset.New(3)
+	peerHas.Set(0)
+	peerHas.Set(2)
+	other := bitset.New(3)
+	other.Set(0)
+	pk.addAvailability(peerHas, 1)
+	pk.addAvailability(other, 1)
+
+	// Piece 2 is rarer so it's picked first.
+	blocks := pk.pick(peerHas, 1)
+	assert.Equal([]block{{2, 0, blockSize}}, blocks)
+	// The rest of piece 2 is finished before piece 0 is started.
+	blocks = pk.pick(peerHas, 3)
+	assert.Equal([]block{{2, blockSize, 10}, {0, 0, blockSize}, {0, blockSize, blockSize}}, blocks)
+	assert.Equal(0, len(pk.pick(peerHas, 1)))
+
+	// Released blocks are picked again.
+	pk.release(block{0, blockSize, blockSize})
+	assert.Equal([]block{{0, blockSize, blockSize}}, pk.pick(peerHas, 5))
+}
+
+func TestPickerReceive(t *testing.T) {
+	assert := assert.New(t)
+	pk := newPicker(bitset.New(2), 2*blockSize, 4*blockSize)
+	peerHas := bitset.New(2)
+	peerHas.Set(1)
+	assert.True(pk.interesting(peerHas))
+	blocks := pk.pick(peerHas, 2)
+
+	assert.False(pk.receive(block{1, 0, 10}))
+	assert.False(pk.receive(block{0, 0, blockSize}))
+	assert.True(pk.receive(blocks[0]))
+	assert.False(pk.receive(blocks[0]))
+	assert.False(pk.complete(1))
+	assert.True(pk.receive(blocks[1]))
+	assert.True(pk.complete(1))
+
+	// A piece that fails verification is downloaded again from scratch.
+	pk.finish(1, false)
+	assert.False(pk.hasPiece(1))
+	assert.Equal(blocks, pk.pick(peerHas, 2))
+	pk.receive(blocks[0])
+	pk.receive(blocks[1])
+	pk.finish(1, true)
+	assert.True(pk.hasPiece(1))
+	assert.False(pk.interesting(peerHas))
+	assert.Equal(int64(2*blockSize), pk.bytesCompleted())
+	assert.False(pk.done())
+}
+
+func TestPickerPriority(t *testing.T) {
+	assert := assert.New(t)
+	pk := newPicker(bitset.New(4), blockSize, 4*blockSize)
+	peerHas := bitset.New(4)
+	for i := 0; i < 4; i++ {
+		peerHas.Set(i)
+	}
+	pk.addAvailability(peerHas, 1)
+	rare := bitset.New(4)
+	rare.Set(3)
+	pk.addAvailability(rare, -1)
+	pk.setPriorities([]Priority{PrioritySkip, PriorityLow, PriorityHigh, PriorityNormal})
+
+	// Priority beats rarity, and skipped pieces are never picked.
+	assert.Equal([]block{{2, 0, blockSize}, {3, 0, blockSize}, {1, 0, blockSize}}, pk.pick(peerHas, 4))
+	assert.Equal(int64(3*blockSize), pk.bytesLeft())
+	for _, index := range []int{1, 2, 3} {
+		pk.finish(index, true)
+	}
+	assert.True(pk.done())
+	assert.False(pk.interesting(peerHas))
+	assert.Equal(int64(0), pk.bytesLeft())
+
+	pk.setPriorities(nil)
+	assert.False(pk.done())
+	assert.True(pk.interesting(peerHas))
+	assert.Equal(int64(blockSize), pk.bytesLeft())
+}
+
+func TestPickerUrgent(t *testing.T) {
+	assert := assert.New(t)
+	pk := newPicker(bitset.New(6), blockSize, 6*blockSize)
+	peerHas := bitset.New(6)
+	for i := 0; i < 6; i++ {
+		peerHas.Set(i)
+	}
+	pk.addAvailability(peerHas, 2)
+	rare := bitset.New(6)
+	rare.Set(1)
+	pk.addAvailability(rare, -1)
+	pk.setPriorities([]Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal, PrioritySkip, PriorityNormal})
+
+	// A reader's pieces come first, in order, even if they're skipped.
+	assert.True(pk.setUrgent("reader", 3, 4))
+	assert.False(pk.setUrgent("reader", 3, 4))
+	assert.Equal([]block{{3, 0, blockSize}, {4, 0, blockSize}, {1, 0, blockSize}}, pk.pick(peerHas, 3))
+	pk.clearUrgent("reader")
+
+	// In sequential mode the rest come in order instead of rarest first.
+	pk.setSequential(true)
+	assert.Equal([]block{{0, 0, blockSize}, {2, 0, blockSize}, {5, 0, blockSize}}, pk.pick(peerHas, 5))
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/saicheems/gotorrent/torrent"
+)
+
+var (
+	// ErrNoMetadata is returned when the files of a torrent are needed before the metadata of
+	// its magnet link has been fetched.
+	ErrNoMetadata = errors.New("torrent metadata not known yet")
+	// ErrNoSuchFile is returned for a file index outside the torrent's files.
+	ErrNoSuchFile = errors.New("no such file in torrent")
+)
+
+// Priority is how urgently the pieces of a file are downloaded. Pieces of higher priority files
+// are picked first, and skipped files aren't downloaded at all.
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high"}
+
+func (p Priority) String() string {
+	if p >= 0 && int(p) < len(priorityNames) {
+		return priorityNames[p]
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority returns the priority with the given name: skip, low, normal or high.
+func ParsePriority(name string) (Priority, error) {
+	for i, n := range priorityNames {
+		if n == name {
+			return Priority(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q", name)
+}
+
+// piecePriorities returns the priority of every piece given the priorities of the files. A piece
+// gets the highest priority of the files it overlaps, so pieces shared with a wanted file are
+// downloaded even if another of their files is skipped.
+func piecePriorities(info *torrent.InfoDict, files []Priority) []Priority {
+	if files == nil {
+		return nil
+	}
+	pieces := make([]Priority, len(info.Pieces)/20)
+	for i, f := range info.FileList() {
+		if f.Length == 0 {
+			continue
+		}
+		last := int((f.Offset + f.Length - 1) / info.PieceLength)
+		for index := int(f.Offset / info.PieceLength); index <= last; index++ {
+			if files[i] > pieces[index] {
+				pieces[index] = files[i]
+			}
+		}
+	}
+	return pieces
+}
+
+// Files returns the files of the torrent, or nil if its metadata isn't known yet.
+func (t *Torrent) Files() []torrent.File {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.meta.Info.Pieces == "" {
+		return nil
+	}
+	return t.meta.Info.FileList()
+}
+
+// FilePriorities returns the priority of every file of the torrent, or nil if its metadata isn't
+// known yet.
+func (t *Torrent) FilePriorities() []Priority {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.meta.Info.Pieces == "" {
+		return nil
+	}
+	if t.priorities == nil {
+		priorities := make([]Priority, len(t.meta.Info.FileList()))
+		for i := range priorities {
+			priorities[i] = PriorityNormal
+		}
+		return priorities
+	}
+	return append([]Priority(nil), t.priorities...)
+}
+
+// SetFilePriority changes the priority of the file at index. Every file starts out with normal
+// priority.
+func (t *Torrent) SetFilePriority(index int, p Priority) error {
+	priorities := t.FilePriorities()
+	if priorities == nil {
+		return ErrNoMetadata
+	}
+	if index < 0 || index >= len(priorities) {
+		return ErrNoSuchFile
+	}
+	priorities[index] = p
+	t.setPriorities(priorities)
+	return nil
+}
+
+// SelectFiles downloads only the files matching one of patterns and skips the rest. A pattern is
+// either the index of a file or a glob as understood by path.Match, which is matched against the
+// file's path within the torrent and against its name.
+func (t *Torrent) SelectFiles(patterns ...string) error {
+	files := t.Files()
+	if files == nil {
+		return ErrNoMetadata
+	}
+	multi := len(t.MetaInfo().Info.Files) > 0
+	priorities := make([]Priority, len(files))
+	for _, pattern := range patterns {
+		found := false
+		if index, err := strconv.Atoi(pattern); err == nil {
+			if index < 0 || index >= len(files) {
+				return ErrNoSuchFile
+			}
+			priorities[index] = PriorityNormal
+			continue
+		}
+		for i, f := range files {
+			p := f.Path
+			if multi {
+				// Leave out the torrent's directory.
+				p = p[1:]
+			}
+			full, err := path.Match(pattern, strings.Join(p, "/"))
+			if err != nil {
+				return err
+			}
+			base, _ := path.Match(pattern, p[len(p)-1])
+			if full || base {
+				priorities[i] = PriorityNormal
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no file matches %q", pattern)
+		}
+	}
+	t.setPriorities(priorities)
+	return nil
+}
+
+// setPriorities replaces the file priorities and hands the resulting piece priorities to the
+// picker.
+func (t *Torrent) setPriorities(priorities []Priority) {
+	t.mu.Lock()
+	t.priorities = priorities
+	pk := t.picker
+	pieces := piecePriorities(&t.meta.Info, priorities)
+	t.mu.Unlock()
+	if pk == nil {
+		// The picker picks them up once the torrent is opened.
+		return
+	}
+	pk.setPriorities(pieces)
+	t.updateComplete()
+	t.wakePeers()
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/saicheems/gotorrent/proxy"
+	"github.com/saicheems/gotorrent/utp"
+)
+
+// proxyTimeout bounds setting up a UDP relay with a SOCKS5 proxy.
+const proxyTimeout = 10 * time.Second
+
+// setProxy sets up the dialer and HTTP client from the configured proxy.
+func (c *Client) setProxy() error {
+	c.dialer = proxy.Direct
+	c.http = http.DefaultClient
+	if c.config.Proxy == "" {
+		if c.config.ProxyOnly {
+			return ErrProxyRequired
+		}
+		return nil
+	}
+	d, err := proxy.FromURL(c.config.Proxy, nil)
+	if err != nil {
+		return err
+	}
+	c.dialer = d
+	// The transport dials through the proxy itself, so it mustn't use proxies from the
+	// environment on top.
+	c.http = &http.Client{Transport: &http.Transport{
+		DialContext:         d.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	}}
+	return nil
+}
+
+// utpDialer returns the socket to dial peers over uTP from, or nil if they're only dialed over
+// TCP. Without a proxy it's the listener's socket. With a SOCKS5 proxy it's a socket relaying
+// through the proxy, set up on first use.
+func (c *Client) utpDialer() *utp.Socket {
+	if c.config.DisableUTP {
+		return nil
+	}
+	if c.config.Proxy == "" {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.utp
+	}
+	pl, ok := c.dialer.(proxy.PacketListener)
+	if !ok {
+		return nil
+	}
+	c.utpProxy.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), proxyTimeout)
+		defer cancel()
+		pc, err := pl.ListenPacket(ctx)
+		if err != nil {
+			c.log.Warn("couldn't relay uTP through the proxy", "subsystem", "proxy", "err", err)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed {
+			pc.Close()
+			return
+		}
+		c.proxyUTP = utp.NewSocket(pc)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proxyUTP
+}
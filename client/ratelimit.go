@@ -0,0 +1,252 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saicheems/gotorrent/ratelimit"
+)
+
+// scheduleInterval is how often the rate schedule is checked for a rule coming into effect.
+const scheduleInterval = time.Minute
+
+// RateRule replaces the client's rate limits during a daily window of time, e.g. to keep the
+// uplink usable during working hours.
+type RateRule struct {
+	// Days are the days the rule applies on, every day if empty.
+	Days []time.Weekday
+	// Start and End are the times of day the window starts and ends at, as offsets from
+	// midnight. A window ending before it starts runs past midnight.
+	Start, End time.Duration
+	// MaxUploadRate and MaxDownloadRate are the limits in bytes per second while the rule
+	// applies, 0 for no limit.
+	MaxUploadRate, MaxDownloadRate int64
+}
+
+// active returns whether the rule applies at t. The day of a window running past midnight is the
+// day it's checked on.
+func (r RateRule) active(t time.Time) bool {
+	if len(r.Days) > 0 {
+		found := false
+		for _, d := range r.Days {
+			found = found || d == t.Weekday()
+		}
+		if !found {
+			return false
+		}
+	}
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if r.Start <= r.End {
+		return r.Start <= tod && tod < r.End
+	}
+	return tod >= r.Start || tod < r.End
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseRateRule parses a rule written as "[days] start-end upload/download", e.g.
+// "mon-fri 09:00-17:00 100K/1M". Days are a range or a comma separated list of three letter day
+// names, rates are as accepted by ParseRate.
+func ParseRateRule(s string) (RateRule, error) {
+	var r RateRule
+	fields := strings.Fields(s)
+	if len(fields) == 3 {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return r, err
+		}
+		r.Days = days
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return r, fmt.Errorf("invalid rate rule %q", s)
+	}
+	window := strings.Split(fields[0], "-")
+	rates := strings.Split(fields[1], "/")
+	if len(window) != 2 || len(rates) != 2 {
+		return r, fmt.Errorf("invalid rate rule %q", s)
+	}
+	var err error
+	if r.Start, err = parseTimeOfDay(window[0]); err != nil {
+		return r, err
+	}
+	if r.End, err = parseTimeOfDay(window[1]); err != nil {
+		return r, err
+	}
+	if r.MaxUploadRate, err = ParseRate(rates[0]); err != nil {
+		return r, err
+	}
+	if r.MaxDownloadRate, err = ParseRate(rates[1]); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+func parseDays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.Split(part, "-")
+		first, ok := weekdays[bounds[0]]
+		last, ok2 := weekdays[bounds[len(bounds)-1]]
+		if !ok || !ok2 || len(bounds) > 2 {
+			return nil, fmt.Errorf("invalid days %q", s)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseRate parses a rate in bytes per second with an optional K, M or G suffix for multiples of
+// 1024, e.g. "500K" or "1.5M". "0" means no limit.
+func ParseRate(s string) (int64, error) {
+	mult := 1.0
+	num := strings.TrimSpace(s)
+	if n := len(num); n > 0 {
+		switch strings.ToUpper(num[n-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			num = num[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(f * mult), nil
+}
+
+// RateLimits returns the client-wide upload and download limits currently in force.
+func (c *Client) RateLimits() (upload, download int64) {
+	return c.uploadLimit.Rate(), c.downloadLimit.Rate()
+}
+
+// SetRateLimits changes the client-wide upload and download limits in bytes per second, 0 for no
+// limit. A rule of the rate schedule overrides them while it applies.
+func (c *Client) SetRateLimits(upload, download int64) {
+	c.mu.Lock()
+	c.maxUploadRate, c.maxDownloadRate = upload, download
+	c.mu.Unlock()
+	c.applyRates(time.Now())
+}
+
+// applyRates sets the client-wide limiters to the limits in force at now.
+func (c *Client) applyRates(now time.Time) {
+	c.mu.Lock()
+	up, down := c.maxUploadRate, c.maxDownloadRate
+	for _, r := range c.config.RateSchedule {
+		if r.active(now) {
+			up, down = r.MaxUploadRate, r.MaxDownloadRate
+			break
+		}
+	}
+	c.mu.Unlock()
+	c.uploadLimit.SetRate(up)
+	c.downloadLimit.SetRate(down)
+}
+
+// rateScheduler keeps the limits in line with the rate schedule until the client is closed.
+func (c *Client) rateScheduler() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closing:
+			return
+		case now := <-ticker.C:
+			c.applyRates(now)
+		}
+	}
+}
+
+// SetRateLimits changes the torrent's own upload and download limits in bytes per second, 0 for
+// no limit. The client-wide limits apply on top of them.
+func (t *Torrent) SetRateLimits(upload, download int64) {
+	t.uploadLimit.SetRate(upload)
+	t.downloadLimit.SetRate(download)
+}
+
+// RateLimits returns the torrent's own upload and download limits.
+func (t *Torrent) RateLimits() (upload, download int64) {
+	return t.uploadLimit.Rate(), t.downloadLimit.Rate()
+}
+
+// limitConn returns conn with reads and writes held back by the torrent's and the client's
+// limiters. Waits end when ctx is cancelled.
+func (t *Torrent) limitConn(ctx context.Context, conn net.Conn) net.Conn {
+	return &limitedConn{
+		Conn:   conn,
+		reader: t.limitReader(ctx, conn),
+		ctx:    ctx,
+		limits: []*ratelimit.Limiter{t.uploadLimit, t.client.uploadLimit},
+	}
+}
+
+// limitReader returns r with reads held back by the torrent's and the client's download limiters.
+func (t *Torrent) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	return &limitedReader{r: r, ctx: ctx, limits: []*ratelimit.Limiter{t.downloadLimit, t.client.downloadLimit}}
+}
+
+// limitedReader waits on its limiters for every byte read.
+type limitedReader struct {
+	r      io.Reader
+	ctx    context.Context
+	limits []*ratelimit.Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for _, l := range r.limits {
+		if werr := l.WaitN(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// limitedConn is a connection whose reads and writes wait on limiters.
+type limitedConn struct {
+	net.Conn
+	reader io.Reader
+	ctx    context.Context
+	limits []*ratelimit.Limiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	for _, l := range c.limits {
+		if err := l.WaitN(c.ctx, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
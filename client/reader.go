@@ -0,0 +1,189 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/saicheems/gotorrent/torrent"
+)
+
+var (
+	// ErrReaderClosed is returned when reading from a closed Reader.
+	ErrReaderClosed = errors.New("reader closed")
+	errWhence       = errors.New("invalid whence")
+	errNegativePos  = errors.New("negative position")
+)
+
+// Reader reads a file of a torrent while it's being downloaded. Reads block until the bytes they
+// need have been downloaded and verified, and the pieces just ahead of the read position are
+// downloaded before any others. A Reader isn't safe for concurrent use, except that Close may be
+// called to abort a blocked Read.
+type Reader struct {
+	t           *Torrent
+	file        torrent.File
+	pieceLength int64
+	pos         int64
+	readahead   int64
+
+	mu     sync.Mutex // Guards the reader's urgent pieces against Close.
+	closed chan struct{}
+}
+
+// NewReader returns a reader for the file at index, starting at the beginning of the file. Reads
+// only make progress while the torrent is running.
+func (t *Torrent) NewReader(index int) (*Reader, error) {
+	files := t.Files()
+	if files == nil {
+		return nil, ErrNoMetadata
+	}
+	if index < 0 || index >= len(files) {
+		return nil, ErrNoSuchFile
+	}
+	return &Reader{
+		t:           t,
+		file:        files[index],
+		pieceLength: t.MetaInfo().Info.PieceLength,
+		readahead:   t.client.config.Readahead,
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+// SetReadahead changes how many bytes ahead of the read position are downloaded first. It
+// defaults to the client's Readahead setting.
+func (r *Reader) SetReadahead(n int64) {
+	r.readahead = n
+	if pk := r.t.getPicker(); pk != nil {
+		r.setWindow(pk)
+	}
+}
+
+// Read reads from the file at the current position, blocking until at least the first byte has
+// been downloaded. It returns fewer bytes than asked for rather than wait for more pieces.
+func (r *Reader) Read(p []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, ErrReaderClosed
+	default:
+	}
+	if r.pos >= r.file.Length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if rest := r.file.Length - r.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	off := r.file.Offset + r.pos
+	pk, err := r.wait(int(off / r.pieceLength))
+	if err != nil {
+		return 0, err
+	}
+	// Read as far as the verified pieces go.
+	end := off + int64(len(p))
+	avail := (off/r.pieceLength + 1) * r.pieceLength
+	for avail < end && pk.hasPiece(int(avail/r.pieceLength)) {
+		avail += r.pieceLength
+	}
+	if avail < end {
+		p = p[:avail-off]
+	}
+	s := r.t.getStorage()
+	if s == nil {
+		return 0, ErrTorrentStopped
+	}
+	n, err := s.ReadAt(p, off)
+	r.pos += int64(n)
+	r.setWindow(pk)
+	return n, err
+}
+
+// Seek sets the position of the next Read, as in io.Seeker. Seeking past the end of the file is
+// allowed, reads there return io.EOF.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.file.Length
+	default:
+		return 0, errWhence
+	}
+	if offset < 0 {
+		return 0, errNegativePos
+	}
+	r.pos = offset
+	if pk := r.t.getPicker(); pk != nil {
+		r.setWindow(pk)
+	}
+	return offset, nil
+}
+
+// Close closes the reader, making a blocked Read return ErrReaderClosed. The pieces ahead of it are
+// no longer downloaded first.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+	close(r.closed)
+	if pk := r.t.getPicker(); pk != nil {
+		pk.clearUrgent(r)
+	}
+	return nil
+}
+
+// wait blocks until the piece at index has been verified. The reader's urgent pieces are handed to
+// the picker as soon as there is one.
+func (r *Reader) wait(index int) (*picker, error) {
+	for {
+		r.t.mu.Lock()
+		pk, event := r.t.picker, r.t.pieceEvent
+		r.t.mu.Unlock()
+		if pk != nil {
+			r.setWindow(pk)
+			if pk.hasPiece(index) {
+				return pk, nil
+			}
+		}
+		select {
+		case <-event:
+		case <-r.closed:
+			return nil, ErrReaderClosed
+		case <-r.t.done:
+			return nil, ErrTorrentStopped
+		}
+	}
+}
+
+// setWindow marks the pieces from the read position up to readahead bytes further as urgent, and
+// wakes up peers to request them if they changed.
+func (r *Reader) setWindow(pk *picker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+	if r.pos >= r.file.Length {
+		pk.clearUrgent(r)
+		return
+	}
+	off := r.file.Offset + r.pos
+	end := off + r.readahead
+	if fileEnd := r.file.Offset + r.file.Length; end > fileEnd {
+		end = fileEnd
+	}
+	if end <= off {
+		end = off + 1
+	}
+	if pk.setUrgent(r, int(off/r.pieceLength), int((end-1)/r.pieceLength)) {
+		r.t.wakePeers()
+	}
+}
@@ -0,0 +1,274 @@
+package client
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/saicheems/gotorrent/torrent"
+)
+
+// storage reads and writes torrent data on disk. The data is addressed as if every file of the
+// torrent was laid end to end. Files are only created once they're written to, so files that are
+// skipped don't take up space.
+type storage struct {
+	dir   string
+	mu    sync.Mutex // Guards the open files.
+	files []storageFile
+}
+
+type storageFile struct {
+	torrent.File
+	rel  []string // Path relative to dir, see filePaths.
+	path string
+	f    *os.File // Nil until the file is first used.
+}
+
+// openStorage prepares the files of a torrent inside dir, at the paths given by filePaths. A file
+// already there is taken to be the torrent's data if it could be, see adoptable. Other files are
+// left alone and the torrent's file is numbered instead, e.g. "a (1).txt". Only empty files are
+// created right away, since nothing is ever written to them.
+func openStorage(dir string, info *torrent.InfoDict) (*storage, error) {
+	paths, err := filePaths(info)
+	if err != nil {
+		return nil, err
+	}
+	s := &storage{dir: dir}
+	taken := make(map[string]bool) // Lower cased paths of the torrent's files.
+	for i, file := range info.FileList() {
+		path := filepath.Join(append([]string{dir}, paths[i]...)...)
+		s.files = append(s.files, storageFile{File: file, rel: paths[i], path: path})
+		taken[strings.ToLower(filepath.Join(paths[i]...))] = true
+	}
+	for i := range s.files {
+		sf := &s.files[i]
+		if err := checkSymlinks(dir, sf.rel); err != nil {
+			return nil, err
+		}
+		name := sf.rel[len(sf.rel)-1]
+		n := 0
+		for {
+			fi, err := os.Lstat(sf.path)
+			if os.IsNotExist(err) || err == nil && s.adoptable(i, fi, info) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			// Try the next number that none of the torrent's other files has.
+			rel := append([]string(nil), sf.rel...)
+			for {
+				n++
+				rel[len(rel)-1] = withSuffix(name, fmt.Sprintf(" (%d)", n))
+				if key := strings.ToLower(filepath.Join(rel...)); !taken[key] {
+					taken[key] = true
+					break
+				}
+			}
+			sf.rel = rel
+			sf.path = filepath.Join(append([]string{dir}, rel...)...)
+		}
+	}
+	for i, sf := range s.files {
+		if sf.Length == 0 {
+			if _, err := s.file(i, true); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// adoptable returns whether fi, found at the path of file i, can hold the torrent's data: it's a
+// regular file no longer than the torrent's, and unless the torrent's file is empty, at least one
+// of the pieces it's part of verifies. A download that was interrupted can be picked up again that
+// way, while a file that merely has the same name isn't written over or later removed.
+func (s *storage) adoptable(i int, fi os.FileInfo, info *torrent.InfoDict) bool {
+	sf := s.files[i]
+	if !fi.Mode().IsRegular() || fi.Size() > sf.Length {
+		return false
+	}
+	if sf.Length == 0 {
+		return true
+	}
+	first := sf.Offset / info.PieceLength
+	last := (sf.Offset + fi.Size() - 1) / info.PieceLength
+	buf := make([]byte, info.PieceLength)
+	for p := first; p <= last; p++ {
+		off := p * info.PieceLength
+		length := info.PieceLength
+		if rest := info.TotalLength() - off; length > rest {
+			length = rest
+		}
+		if s.peek(buf[:length], off) != nil {
+			continue
+		}
+		if hash := sha1.Sum(buf[:length]); string(hash[:]) == info.Pieces[p*20:p*20+20] {
+			return true
+		}
+	}
+	return false
+}
+
+// peek reads len(p) bytes at off like ReadAt, but without keeping the files open, so that a file
+// only looked at isn't counted as used.
+func (s *storage) peek(p []byte, off int64) error {
+	for _, sf := range s.files {
+		if len(p) == 0 {
+			break
+		}
+		if off >= sf.Offset+sf.Length {
+			continue
+		}
+		chunk := p
+		if rest := sf.Offset + sf.Length - off; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		f, err := os.Open(sf.path)
+		if err != nil {
+			return err
+		}
+		_, err = f.ReadAt(chunk, off-sf.Offset)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		p, off = p[len(chunk):], off+int64(len(chunk))
+	}
+	if len(p) > 0 {
+		return io.EOF
+	}
+	return nil
+}
+
+// file returns the file at index i, opening it if it isn't open yet. A file that doesn't exist is
+// created along with its directories if create is set, otherwise it's an error.
+func (s *storage) file(i int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sf := &s.files[i]
+	if sf.f != nil {
+		return sf.f, nil
+	}
+	if err := checkSymlinks(s.dir, sf.rel); err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(sf.path), 0755); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(sf.path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sf.f = f
+	return f, nil
+}
+
+func (s *storage) ReadAt(p []byte, off int64) (int, error) {
+	return s.apply(p, off, false, (*os.File).ReadAt)
+}
+
+func (s *storage) WriteAt(p []byte, off int64) (int, error) {
+	return s.apply(p, off, true, (*os.File).WriteAt)
+}
+
+// apply reads or writes p at off, split up between the files it spans. Files are created if
+// create is set.
+func (s *storage) apply(p []byte, off int64, create bool, op func(*os.File, []byte, int64) (int, error)) (int, error) {
+	n := 0
+	for i, sf := range s.files {
+		if len(p) == 0 {
+			break
+		}
+		if off >= sf.Offset+sf.Length {
+			continue
+		}
+		chunk := p
+		if rest := sf.Offset + sf.Length - off; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		f, err := s.file(i, create)
+		if err != nil {
+			return n, err
+		}
+		m, err := op(f, chunk, off-sf.Offset)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p, off = p[m:], off+int64(m)
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// used returns the files that have been opened, the ones the torrent created or took over.
+func (s *storage) used() []storageFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []storageFile
+	for _, sf := range s.files {
+		if sf.f != nil {
+			files = append(files, sf)
+		}
+	}
+	return files
+}
+
+// Close flushes the data written to disk and closes the files.
+func (s *storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, sf := range s.files {
+		if sf.f == nil {
+			continue
+		}
+		if err := sf.f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := sf.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// blockHashes returns the sha1 hash of every block of the length bytes at off.
+func (s *storage) blockHashes(off int64, length int) ([][sha1.Size]byte, error) {
+	var hashes [][sha1.Size]byte
+	buf := make([]byte, blockSize)
+	for begin := 0; begin < length; begin += blockSize {
+		n := length - begin
+		if n > blockSize {
+			n = blockSize
+		}
+		if _, err := s.ReadAt(buf[:n], off+int64(begin)); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, sha1.Sum(buf[:n]))
+	}
+	return hashes, nil
+}
+
+// verifyPiece returns whether the length bytes at off hash to the expected sha1 hash. Data that
+// hasn't been written yet never verifies.
+func (s *storage) verifyPiece(off int64, length int, hash string) bool {
+	h := sha1.New()
+	n, err := io.Copy(h, io.NewSectionReader(s, off, int64(length)))
+	if err != nil || n != int64(length) {
+		return false
+	}
+	return string(h.Sum(nil)) == hash
+}
@@ -0,0 +1,685 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/saicheems/gotorrent/bitset"
+	"github.com/saicheems/gotorrent/ratelimit"
+	"github.com/saicheems/gotorrent/torrent"
+)
+
+// ErrTorrentStopped is returned when using a torrent after it has been stopped.
+var ErrTorrentStopped = errors.New("torrent stopped")
+
+// Torrent is a handle to a torrent in a Client. A torrent does nothing until it's started, and can
+// be paused and started again any number of times until it's stopped.
+type Torrent struct {
+	client   *Client
+	infoHash string
+	log      *slog.Logger
+	added    time.Time
+
+	mu       sync.Mutex
+	meta     *torrent.MetaInfo
+	info     []byte // Bencoded info dictionary, nil if we can't share it.
+	picker   *picker
+	storage  *storage
+	peers    map[*peer]struct{}
+	webSeeds map[*webSeed]struct{}
+	cancel   context.CancelFunc // Non-nil while running.
+	exited   chan struct{}      // Closed when the running session has shut down.
+	incoming chan incomingPeer  // Incoming connections for the running session.
+	stopped  bool
+	err      error
+	complete chan struct{} // Closed once every wanted piece has been verified.
+	done     chan struct{} // Closed once the torrent is stopped.
+	gotInfo  chan struct{} // Closed once the metadata is known.
+	// completeAtOpen is set if every wanted piece was already on disk when the files were opened.
+	completeAtOpen bool
+	// priorities holds the priority of every file, nil until one is changed.
+	priorities []Priority
+	sequential bool
+	// hashFailures counts the pieces that failed verification each peer address sent data for.
+	hashFailures map[string]int
+	pieceEvent   chan struct{} // Closed and replaced whenever pieces are verified.
+	tracker      TrackerInfo   // The outcome of the last announce.
+
+	uploadSlots   chan struct{}
+	uploadLimit   *ratelimit.Limiter
+	downloadLimit *ratelimit.Limiter
+	downloaded    int64
+	uploaded      int64
+	rates         rateMeter
+	// Counters for the metrics, accessed atomically.
+	piecesFailed     int64
+	announces        int64
+	announceFailures int64
+}
+
+// Stats contains a snapshot of the state of a torrent.
+type Stats struct {
+	Length         int64
+	BytesCompleted int64
+	Downloaded     int64
+	Uploaded       int64
+	NumPieces      int
+	PiecesComplete int
+	Peers          int
+	// DownloadRate and UploadRate are the bytes per second transferred over the last few
+	// seconds.
+	DownloadRate int64
+	UploadRate   int64
+	// Running is whether the torrent has been started and isn't paused.
+	Running bool
+}
+
+func newTorrent(c *Client, m *torrent.MetaInfo, info []byte) (*Torrent, error) {
+	t := new(Torrent)
+	t.client = c
+	t.infoHash = m.InfoHash
+	t.added = time.Now()
+	t.log = c.log.With("info_hash", hex.EncodeToString([]byte(m.InfoHash)))
+	t.meta = m
+	t.info = info
+	if t.hasMetadata() {
+		if err := validateInfo(&m.Info); err != nil {
+			return nil, err
+		}
+	}
+	t.peers = make(map[*peer]struct{})
+	t.hashFailures = make(map[string]int)
+	t.webSeeds = make(map[*webSeed]struct{})
+	t.complete = make(chan struct{})
+	t.done = make(chan struct{})
+	t.gotInfo = make(chan struct{})
+	t.pieceEvent = make(chan struct{})
+	if t.hasMetadata() {
+		close(t.gotInfo)
+	}
+	t.uploadSlots = make(chan struct{}, c.config.UploadSlots)
+	t.uploadLimit = ratelimit.NewLimiter(0)
+	t.downloadLimit = ratelimit.NewLimiter(0)
+	return t, nil
+}
+
+// validateInfo checks that the file and piece layout of a torrent is consistent.
+func validateInfo(info *torrent.InfoDict) error {
+	if info.PieceLength <= 0 || info.Name == "" || len(info.Pieces)%20 != 0 {
+		return torrent.MalformedTorrentError
+	}
+	if info.Length < 0 {
+		return torrent.MalformedTorrentError
+	}
+	for _, f := range info.Files {
+		if f.Length < 0 || len(f.Path) == 0 {
+			return torrent.MalformedTorrentError
+		}
+	}
+	length := info.TotalLength()
+	if int64(len(info.Pieces)/20) != (length+info.PieceLength-1)/info.PieceLength {
+		return torrent.MalformedTorrentError
+	}
+	_, err := filePaths(info)
+	return err
+}
+
+// InfoHash returns the info hash of the torrent.
+func (t *Torrent) InfoHash() string {
+	return t.infoHash
+}
+
+// Added returns when the torrent was added to the client.
+func (t *Torrent) Added() time.Time {
+	return t.added
+}
+
+// Name returns the name of the torrent. For magnet links this is the display name until the
+// metadata has been fetched.
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.meta.Info.Name
+}
+
+// MetaInfo returns the metainfo of the torrent. For magnet links the info dictionary is empty until
+// the metadata has been fetched.
+func (t *Torrent) MetaInfo() *torrent.MetaInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.meta
+}
+
+// BitSet returns a copy of the set of pieces we have, or nil if the torrent hasn't been opened yet.
+func (t *Torrent) BitSet() *bitset.BitSet {
+	pk := t.getPicker()
+	if pk == nil {
+		return nil
+	}
+	return pk.haveSnapshot()
+}
+
+// Err returns the error that stopped the last session of the torrent, if any.
+func (t *Torrent) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Stats returns a snapshot of the state of the torrent.
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	s := Stats{Length: t.meta.Info.TotalLength(), Peers: len(t.peers), Running: t.cancel != nil}
+	pk := t.picker
+	t.mu.Unlock()
+	totals := t.totals()
+	s.Downloaded, s.Uploaded = totals.down, totals.up
+	s.DownloadRate, s.UploadRate = t.rates.rates(totals)
+	if pk != nil {
+		s.BytesCompleted = pk.bytesCompleted()
+		s.NumPieces = pk.numPieces()
+		s.PiecesComplete = pk.haveSnapshot().Count()
+	}
+	return s
+}
+
+// Peers returns information about every connected peer.
+func (t *Torrent) Peers() []PeerInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]PeerInfo, 0, len(t.peers))
+	for p := range t.peers {
+		info := p.Info()
+		info.HashFailures = t.hashFailures[p.ip]
+		peers = append(peers, info)
+	}
+	return peers
+}
+
+// Start connects to the swarm and starts downloading or seeding. The torrent runs until ctx is
+// cancelled or it's paused or stopped. Starting a running torrent does nothing.
+func (t *Torrent) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return ErrTorrentStopped
+	}
+	if t.cancel != nil {
+		return nil
+	}
+	if err := t.client.listen(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+	t.exited = make(chan struct{})
+	t.incoming = make(chan incomingPeer)
+	t.err = nil
+	go t.run(ctx, t.exited, t.incoming)
+	return nil
+}
+
+// incomingPeer is a connection from a peer whose handshake has been read but not yet answered.
+type incomingPeer struct {
+	conn      net.Conn
+	handshake *torrent.PeerHandshake
+}
+
+// accept hands an incoming connection to the running session. The connection is closed if the
+// torrent isn't running or doesn't pick it up in time.
+func (t *Torrent) accept(conn net.Conn, h *torrent.PeerHandshake) {
+	t.mu.Lock()
+	incoming, exited := t.incoming, t.exited
+	running := t.cancel != nil
+	t.mu.Unlock()
+	if !running {
+		conn.Close()
+		return
+	}
+	select {
+	case incoming <- incomingPeer{conn, h}:
+	case <-exited:
+		conn.Close()
+	case <-time.After(handshakeTimeout):
+		conn.Close()
+	}
+}
+
+// Pause disconnects from the swarm and tells the tracker we've stopped, but keeps the torrent
+// around so it can be started again. It returns once the session has shut down.
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	cancel, exited := t.cancel, t.exited
+	t.cancel = nil
+	t.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-exited
+}
+
+// Stop shuts the torrent down for good, closing its files and removing it from the client.
+func (t *Torrent) Stop() error {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return nil
+	}
+	t.stopped = true
+	t.mu.Unlock()
+	t.Pause()
+	t.client.remove(t)
+	close(t.done)
+	t.mu.Lock()
+	s := t.storage
+	t.storage = nil
+	t.mu.Unlock()
+	t.client.releaseRoot(t)
+	if s != nil {
+		return s.Close()
+	}
+	return nil
+}
+
+// Remove stops the torrent like Stop and deletes the files it stored in the download directory,
+// along with the directories of a multi-file torrent that are left empty. Files the torrent never
+// used, such as those of a torrent that was never started, are left alone.
+func (t *Torrent) Remove() error {
+	// Pausing first lets a torrent that's still opening its files finish doing so.
+	t.Pause()
+	s := t.getStorage()
+	err := t.Stop()
+	if s == nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, sf := range s.used() {
+		// A symlink put in place since could lead outside the download directory.
+		if rerr := checkSymlinks(s.dir, sf.rel); rerr != nil {
+			if err == nil {
+				err = rerr
+			}
+			continue
+		}
+		if rerr := os.Remove(sf.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = rerr
+		}
+		for i := 1; i < len(sf.rel); i++ {
+			dirs[filepath.Join(append([]string{s.dir}, sf.rel[:i]...)...)] = true
+		}
+	}
+	// Deeper directories have longer paths and go first. Ones that aren't empty stay.
+	var sorted []string
+	for d := range dirs {
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, d := range sorted {
+		os.Remove(d)
+	}
+	return err
+}
+
+// Wait blocks until every piece of the files we want has been downloaded and verified. It returns
+// ErrTorrentStopped if the torrent is stopped first, or the context's error if ctx is done first.
+func (t *Torrent) Wait(ctx context.Context) error {
+	complete := t.completeChan()
+	select {
+	case <-complete:
+		return nil
+	default:
+	}
+	select {
+	case <-complete:
+		return nil
+	case <-t.done:
+		return ErrTorrentStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run is the body of a torrent session. It returns once ctx is cancelled and every goroutine it
+// started has exited.
+func (t *Torrent) run(ctx context.Context, exited chan struct{}, incoming <-chan incomingPeer) {
+	defer close(exited)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	addrs := make(chan string)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer t.ended(exited)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t.announcer(ctx, addrs)
+	}()
+	go func() {
+		defer wg.Done()
+		t.meter(ctx)
+	}()
+	var known []string
+	if !t.hasMetadata() {
+		info, d, peers, err := t.fetchMetadata(ctx, addrs)
+		if err != nil {
+			return
+		}
+		t.setMetadata(info, d)
+		known = peers
+	}
+	if err := t.open(); err != nil {
+		t.fail(err)
+		return
+	}
+	blocks := make(chan blockData)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.writer(ctx, blocks)
+	}()
+	meta := t.MetaInfo()
+	var seeds []*webSeed
+	for _, u := range meta.URLList {
+		seeds = append(seeds, newWebSeed(t, u, false))
+	}
+	for _, u := range meta.HTTPSeeds {
+		seeds = append(seeds, newWebSeed(t, u, true))
+	}
+	for _, ws := range seeds {
+		wg.Add(1)
+		go func(ws *webSeed) {
+			defer wg.Done()
+			ws.run(ctx, blocks)
+		}(ws)
+	}
+	t.peerManager(ctx, known, addrs, incoming, blocks)
+}
+
+// ended forgets a session that stopped on its own, because it failed or the context given to Start
+// was cancelled, so that the torrent no longer reports itself as running and Start begins anew.
+func (t *Torrent) ended(exited chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exited == exited && t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+}
+
+// fail records the error that ended a session.
+func (t *Torrent) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.log.Error("torrent failed", "err", err)
+	t.err = err
+}
+
+// hasMetadata returns whether the info dictionary is known.
+func (t *Torrent) hasMetadata() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.meta.Info.Pieces != ""
+}
+
+// setMetadata fills in the info dictionary fetched for a magnet link.
+func (t *Torrent) setMetadata(info []byte, d *torrent.InfoDict) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := *t.meta
+	m.Info = *d
+	t.meta = &m
+	t.info = info
+	close(t.gotInfo)
+}
+
+// GotInfo returns a channel that's closed once the torrent's metadata is known, which for magnet
+// links is after it has been fetched from peers.
+func (t *Torrent) GotInfo() <-chan struct{} {
+	return t.gotInfo
+}
+
+// infoBytes returns the bencoded info dictionary if we're able to share it.
+func (t *Torrent) infoBytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.info
+}
+
+// open opens the storage of the torrent and checks which pieces are already on disk. It only does
+// any work the first time it's called.
+func (t *Torrent) open() error {
+	t.mu.Lock()
+	if t.storage != nil {
+		t.mu.Unlock()
+		return nil
+	}
+	info := &t.meta.Info
+	t.mu.Unlock()
+	// Hashing what's already on disk can take a while, so it's done without holding t.mu.
+	if err := validateInfo(info); err != nil {
+		return err
+	}
+	root, _ := sanitizeName(info.Name)
+	if err := t.client.claimRoot(root, t); err != nil {
+		return err
+	}
+	s, err := openStorage(t.client.config.DownloadDir, info)
+	if err != nil {
+		t.client.releaseRoot(t)
+		return err
+	}
+	pk := newPicker(bitset.New(len(info.Pieces)/20), info.PieceLength, info.TotalLength())
+	for i := 0; i < pk.numPieces(); i++ {
+		if s.verifyPiece(int64(i)*info.PieceLength, pk.pieceSize(i), info.Pieces[i*20:i*20+20]) {
+			pk.finish(i, true)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Priorities and sequential mode may have changed while we were hashing.
+	pk.setPriorities(piecePriorities(info, t.priorities))
+	pk.setSequential(t.sequential)
+	t.storage = s
+	t.picker = pk
+	if pk.done() {
+		t.completeAtOpen = true
+		close(t.complete)
+	}
+	t.notifyPieces()
+	return nil
+}
+
+// SetSequential switches the torrent between downloading pieces in order and rarest first. Pieces
+// just ahead of readers are downloaded first either way.
+func (t *Torrent) SetSequential(sequential bool) {
+	t.mu.Lock()
+	t.sequential = sequential
+	pk := t.picker
+	t.mu.Unlock()
+	if pk != nil {
+		pk.setSequential(sequential)
+	}
+}
+
+// notifyPieces wakes up readers waiting for pieces. t.mu must be held.
+func (t *Torrent) notifyPieces() {
+	close(t.pieceEvent)
+	t.pieceEvent = make(chan struct{})
+}
+
+func (t *Torrent) getPicker() *picker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.picker
+}
+
+func (t *Torrent) getStorage() *storage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.storage
+}
+
+// left returns the number of bytes of the files we want that we still need, as reported to the
+// tracker.
+func (t *Torrent) left() int64 {
+	pk := t.getPicker()
+	if pk == nil {
+		// We don't know the size of a magnet link until we have its metadata.
+		return metadataLeft
+	}
+	return pk.bytesLeft()
+}
+
+// completeChan returns the channel closed once every wanted piece has been verified.
+func (t *Torrent) completeChan() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.complete
+}
+
+// updateComplete closes the complete channel once every wanted piece has been verified, and
+// replaces it if more pieces are wanted after that.
+func (t *Torrent) updateComplete() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.picker == nil {
+		return
+	}
+	closed := false
+	select {
+	case <-t.complete:
+		closed = true
+	default:
+	}
+	done := t.picker.done()
+	if done && !closed {
+		close(t.complete)
+	} else if !done && closed {
+		t.complete = make(chan struct{})
+	}
+}
+
+// blockData is a block received from a peer on its way to disk.
+type blockData struct {
+	block
+	data []byte
+	from string // The address of the peer that sent the block, empty for web seeds.
+}
+
+// writer writes incoming blocks to disk. Once every block of a piece has arrived the piece is
+// verified against its hash, and peers are woken up to announce it or to re-request it if it
+// turned out to be corrupt. Peers that send corrupt data are banned, see smartBan.
+func (t *Torrent) writer(ctx context.Context, blocks chan blockData) {
+	pk := t.getPicker()
+	s := t.getStorage()
+	info := &t.MetaInfo().Info
+	log := t.log.With("subsystem", "storage")
+	sb := newSmartBan()
+	for {
+		var b blockData
+		select {
+		case <-ctx.Done():
+			return
+		case b = <-blocks:
+		}
+		if !pk.receive(b.block) {
+			continue
+		}
+		size := pk.pieceSize(b.index)
+		sb.received(b.block, (size+blockSize-1)/blockSize, b.from)
+		off := int64(b.index)*info.PieceLength + int64(b.begin)
+		start := time.Now()
+		_, err := s.WriteAt(b.data, off)
+		t.client.writeLatency.Observe(time.Since(start).Seconds())
+		if err != nil {
+			log.Error("couldn't write block", "piece", b.index, "err", err)
+			sb.drop(b.index)
+			pk.finish(b.index, false)
+			t.wakePeers()
+			continue
+		}
+		if !pk.complete(b.index) {
+			continue
+		}
+		pieceOff := int64(b.index) * info.PieceLength
+		hash := info.Pieces[b.index*20 : b.index*20+20]
+		ok := s.verifyPiece(pieceOff, size, hash)
+		if ok {
+			log.Debug("piece verified", "piece", b.index)
+			if sb.suspect(b.index) {
+				hashes, _ := s.blockHashes(pieceOff, size)
+				for _, ip := range sb.pass(b.index, hashes) {
+					if err := t.client.Ban(net.ParseIP(ip), fmt.Sprintf("sent a corrupt block of piece %d", b.index)); err != nil {
+						log.Error("couldn't save bans", "err", err)
+					}
+				}
+			} else {
+				sb.drop(b.index)
+			}
+		} else {
+			log.Warn("piece failed verification", "piece", b.index)
+			atomic.AddInt64(&t.piecesFailed, 1)
+			hashes, _ := s.blockHashes(pieceOff, size)
+			t.hashFailed(sb.fail(b.index, hashes))
+		}
+		pk.finish(b.index, ok)
+		if ok {
+			t.mu.Lock()
+			t.notifyPieces()
+			t.mu.Unlock()
+			t.updateComplete()
+		}
+		t.wakePeers()
+	}
+}
+
+// addPeer registers a connected peer.
+func (t *Torrent) addPeer(p *peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers[p] = struct{}{}
+}
+
+// removePeer forgets a disconnected peer.
+func (t *Torrent) removePeer(p *peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, p)
+}
+
+// addWebSeed registers a running web seed.
+func (t *Torrent) addWebSeed(ws *webSeed) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.webSeeds[ws] = struct{}{}
+}
+
+// removeWebSeed forgets a web seed that stopped.
+func (t *Torrent) removeWebSeed(ws *webSeed) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.webSeeds, ws)
+}
+
+// wakePeers tells every peer and web seed that the pieces we have or want have changed.
+func (t *Torrent) wakePeers() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for p := range t.peers {
+		p.notify()
+	}
+	for ws := range t.webSeeds {
+		ws.notify()
+	}
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/saicheems/gotorrent/bitset"
+	"github.com/saicheems/gotorrent/torrent"
+)
+
+const (
+	// webSeedBlocks is how many blocks a web seed is asked for at a time.
+	webSeedBlocks = 64
+	// webSeedRetry is how long a web seed is left alone after a failure. It doubles with every
+	// failure in a row, up to webSeedMaxRetry, which also bounds how long a server can ask us to
+	// stay away for.
+	webSeedRetry    = 5 * time.Second
+	webSeedMaxRetry = 10 * time.Minute
+	// webSeedTimeout bounds a single HTTP request.
+	webSeedTimeout = time.Minute
+)
+
+// webSeedError is returned when a web seed answers with an unexpected HTTP status. retryAfter is
+// set if the server said when to come back.
+type webSeedError struct {
+	status     int
+	retryAfter time.Duration
+}
+
+// errWebSeedRange is returned when a web seed answers a Range request with other bytes.
+var errWebSeedRange = errors.New("web seed returned the wrong range")
+
+func (e *webSeedError) Error() string {
+	return fmt.Sprintf("web seed returned %s", http.StatusText(e.status))
+}
+
+// webSeed downloads pieces from an HTTP server. It either serves the torrent's files, which are
+// fetched with Range requests (BEP 19), or is a seeding script that serves pieces (BEP 17). A web
+// seed has every piece and takes part in the piece picker like any other peer.
+type webSeed struct {
+	t        *Torrent
+	url      string
+	httpSeed bool // The server is a BEP 17 seeding script.
+	wake     chan struct{}
+	log      *slog.Logger
+}
+
+func newWebSeed(t *Torrent, u string, httpSeed bool) *webSeed {
+	log := t.log.With("subsystem", "webseed", "url", u)
+	return &webSeed{t: t, url: u, httpSeed: httpSeed, wake: make(chan struct{}, 1), log: log}
+}
+
+// notify wakes the web seed up without blocking. Wakeups coalesce.
+func (ws *webSeed) notify() {
+	select {
+	case ws.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run downloads whatever the picker hands out until ctx is cancelled. After a failed request the
+// web seed backs off before it tries again.
+func (ws *webSeed) run(ctx context.Context, blocks chan blockData) {
+	t := ws.t
+	t.addWebSeed(ws)
+	defer t.removeWebSeed(ws)
+	pk := t.getPicker()
+	all := bitset.New(pk.numPieces())
+	for i := 0; i < all.Len(); i++ {
+		all.Set(i)
+	}
+	pk.addAvailability(all, 1)
+	defer pk.addAvailability(all, -1)
+	failures := 0
+	for {
+		picked := pk.pick(all, webSeedBlocks)
+		if len(picked) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ws.wake:
+			}
+			continue
+		}
+		err := ws.download(ctx, picked, blocks)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		delay := webSeedRetry << uint(failures)
+		if delay > webSeedMaxRetry || delay <= 0 {
+			delay = webSeedMaxRetry
+		}
+		if we, ok := err.(*webSeedError); ok && we.retryAfter > 0 {
+			delay = we.retryAfter
+		}
+		ws.log.Warn("web seed failed", "err", err, "retry", delay)
+		failures++
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// download fetches the picked blocks and hands them to the writer. Consecutive blocks are fetched
+// with a single request. Blocks that couldn't be delivered are released back to the picker.
+func (ws *webSeed) download(ctx context.Context, picked []block, blocks chan blockData) error {
+	pk := ws.t.getPicker()
+	sort.Slice(picked, func(i, j int) bool {
+		if picked[i].index != picked[j].index {
+			return picked[i].index < picked[j].index
+		}
+		return picked[i].begin < picked[j].begin
+	})
+	offset := func(b block) int64 {
+		return int64(b.index)*pk.pieceLength + int64(b.begin)
+	}
+	delivered := 0
+	defer func() {
+		for _, b := range picked[delivered:] {
+			pk.release(b)
+		}
+	}()
+	for delivered < len(picked) {
+		// Seeding scripts serve one piece per request.
+		first := picked[delivered]
+		end := delivered + 1
+		length := first.length
+		for end < len(picked) && offset(picked[end]) == offset(first)+int64(length) &&
+			(!ws.httpSeed || picked[end].index == first.index) {
+			length += picked[end].length
+			end++
+		}
+		var data []byte
+		var err error
+		if ws.httpSeed {
+			data, err = ws.fetchPiece(ctx, first.index, first.begin, length)
+		} else {
+			data, err = ws.fetchFiles(ctx, offset(first), length)
+		}
+		if err != nil {
+			return err
+		}
+		for _, b := range picked[delivered:end] {
+			select {
+			case blocks <- blockData{block: b, data: data[:b.length]}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			atomic.AddInt64(&ws.t.downloaded, int64(b.length))
+			data = data[b.length:]
+			delivered++
+		}
+	}
+	return nil
+}
+
+// fetchFiles fetches length bytes of the torrent's content at off from the files on the server.
+func (ws *webSeed) fetchFiles(ctx context.Context, off int64, length int) ([]byte, error) {
+	info := &ws.t.MetaInfo().Info
+	buf := make([]byte, length)
+	filled := 0
+	for _, f := range info.FileList() {
+		if filled == length {
+			break
+		}
+		cur := off + int64(filled)
+		if cur >= f.Offset+f.Length {
+			continue
+		}
+		n := length - filled
+		if rest := f.Offset + f.Length - cur; int64(n) > rest {
+			n = int(rest)
+		}
+		req, err := http.NewRequest("GET", ws.fileURL(info, f), nil)
+		if err != nil {
+			return nil, err
+		}
+		start := cur - f.Offset
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+int64(n)-1))
+		if err := ws.get(ctx, req, buf[filled:filled+n], start == 0); err != nil {
+			return nil, err
+		}
+		filled += n
+	}
+	if filled != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
+
+// fileURL returns the URL of a file of the torrent. URLs ending in a slash are directories the
+// torrent is stored in, others name the file of a single file torrent.
+func (ws *webSeed) fileURL(info *torrent.InfoDict, f torrent.File) string {
+	u := ws.url
+	if info.Files == nil && !strings.HasSuffix(u, "/") {
+		return u
+	}
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	parts := make([]string, len(f.Path))
+	for i, p := range f.Path {
+		parts[i] = url.PathEscape(p)
+	}
+	return u + strings.Join(parts, "/")
+}
+
+// fetchPiece fetches length bytes at begin in a piece from a seeding script.
+func (ws *webSeed) fetchPiece(ctx context.Context, index int, begin int, length int) ([]byte, error) {
+	u, err := url.Parse(ws.url)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("info_hash", ws.t.infoHash)
+	q.Set("piece", strconv.Itoa(index))
+	q.Set("ranges", fmt.Sprintf("%d-%d", begin, begin+length-1))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if err := ws.get(ctx, req, buf, true); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// get sends req and reads the response into buf. Partial content is accepted if it's the range
+// that was asked for, a full response only if ok200 is set, in which case it has to start with
+// the requested bytes.
+func (ws *webSeed) get(ctx context.Context, req *http.Request, buf []byte, ok200 bool) error {
+	ctx, cancel := context.WithTimeout(ctx, webSeedTimeout)
+	defer cancel()
+	resp, err := ws.t.client.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPartialContent || (resp.StatusCode == http.StatusOK && ok200) {
+		if want := req.Header.Get("Range"); want != "" && resp.StatusCode == http.StatusPartialContent {
+			// Content-Range looks like "bytes 0-99/1000", the Range we sent like "bytes=0-99".
+			got := resp.Header.Get("Content-Range")
+			if i := strings.IndexByte(got, '/'); i < 0 || "bytes="+strings.TrimPrefix(got[:i], "bytes ") != want {
+				return errWebSeedRange
+			}
+		}
+		_, err = io.ReadFull(ws.t.limitReader(ctx, resp.Body), buf)
+		return err
+	}
+	we := &webSeedError{status: resp.StatusCode}
+	if resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests {
+		// Seeding scripts put the number of seconds to wait in the body.
+		retry := resp.Header.Get("Retry-After")
+		if ws.httpSeed && retry == "" {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 32))
+			retry = strings.TrimSpace(string(body))
+		}
+		if secs, err := strconv.Atoi(retry); err == nil && secs > 0 {
+			we.retryAfter = webSeedMaxRetry
+			if secs < int(webSeedMaxRetry/time.Second) {
+				we.retryAfter = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return we
+}
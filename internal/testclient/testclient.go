@@ -0,0 +1,44 @@
+// Package testclient sets up clients for tests.
+package testclient
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saicheems/gotorrent/client"
+	"github.com/saicheems/gotorrent/internal/testtorrent"
+)
+
+// Seed returns a client storing its data in a temporary directory, seeding a single file torrent
+// of data named name with 16 KiB pieces, and the torrent.
+func Seed(t *testing.T, name string, data []byte) (*client.Client, *client.Torrent) {
+	dir, err := ioutil.TempDir("", "gotorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+	c, err := client.NewClient(&client.Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metainfo, _ := testtorrent.Make(name, data, 1<<14, "")
+	tor, err := c.AddTorrentReader(bytes.NewReader(metainfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tor.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c, tor
+}
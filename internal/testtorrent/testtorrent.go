@@ -0,0 +1,77 @@
+// Package testtorrent builds torrents for tests.
+package testtorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// File is a file of a multi-file torrent.
+type File struct {
+	Path []string
+	Data []byte
+}
+
+// Make returns a bencoded single file torrent for data named name announcing to announce, if it's
+// set, and its info hash.
+func Make(name string, data []byte, pieceLength int, announce string) ([]byte, string) {
+	info := map[string]interface{}{
+		"name":         name,
+		"length":       len(data),
+		"piece length": pieceLength,
+		"pieces":       PieceHashes(data, pieceLength),
+	}
+	top := make(map[string]interface{})
+	if announce != "" {
+		top["announce"] = announce
+	}
+	return Encode(info, top)
+}
+
+// MakeMultiFile returns a bencoded multi-file torrent for files, with top holding any other keys
+// of the metainfo, and its info hash.
+func MakeMultiFile(name string, files []File, pieceLength int, top map[string]interface{}) ([]byte, string) {
+	var all []byte
+	var list []interface{}
+	for _, f := range files {
+		all = append(all, f.Data...)
+		list = append(list, map[string]interface{}{"length": len(f.Data), "path": f.Path})
+	}
+	info := map[string]interface{}{
+		"name":         name,
+		"files":        list,
+		"piece length": pieceLength,
+		"pieces":       PieceHashes(all, pieceLength),
+	}
+	return Encode(info, top)
+}
+
+// PieceHashes returns the concatenated sha1 hashes of the pieces of data.
+func PieceHashes(data []byte, pieceLength int) string {
+	var pieces bytes.Buffer
+	for i := 0; i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[i:end])
+		pieces.Write(h[:])
+	}
+	return pieces.String()
+}
+
+// Encode returns the bencoded metainfo with info and the other keys in top, and its info hash.
+func Encode(info map[string]interface{}, top map[string]interface{}) ([]byte, string) {
+	var buf bytes.Buffer
+	bencode.Marshal(&buf, info)
+	infoHash := sha1.Sum(buf.Bytes())
+	buf.Reset()
+	m := map[string]interface{}{"info": info}
+	for k, v := range top {
+		m[k] = v
+	}
+	bencode.Marshal(&buf, m)
+	return buf.Bytes(), string(infoHash[:])
+}
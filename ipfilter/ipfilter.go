@@ -0,0 +1,218 @@
+// Package ipfilter decides which IP addresses to refuse connections to and from. Filters are built
+// from lists of address ranges: eMule ipfilter.dat files, PeerGuardian .p2p files and lists of
+// CIDR blocks or single addresses, which may be mixed within one file.
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// emuleAllowLevel is the access level from which eMule ranges are allowed rather than blocked.
+const emuleAllowLevel = 128
+
+// ipRange is a range of addresses from first to last inclusive. IPv4 addresses are stored in
+// their IPv6 mapped form so both kinds sort together.
+type ipRange struct {
+	first, last [16]byte
+}
+
+// Filter is a set of blocked address ranges. The nil Filter blocks nothing. A Filter is never
+// modified once built, so it's safe for concurrent use.
+type Filter struct {
+	ranges []ipRange // Sorted and without overlaps.
+}
+
+// Parse reads a list of ranges to block. Each line is one of:
+//
+//	1.2.3.0 - 1.2.3.255 , 100 , Description   (eMule, levels of 128 and up are allowed)
+//	Description:1.2.3.0-1.2.3.255             (PeerGuardian)
+//	1.2.3.0/24                                (CIDR)
+//	1.2.3.4 or 1.2.3.0-1.2.3.255              (address or range)
+//
+// Blank lines and lines starting with # or // are skipped.
+func Parse(r io.Reader) (*Filter, error) {
+	var ranges []ipRange
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, block, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if block {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return build(ranges), nil
+}
+
+// ParseFile reads a list of ranges to block from the file at path, see Parse.
+func ParseFile(path string) (*Filter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	filter, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return filter, nil
+}
+
+// Merge returns a filter blocking everything any of filters blocks.
+func Merge(filters ...*Filter) *Filter {
+	var ranges []ipRange
+	for _, f := range filters {
+		if f != nil {
+			ranges = append(ranges, f.ranges...)
+		}
+	}
+	return build(ranges)
+}
+
+// build sorts ranges and merges the ones that overlap or touch.
+func build(ranges []ipRange) *Filter {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first[:], ranges[j].first[:]) < 0
+	})
+	var merged []ipRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := last.last
+			if increment(&next) && bytes.Compare(r.first[:], next[:]) <= 0 || bytes.Equal(last.last[:], maxAddr[:]) {
+				if bytes.Compare(r.last[:], last.last[:]) > 0 {
+					last.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return &Filter{ranges: merged}
+}
+
+var maxAddr = [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// increment adds one to a, returning false if it overflowed.
+func increment(a *[16]byte) bool {
+	for i := len(a) - 1; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocked returns whether ip is in one of the filter's ranges.
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil || len(f.ranges) == 0 {
+		return false
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	var a [16]byte
+	copy(a[:], ip16)
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return bytes.Compare(f.ranges[i].last[:], a[:]) >= 0
+	})
+	return i < len(f.ranges) && bytes.Compare(f.ranges[i].first[:], a[:]) <= 0
+}
+
+// Len returns the number of distinct ranges in the filter.
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.ranges)
+}
+
+// parseLine parses one line of a list. block is false for eMule ranges that are allowed.
+func parseLine(line string) (r ipRange, block bool, err error) {
+	// eMule lines have the access level after the range.
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		if level, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil {
+			r, err = parseRange(fields[0])
+			return r, level < emuleAllowLevel, err
+		}
+	}
+	if _, ipnet, err := net.ParseCIDR(line); err == nil {
+		first := ipnet.IP.To16()
+		last := make(net.IP, len(first))
+		ones, bits := ipnet.Mask.Size()
+		// The mask is shifted along for IPv4 networks, which are stored as IPv6 mapped.
+		mask := net.CIDRMask(ones+len(first)*8-bits, len(first)*8)
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		copy(r.first[:], first)
+		copy(r.last[:], last)
+		return r, true, nil
+	}
+	// PeerGuardian lines start with a description, which may itself contain colons. IPv6
+	// addresses don't appear in them.
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Count(line[i:], ".") > 0 {
+		line = line[i+1:]
+	}
+	r, err = parseRange(line)
+	return r, true, err
+}
+
+// parseRange parses "first-last" or a single address.
+func parseRange(s string) (ipRange, error) {
+	var r ipRange
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	a, b := parseIP(first), parseIP(last)
+	if a == nil || b == nil {
+		return r, fmt.Errorf("invalid range %q", s)
+	}
+	copy(r.first[:], a)
+	copy(r.last[:], b)
+	if bytes.Compare(r.first[:], r.last[:]) > 0 {
+		return r, fmt.Errorf("invalid range %q", s)
+	}
+	return r, nil
+}
+
+// parseIP parses an address in its 16 byte form. IPv4 octets may have leading zeros, as they do in
+// eMule lists.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s)
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	var b [4]byte
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return nil
+		}
+		b[i] = byte(n)
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3]).To16()
+}
@@ -0,0 +1,85 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const list = `# Mixed list
+001.002.003.000 - 001.002.003.255 , 000 , eMule blocked
+005.000.000.000 - 005.255.255.255 , 200 , eMule allowed
+Bad Corp, Inc:10.0.0.0-10.0.0.10
+Other:10.0.0.5-10.0.1.0
+192.168.0.0/16
+2001:db8::/32
+// single address
+8.8.4.4
+
+`
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+	f, err := Parse(strings.NewReader(list))
+	assert.Nil(err)
+	// The two PeerGuardian ranges overlap and are merged.
+	assert.Equal(5, f.Len())
+	for ip, blocked := range map[string]bool{
+		"1.2.3.0":         true,
+		"1.2.3.255":       true,
+		"1.2.4.0":         false,
+		"5.1.1.1":         false,
+		"10.0.0.0":        true,
+		"10.0.0.200":      true,
+		"10.0.1.1":        false,
+		"192.168.255.255": true,
+		"192.169.0.0":     false,
+		"8.8.4.4":         true,
+		"8.8.4.5":         false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::1":             false,
+	} {
+		assert.Equal(blocked, f.Blocked(net.ParseIP(ip)), ip)
+	}
+	var empty *Filter
+	assert.False(empty.Blocked(net.ParseIP("1.2.3.4")))
+	assert.Equal(0, empty.Len())
+
+	for _, line := range []string{"1.2.3.4-1.2.3", "desc:300.1.1.1", "1.2.3.9-1.2.3.1", "hello"} {
+		_, err := Parse(strings.NewReader(line))
+		assert.NotNil(err, line)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	assert := assert.New(t)
+	a, _ := Parse(strings.NewReader("1.0.0.0-1.0.0.255\n255.255.255.255/32"))
+	b, _ := Parse(strings.NewReader("1.0.1.0-1.0.1.255\nffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"))
+	f := Merge(a, nil, b)
+	// Touching ranges merge, also at the very end of the address space.
+	assert.Equal(3, f.Len())
+	assert.True(f.Blocked(net.ParseIP("1.0.1.7")))
+	assert.True(f.Blocked(net.ParseIP("255.255.255.255")))
+	assert.False(f.Blocked(net.ParseIP("1.0.2.0")))
+}
+
+func TestParseFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list.p2p")
+	ioutil.WriteFile(path, []byte("x:1.1.1.1-1.1.1.2\nbogus\n"), 0644)
+	_, err = ParseFile(path)
+	assert.EqualError(err, path+`: line 2: invalid range "bogus"`)
+	_, err = ParseFile(filepath.Join(dir, "missing"))
+	assert.True(os.IsNotExist(err))
+}
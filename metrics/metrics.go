@@ -0,0 +1,173 @@
+// Package metrics exposes metrics in the Prometheus text exposition format. Values are gathered
+// when they're scraped: a Collector writes the current value of everything it tracks, and
+// Histograms accumulate observations in between.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types, as written in TYPE lines.
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+	// HistogramType is the type of metrics written with Writer.Histogram.
+	HistogramType = "histogram"
+)
+
+// Label is a label name and value of a sample.
+type Label struct {
+	Name, Value string
+}
+
+// Collector writes the current value of the metrics it tracks.
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// Handler returns a handler serving the metrics of c.
+func Handler(c Collector) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := NewWriter(rw)
+		c.Collect(w)
+		w.Flush()
+	})
+}
+
+// Writer writes metrics in the text exposition format. Every sample of a metric must be written
+// right after its Header.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// NewWriter returns a Writer writing to w. Nothing is written until Flush is called.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Header starts a metric of type typ, one of Counter, Gauge or HistogramType.
+func (w *Writer) Header(name, typ, help string) {
+	w.write("# HELP ", name, " ", escapeHelp(help), "\n")
+	w.write("# TYPE ", name, " ", typ, "\n")
+}
+
+// Value writes a sample of a metric.
+func (w *Writer) Value(name string, v float64, labels ...Label) {
+	w.write(name, formatLabels(labels), " ", formatFloat(v), "\n")
+}
+
+// Histogram writes the buckets, sum and count of h as samples of the histogram name.
+func (w *Writer) Histogram(name string, h *Histogram, labels ...Label) {
+	bounds, counts, sum, count := h.snapshot()
+	for i, b := range bounds {
+		le := append(labels[:len(labels):len(labels)], Label{"le", formatFloat(b)})
+		w.write(name, "_bucket", formatLabels(le), " ", strconv.FormatUint(counts[i], 10), "\n")
+	}
+	le := append(labels[:len(labels):len(labels)], Label{"le", "+Inf"})
+	w.write(name, "_bucket", formatLabels(le), " ", strconv.FormatUint(count, 10), "\n")
+	w.write(name, "_sum", formatLabels(labels), " ", formatFloat(sum), "\n")
+	w.write(name, "_count", formatLabels(labels), " ", strconv.FormatUint(count, 10), "\n")
+}
+
+// Flush writes out everything written so far and returns the first error that happened.
+func (w *Writer) Flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+func (w *Writer) write(parts ...string) {
+	for _, p := range parts {
+		if w.err != nil {
+			return
+		}
+		_, w.err = w.w.WriteString(p)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Histogram counts observations in buckets. It's safe for concurrent use.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64 // Upper bounds of the buckets, sorted.
+	counts []uint64  // Observations at or below each bound.
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram returns a histogram with buckets up to each of bounds, and one for everything
+// above them.
+func NewHistogram(bounds ...float64) *Histogram {
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+	return &Histogram{bounds: b, counts: make([]uint64, len(b))}
+}
+
+// Observe adds an observation of v.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// snapshot returns the cumulative bucket counts along with the sum and count of observations.
+func (h *Histogram) snapshot() (bounds []float64, counts []uint64, sum float64, count uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.bounds, append([]uint64(nil), h.counts...), h.sum, h.count
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Header("test_bytes_total", Counter, "Bytes sent\nsomewhere.")
+	w.Value("test_bytes_total", 1234, Label{"name", `a "quoted" \ name`}, Label{"dir", "up"})
+	w.Value("test_bytes_total", 0.5)
+	w.Header("test_ratio", Gauge, "A ratio.")
+	w.Value("test_ratio", math.Inf(1))
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, `# HELP test_bytes_total Bytes sent\nsomewhere.
+# TYPE test_bytes_total counter
+test_bytes_total{name="a \"quoted\" \\ name",dir="up"} 1234
+test_bytes_total 0.5
+# HELP test_ratio A ratio.
+# TYPE test_ratio gauge
+test_ratio +Inf
+`, buf.String())
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(1, 0.1)
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(v)
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Header("test_seconds", HistogramType, "Durations.")
+	w.Histogram("test_seconds", h, Label{"op", "write"})
+	w.Flush()
+	assert.Equal(t, `# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="write",le="0.1"} 2
+test_seconds_bucket{op="write",le="1"} 3
+test_seconds_bucket{op="write",le="+Inf"} 4
+test_seconds_sum{op="write"} 2.65
+test_seconds_count{op="write"} 4
+`, buf.String())
+}
+
+type collectorFunc func(w *Writer)
+
+func (f collectorFunc) Collect(w *Writer) { f(w) }
+
+func TestHandler(t *testing.T) {
+	ts := httptest.NewServer(Handler(collectorFunc(func(w *Writer) {
+		w.Header("test_up", Gauge, "Whether it's up.")
+		w.Value("test_up", 1)
+	})))
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "# HELP test_up Whether it's up.\n# TYPE test_up gauge\ntest_up 1\n", string(body))
+}
@@ -0,0 +1,341 @@
+// Package mse implements Message Stream Encryption, the obfuscated handshake and RC4 stream peers
+// use to hide BitTorrent traffic from middleboxes. Connections are wrapped in a Conn that encrypts
+// and decrypts transparently, so the regular BitTorrent handshake runs on top of it.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// CryptoMethod is a bit set of the encryption methods a peer provides or the one it selects.
+type CryptoMethod uint32
+
+const (
+	// Plaintext sends the stream unencrypted once the handshake is done.
+	Plaintext CryptoMethod = 0x01
+	// RC4 encrypts the whole stream.
+	RC4 CryptoMethod = 0x02
+)
+
+const (
+	keyLength = 96
+	maxPad    = 512
+)
+
+var (
+	// ErrUnknownSKey is returned when an incoming handshake is for a torrent we don't have.
+	ErrUnknownSKey = errors.New("mse: unknown skey")
+	// ErrNoCryptoMethod is returned when the peers have no encryption method in common.
+	ErrNoCryptoMethod = errors.New("mse: no common crypto method")
+	// ErrSync is returned when the peer's handshake couldn't be found in what it sent.
+	ErrSync = errors.New("mse: handshake not found")
+	// ErrMalformed is returned when the peer's handshake is invalid.
+	ErrMalformed = errors.New("mse: malformed handshake")
+)
+
+var (
+	prime = mustParseHex("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22" +
+		"514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63" +
+		"A36210000000000090563")
+	generator = big.NewInt(2)
+	vc        = make([]byte, 8)
+)
+
+func mustParseHex(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("mse: bad constant")
+	}
+	return n
+}
+
+// Conn is a connection that has completed the encryption handshake. If RC4 was selected, everything
+// read and written is encrypted on the wire.
+type Conn struct {
+	net.Conn
+	r       io.Reader
+	pending []byte // Plaintext to hand out before reading from r.
+	dec     *rc4.Cipher
+	method  CryptoMethod
+
+	wmu sync.Mutex
+	enc *rc4.Cipher
+}
+
+// Method returns the encryption method the peers agreed on.
+func (c *Conn) Method() CryptoMethod {
+	return c.method
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	// The caller's buffer must be left alone.
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// Sniff reads the start of an incoming connection and reports whether the peer opened with a plain
+// BitTorrent handshake rather than an encrypted one. The returned connection replays what was
+// read, so it can be passed on to either handshake.
+func Sniff(conn net.Conn) (net.Conn, bool, error) {
+	const pStr = "\x13BitTorrent protocol"
+	prefix := make([]byte, len(pStr))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, false, err
+	}
+	return &Conn{Conn: conn, r: conn, pending: prefix, method: Plaintext}, string(prefix) == pStr, nil
+}
+
+// Initiate runs the handshake with a peer we connected to for the torrent identified by skey,
+// usually the info hash. provide holds the methods we accept, the peer picks one of them.
+func Initiate(conn net.Conn, skey []byte, provide CryptoMethod) (*Conn, error) {
+	r := bufio.NewReader(conn)
+	x, y, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKey(conn, y); err != nil {
+		return nil, err
+	}
+	s, err := readSecret(r, x)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := newCipher("keyA", s, skey)
+	dec := newCipher("keyB", s, skey)
+	req2 := hash([]byte("req2"), skey)
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), s))
+	msg.Write(req2)
+	// VC, crypto_provide, len(PadC), PadC and len(IA), with both pads empty.
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint32(plain[8:12], uint32(provide))
+	enc.XORKeyStream(plain, plain)
+	msg.Write(plain)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// The peer's answer follows its pad, find it by the encrypted VC.
+	mark := make([]byte, len(vc))
+	dec.XORKeyStream(mark, vc)
+	if err := synchronize(r, mark); err != nil {
+		return nil, err
+	}
+	var hdr [6]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(hdr[:], hdr[:])
+	method := CryptoMethod(binary.BigEndian.Uint32(hdr[0:4]))
+	padLen := int(binary.BigEndian.Uint16(hdr[4:6]))
+	if !single(method) || method&provide == 0 {
+		return nil, ErrNoCryptoMethod
+	}
+	if padLen > maxPad {
+		return nil, ErrMalformed
+	}
+	pad := make([]byte, padLen)
+	if _, err := io.ReadFull(r, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+	return newConn(conn, r, nil, method, enc, dec), nil
+}
+
+// Receive runs the handshake with a peer that connected to us. skeys returns the skey whose
+// HASH('req2', skey) matches, or nil if we don't know it. choose picks the method to use from the
+// ones the peer provides, returning 0 if none is acceptable.
+func Receive(conn net.Conn, skeys func(req2 []byte) []byte, choose func(provide CryptoMethod) CryptoMethod) (*Conn, error) {
+	r := bufio.NewReader(conn)
+	x, y, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	s, err := readSecret(r, x)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKey(conn, y); err != nil {
+		return nil, err
+	}
+
+	// The peer's request follows its pad, find it by HASH('req1', S).
+	if err := synchronize(r, hash([]byte("req1"), s)); err != nil {
+		return nil, err
+	}
+	req2 := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, req2); err != nil {
+		return nil, err
+	}
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	skey := skeys(req2)
+	if skey == nil {
+		return nil, ErrUnknownSKey
+	}
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+
+	var hdr [14]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(hdr[:], hdr[:])
+	if !bytes.Equal(hdr[0:8], vc) {
+		return nil, ErrMalformed
+	}
+	provide := CryptoMethod(binary.BigEndian.Uint32(hdr[8:12]))
+	padLen := int(binary.BigEndian.Uint16(hdr[12:14]))
+	if padLen > maxPad {
+		return nil, ErrMalformed
+	}
+	// PadC is followed by the length of the initial payload.
+	pad := make([]byte, padLen+2)
+	if _, err := io.ReadFull(r, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+	ia := make([]byte, binary.BigEndian.Uint16(pad[padLen:]))
+	if _, err := io.ReadFull(r, ia); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	method := choose(provide)
+	if !single(method) || method&provide == 0 {
+		return nil, ErrNoCryptoMethod
+	}
+	// VC, crypto_select and an empty PadD.
+	reply := make([]byte, 14)
+	binary.BigEndian.PutUint32(reply[8:12], uint32(method))
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	return newConn(conn, r, ia, method, enc, dec), nil
+}
+
+// SKeyHash returns HASH('req2', skey), which identifies the torrent in an incoming handshake.
+func SKeyHash(skey []byte) []byte {
+	return hash([]byte("req2"), skey)
+}
+
+func newConn(conn net.Conn, r io.Reader, ia []byte, method CryptoMethod, enc, dec *rc4.Cipher) *Conn {
+	c := &Conn{Conn: conn, r: r, pending: ia, method: method}
+	if method == RC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c
+}
+
+// newKey returns a private key and the public key to send to the peer.
+func newKey() (*big.Int, *big.Int, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(b)
+	return x, new(big.Int).Exp(generator, x, prime), nil
+}
+
+// writeKey sends our public key followed by a random pad.
+func writeKey(w io.Writer, y *big.Int) error {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return err
+	}
+	buf := make([]byte, keyLength+int(binary.BigEndian.Uint16(n[:]))%(maxPad+1))
+	y.FillBytes(buf[:keyLength])
+	if _, err := rand.Read(buf[keyLength:]); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readSecret reads the peer's public key and returns the shared secret.
+func readSecret(r io.Reader, x *big.Int) ([]byte, error) {
+	buf := make([]byte, keyLength)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	y := new(big.Int).SetBytes(buf)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(prime) >= 0 {
+		return nil, ErrMalformed
+	}
+	return new(big.Int).Exp(y, x, prime).FillBytes(buf), nil
+}
+
+// synchronize reads up to and including mark, which has to show up within the peer's pad.
+func synchronize(r *bufio.Reader, mark []byte) error {
+	buf := make([]byte, 0, maxPad+len(mark))
+	for len(buf) < cap(buf) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+		if bytes.HasSuffix(buf, mark) {
+			return nil
+		}
+	}
+	return ErrSync
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newCipher returns the RC4 cipher keyed with HASH(name, S, SKEY), with the first 1024 bytes of
+// the key stream discarded.
+func newCipher(name string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// single returns whether exactly one method is set.
+func single(m CryptoMethod) bool {
+	return m != 0 && m&(m-1) == 0
+}
@@ -0,0 +1,116 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var skey = []byte("abcdefghijklmnopqrst")
+
+func lookup(req2 []byte) []byte {
+	if bytes.Equal(req2, SKeyHash(skey)) {
+		return skey
+	}
+	return nil
+}
+
+func prefer(m CryptoMethod) func(CryptoMethod) CryptoMethod {
+	return func(provide CryptoMethod) CryptoMethod {
+		if provide&m != 0 {
+			return m
+		}
+		return provide & -provide
+	}
+}
+
+// handshake runs both sides of a handshake over a pipe.
+func handshake(provide CryptoMethod, choose func(CryptoMethod) CryptoMethod) (*Conn, *Conn, error, error) {
+	a, b := net.Pipe()
+	done := make(chan struct{})
+	var ib *Conn
+	var errB error
+	go func() {
+		defer close(done)
+		sniffed, plain, err := Sniff(b)
+		if err != nil || plain {
+			errB = io.ErrUnexpectedEOF
+			b.Close()
+			return
+		}
+		ib, errB = Receive(sniffed, lookup, choose)
+		if errB != nil {
+			b.Close()
+		}
+	}()
+	ia, errA := Initiate(a, skey, provide)
+	if errA != nil {
+		a.Close()
+	}
+	<-done
+	return ia, ib, errA, errB
+}
+
+func TestHandshake(t *testing.T) {
+	assert := assert.New(t)
+	for _, method := range []CryptoMethod{RC4, Plaintext} {
+		a, b, errA, errB := handshake(RC4|Plaintext, prefer(method))
+		assert.Nil(errA)
+		assert.Nil(errB)
+		assert.Equal(method, a.Method())
+		assert.Equal(method, b.Method())
+
+		msg := []byte("hello, peer")
+		go a.Write(msg)
+		buf := make([]byte, len(msg))
+		_, err := io.ReadFull(b, buf)
+		assert.Nil(err)
+		assert.Equal([]byte("hello, peer"), buf)
+		// Writing doesn't touch the caller's buffer.
+		assert.Equal([]byte("hello, peer"), msg)
+		go b.Write([]byte("hi"))
+		buf = buf[:2]
+		_, err = io.ReadFull(a, buf)
+		assert.Nil(err)
+		assert.Equal([]byte("hi"), buf)
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestHandshakeNoCommonMethod(t *testing.T) {
+	assert := assert.New(t)
+	_, _, _, errB := handshake(Plaintext, prefer(RC4))
+	assert.Nil(errB)
+	_, _, _, errB = handshake(Plaintext, func(CryptoMethod) CryptoMethod { return 0 })
+	assert.Equal(ErrNoCryptoMethod, errB)
+}
+
+func TestHandshakeUnknownSKey(t *testing.T) {
+	assert := assert.New(t)
+	a, b := net.Pipe()
+	go func() {
+		_, err := Receive(b, func([]byte) []byte { return nil }, prefer(RC4))
+		assert.Equal(ErrUnknownSKey, err)
+		b.Close()
+	}()
+	_, err := Initiate(a, skey, RC4)
+	assert.NotNil(err)
+}
+
+func TestSniff(t *testing.T) {
+	assert := assert.New(t)
+	a, b := net.Pipe()
+	hs := append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...)
+	go a.Write(hs)
+	conn, plain, err := Sniff(b)
+	assert.Nil(err)
+	assert.True(plain)
+	buf := make([]byte, len(hs))
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(err)
+	assert.Equal(hs, buf)
+}
@@ -0,0 +1,284 @@
+// Package progress shows the state of a client's torrents on a terminal. On a terminal each torrent
+// gets a block that's redrawn in place: a progress bar, the transfer rates, the time left, the
+// peers, the tracker's status and a map of the pieces we have. Elsewhere, e.g. when the output is
+// piped to a file, a status line per torrent is printed every so often instead.
+package progress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/saicheems/gotorrent/bitset"
+	"github.com/saicheems/gotorrent/client"
+)
+
+const (
+	// ttyInterval and lineInterval are how often the display is updated on a terminal and
+	// elsewhere.
+	ttyInterval  = time.Second
+	lineInterval = 10 * time.Second
+
+	// defaultWidth is the width of the terminal if $COLUMNS doesn't say.
+	defaultWidth = 80
+)
+
+// mapShades draws the cells of the piece map, from none of a cell's pieces done to all of them.
+var mapShades = []rune(" ░▒▓█")
+
+// IsTerminal returns whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Display writes the state of a client's torrents to w.
+type Display struct {
+	c     *client.Client
+	w     io.Writer
+	tty   bool
+	width int
+	lines int // Lines drawn last time, which are redrawn on a terminal.
+}
+
+// New returns a display of c's torrents writing to w, redrawing in place if tty is set. On a
+// terminal, lines are as wide as $COLUMNS says.
+func New(c *client.Client, w io.Writer, tty bool) *Display {
+	width := defaultWidth
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		width = n
+	}
+	return &Display{c: c, w: w, tty: tty, width: width}
+}
+
+// Run updates the display until ctx is cancelled. Status lines are printed one last time on the
+// way out, a terminal is left as last drawn.
+func (d *Display) Run(ctx context.Context) {
+	interval := lineInterval
+	if d.tty {
+		interval = ttyInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.Draw(time.Now())
+		select {
+		case <-ctx.Done():
+			if !d.tty {
+				d.Draw(time.Now())
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Draw writes the state of the torrents as of now.
+func (d *Display) Draw(now time.Time) {
+	torrents := d.c.Torrents()
+	sort.Slice(torrents, func(i, j int) bool {
+		a, b := torrents[i], torrents[j]
+		if !a.Added().Equal(b.Added()) {
+			return a.Added().Before(b.Added())
+		}
+		return a.InfoHash() < b.InfoHash()
+	})
+	var lines []string
+	for _, t := range torrents {
+		if d.tty {
+			lines = append(lines, d.block(t, now)...)
+		} else {
+			lines = append(lines, statusLine(t, now))
+		}
+	}
+	var b strings.Builder
+	if d.tty {
+		// Go back to the start of the last drawing and clear it.
+		if d.lines > 0 {
+			fmt.Fprintf(&b, "\x1b[%dA", d.lines)
+		}
+		b.WriteString("\r\x1b[J")
+	}
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+	d.lines = len(lines)
+	io.WriteString(d.w, b.String())
+}
+
+// status gathers what's shown for a torrent.
+type status struct {
+	name      string
+	stats     client.Stats
+	state     string
+	progress  float64
+	eta       string
+	available int
+	tracker   string
+}
+
+func newStatus(t *client.Torrent, now time.Time) status {
+	s := status{name: t.Name(), stats: t.Stats()}
+	switch {
+	case t.Err() != nil:
+		s.state = "error: " + t.Err().Error()
+	case !s.stats.Running:
+		s.state = "paused"
+	case s.stats.NumPieces == 0:
+		s.state = "fetching metadata"
+	case s.stats.BytesCompleted == s.stats.Length:
+		s.state = "seeding"
+	default:
+		s.state = "downloading"
+	}
+	if s.stats.Length > 0 {
+		s.progress = float64(s.stats.BytesCompleted) / float64(s.stats.Length)
+	}
+	s.eta = "-"
+	if left := s.stats.Length - s.stats.BytesCompleted; s.stats.NumPieces > 0 && left == 0 {
+		s.eta = "done"
+	} else if s.stats.Running && s.stats.DownloadRate > 0 {
+		s.eta = formatDuration(time.Duration(left/s.stats.DownloadRate) * time.Second)
+	}
+	s.tracker = "no tracker"
+	for _, tr := range t.Trackers() {
+		s.available = tr.Seeders + tr.Leechers
+		if s.available == 0 {
+			s.available = tr.Peers
+		}
+		s.tracker = trackerStatus(tr, now)
+	}
+	return s
+}
+
+// trackerStatus sums up the state of a tracker.
+func trackerStatus(tr client.TrackerInfo, now time.Time) string {
+	var s string
+	switch {
+	case tr.Err != nil:
+		s = "tracker error: " + tr.Err.Error()
+	case tr.LastAnnounce.IsZero():
+		s = "tracker: connecting"
+	default:
+		s = fmt.Sprintf("tracker: ok, %d seeders, %d leechers", tr.Seeders, tr.Leechers)
+	}
+	if !tr.NextAnnounce.IsZero() && tr.NextAnnounce.After(now) {
+		s += ", next in " + formatDuration(tr.NextAnnounce.Sub(now))
+	}
+	return s
+}
+
+// block returns the lines drawn for a torrent on a terminal.
+func (d *Display) block(t *client.Torrent, now time.Time) []string {
+	s := newStatus(t, now)
+	pct := fmt.Sprintf(" %5.1f%%", 100*s.progress)
+	sizes := fmt.Sprintf(" %s / %s", formatBytes(s.stats.BytesCompleted), formatBytes(s.stats.Length))
+	barWidth := d.width - len(pct) - len(sizes) - 2
+	if barWidth < 10 {
+		barWidth = 10
+	}
+	lines := []string{
+		truncate(s.name+" ("+s.state+")", d.width),
+		"[" + bar(s.progress, barWidth) + "]" + pct + sizes,
+		truncate(fmt.Sprintf("down %s/s  up %s/s  eta %s  peers %d/%d",
+			formatBytes(s.stats.DownloadRate), formatBytes(s.stats.UploadRate), s.eta, s.stats.Peers, s.available), d.width),
+		truncate(s.tracker, d.width),
+	}
+	if have := t.BitSet(); have != nil && have.Len() > 0 {
+		lines = append(lines, "|"+pieceMap(have, d.width-2)+"|")
+	}
+	return append(lines, "")
+}
+
+// statusLine returns the line printed for a torrent when the output isn't a terminal.
+func statusLine(t *client.Torrent, now time.Time) string {
+	s := newStatus(t, now)
+	return fmt.Sprintf("%s: %s %.1f%% (%s / %s), down %s/s, up %s/s, eta %s, peers %d/%d, %s",
+		s.name, s.state, 100*s.progress, formatBytes(s.stats.BytesCompleted), formatBytes(s.stats.Length),
+		formatBytes(s.stats.DownloadRate), formatBytes(s.stats.UploadRate), s.eta, s.stats.Peers, s.available, s.tracker)
+}
+
+// bar returns a progress bar width characters wide, done of which is filled.
+func bar(done float64, width int) string {
+	n := int(done * float64(width))
+	if n > width {
+		n = width
+	}
+	return strings.Repeat("=", n) + strings.Repeat("-", width-n)
+}
+
+// pieceMap returns a map of the pieces in have width cells wide. Each cell stands for a run of
+// pieces and is shaded by how many of them we have. There's a cell per piece if there are fewer
+// pieces than cells.
+func pieceMap(have *bitset.BitSet, width int) string {
+	n := have.Len()
+	if width > n {
+		width = n
+	}
+	if width <= 0 {
+		return ""
+	}
+	cells := make([]rune, width)
+	for i := range cells {
+		start, end := i*n/width, (i+1)*n/width
+		count := 0
+		for p := start; p < end; p++ {
+			if have.Check(p) {
+				count++
+			}
+		}
+		shade := count * (len(mapShades) - 1) / (end - start)
+		if shade == 0 && count > 0 {
+			shade = 1
+		}
+		cells[i] = mapShades[shade]
+	}
+	return string(cells)
+}
+
+// truncate shortens s to width characters, marking the cut with an ellipsis.
+func truncate(s string, width int) string {
+	if width < 1 {
+		width = 1
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:width-1]) + "…"
+}
+
+// formatBytes formats n bytes in multiples of 1024, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	unit := 0
+	for v >= 1<<10 && unit < 4 {
+		v /= 1 << 10
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, " KMGT"[unit])
+}
+
+// formatDuration formats d to the second, leaving out units that are zero at the front, e.g.
+// "3m05s" or "2h00m00s".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d/time.Hour), int(d%time.Hour/time.Minute), int(d%time.Minute/time.Second)
+	switch {
+	case h > 0:
+		return fmt.Sprintf("%dh%02dm%02ds", h, m, s)
+	case m > 0:
+		return fmt.Sprintf("%dm%02ds", m, s)
+	}
+	return fmt.Sprintf("%ds", s)
+}
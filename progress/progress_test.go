@@ -0,0 +1,86 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saicheems/gotorrent/bitset"
+	"github.com/saicheems/gotorrent/client"
+	"github.com/saicheems/gotorrent/internal/testclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDraw(t *testing.T) {
+	assert := assert.New(t)
+	c, _ := testclient.Seed(t, "seeded.bin", make([]byte, 100000))
+	defer c.Close()
+
+	var buf bytes.Buffer
+	d := New(c, &buf, false)
+	d.Draw(time.Now())
+	assert.Equal("seeded.bin: seeding 100.0% (97.7 KiB / 97.7 KiB), down 0 B/s, up 0 B/s, eta done, peers 0/0, no tracker\n", buf.String())
+
+	buf.Reset()
+	d = New(c, &buf, true)
+	d.width = 50
+	d.Draw(time.Now())
+	want := []string{
+		"seeded.bin (seeding)",
+		"[" + strings.Repeat("=", 21) + "] 100.0% 97.7 KiB / 97.7 KiB",
+		"down 0 B/s  up 0 B/s  eta done  peers 0/0",
+		"no tracker",
+		"|" + strings.Repeat("█", 7) + "|",
+		"",
+	}
+	assert.Equal("\r\x1b[J"+strings.Join(want, "\n")+"\n", buf.String())
+
+	// The next drawing replaces this one.
+	buf.Reset()
+	c.Torrents()[0].Pause()
+	d.Draw(time.Now())
+	assert.True(strings.HasPrefix(buf.String(), "\x1b[6A\r\x1b[Jseeded.bin (paused)\n"), buf.String())
+}
+
+func TestTrackerStatus(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	assert.Equal("tracker: connecting", trackerStatus(client.TrackerInfo{}, now))
+	assert.Equal("tracker: ok, 3 seeders, 4 leechers, next in 30m00s", trackerStatus(client.TrackerInfo{
+		LastAnnounce: now.Add(-time.Minute),
+		NextAnnounce: now.Add(30 * time.Minute),
+		Seeders:      3,
+		Leechers:     4,
+	}, now))
+	assert.Equal("tracker error: refused", trackerStatus(client.TrackerInfo{Err: errString("refused")}, now))
+}
+
+type errString string
+
+func (e errString) Error() string { return string(e) }
+
+func TestPieceMap(t *testing.T) {
+	assert := assert.New(t)
+	have := bitset.New(8)
+	for _, i := range []int{0, 1, 2, 3, 4, 6} {
+		have.Set(i)
+	}
+	assert.Equal("█████ █ ", pieceMap(have, 8))
+	assert.Equal("█████ █ ", pieceMap(have, 20))
+	assert.Equal("██▒▒", pieceMap(have, 4))
+	assert.Equal("██░", pieceMap(have, 3))
+	assert.Equal("", pieceMap(have, 0))
+}
+
+func TestFormat(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("512 B", formatBytes(512))
+	assert.Equal("1.5 KiB", formatBytes(1536))
+	assert.Equal("2.0 GiB", formatBytes(2<<30))
+	assert.Equal("7s", formatDuration(7*time.Second))
+	assert.Equal("3m05s", formatDuration(185*time.Second))
+	assert.Equal("2h00m00s", formatDuration(2*time.Hour))
+	assert.Equal("abcd…", truncate("abcdefgh", 5))
+	assert.Equal("abc", truncate("abc", 5))
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// HTTP dials TCP connections through an HTTP proxy with the CONNECT method.
+type HTTP struct {
+	// Addr is the host:port of the proxy.
+	Addr string
+	// Username and Password are sent with basic authentication when Username isn't empty.
+	Username string
+	Password string
+	// Forward dials the proxy, Direct if it's nil.
+	Forward Dialer
+}
+
+// DialContext connects to addr through the proxy. network must be "tcp", "tcp4" or "tcp6".
+func (p *HTTP) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("proxy: network %q not supported by HTTP proxies", network)
+	}
+	conn, err := dialProxy(ctx, p.Forward, p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var br *bufio.Reader
+	err = handshake(ctx, conn, func() error {
+		req, err := http.NewRequest("CONNECT", "//"+addr, nil)
+		if err != nil {
+			return err
+		}
+		req.Host = addr
+		if p.Username != "" {
+			req.Header.Set("Proxy-Authorization", basicAuth(p.Username, p.Password))
+		}
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+		br = bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("proxy: CONNECT %s: %s", addr, resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if br.Buffered() > 0 {
+		// The target spoke first and its bytes arrived with the proxy's response.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what was buffered while reading the proxy's response before reading from
+// the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
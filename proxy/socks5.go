@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929.
+const (
+	socksVersion = 5
+	authNone     = 0
+	authPassword = 2
+	cmdConnect   = 1
+	cmdAssociate = 3
+	atypIPv4     = 1
+	atypDomain   = 3
+	atypIPv6     = 4
+)
+
+var (
+	// ErrAuthRejected is returned when a SOCKS5 proxy refuses our credentials or has no
+	// authentication method we support.
+	ErrAuthRejected = errors.New("proxy: authentication rejected")
+	errBadReply     = errors.New("proxy: malformed SOCKS5 reply")
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// SOCKS5 dials TCP connections and relays UDP datagrams through a SOCKS5 proxy.
+type SOCKS5 struct {
+	// Addr is the host:port of the proxy.
+	Addr string
+	// Username and Password are offered with username/password authentication when Username
+	// isn't empty.
+	Username string
+	Password string
+	// Forward dials the proxy, Direct if it's nil.
+	Forward Dialer
+}
+
+// DialContext connects to addr through the proxy. network must be "tcp", "tcp4" or "tcp6".
+// Hostnames are resolved by the proxy.
+func (p *SOCKS5) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("proxy: network %q not supported by SOCKS5 dialer", network)
+	}
+	conn, err := dialProxy(ctx, p.Forward, p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	err = handshake(ctx, conn, func() error {
+		if err := p.auth(conn); err != nil {
+			return err
+		}
+		_, err := p.request(conn, cmdConnect, addr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenPacket asks the proxy to relay UDP datagrams for us. The association lasts as long as
+// the returned connection.
+func (p *SOCKS5) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	ctrl, err := dialProxy(ctx, p.Forward, p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var relay *net.UDPAddr
+	err = handshake(ctx, ctrl, func() error {
+		if err := p.auth(ctrl); err != nil {
+			return err
+		}
+		// We don't know the address our datagrams will come from, so we send zeros.
+		bound, err := p.request(ctrl, cmdAssociate, "0.0.0.0:0")
+		if err != nil {
+			return err
+		}
+		if relay, err = net.ResolveUDPAddr("udp", bound); err != nil {
+			return err
+		}
+		// Proxies answer with the unspecified address when the relay is on the proxy's own.
+		if relay.IP.IsUnspecified() {
+			host, _, _ := net.SplitHostPort(ctrl.RemoteAddr().String())
+			relay.IP = net.ParseIP(host)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	c := &packetConn{udp: udp, ctrl: ctrl}
+	go c.watch()
+	return c, nil
+}
+
+// auth negotiates an authentication method and authenticates with it.
+func (p *SOCKS5) auth(conn net.Conn) error {
+	methods := []byte{authNone}
+	if p.Username != "" {
+		methods = append(methods, authPassword)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[0] != socksVersion {
+		return errBadReply
+	}
+	switch b[1] {
+	case authNone:
+		return nil
+	case authPassword:
+		if p.Username == "" {
+			return ErrAuthRejected
+		}
+	default:
+		return ErrAuthRejected
+	}
+	if len(p.Username) > 255 || len(p.Password) > 255 {
+		return errors.New("proxy: username or password too long")
+	}
+	req := []byte{1, byte(len(p.Username))}
+	req = append(req, p.Username...)
+	req = append(req, byte(len(p.Password)))
+	req = append(req, p.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		return ErrAuthRejected
+	}
+	return nil
+}
+
+// request sends a command for addr and returns the address the proxy bound for it.
+func (p *SOCKS5) request(conn net.Conn, cmd byte, addr string) (string, error) {
+	req, err := appendAddr([]byte{socksVersion, cmd, 0}, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	var b [3]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return "", err
+	}
+	if b[0] != socksVersion {
+		return "", errBadReply
+	}
+	if b[1] != 0 {
+		msg, ok := socksReplies[b[1]]
+		if !ok {
+			msg = "error " + strconv.Itoa(int(b[1]))
+		}
+		return "", fmt.Errorf("proxy: %s: %s", addr, msg)
+	}
+	return readAddr(conn)
+}
+
+// appendAddr appends the SOCKS5 encoding of the host:port addr to b.
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid port in %q", addr)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("proxy: host name too long: %q", host)
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, atypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, atypIPv6)
+		b = append(b, ip...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// readAddr reads a SOCKS5 encoded address from r and returns it as host:port.
+func readAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case atypIPv4:
+		host = make([]byte, net.IPv4len)
+	case atypIPv6:
+		host = make([]byte, net.IPv6len)
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		host = make([]byte, n[0])
+	default:
+		return "", errBadReply
+	}
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	h := string(host)
+	if atyp[0] != atypDomain {
+		h = net.IP(host).String()
+	}
+	return net.JoinHostPort(h, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// packetConn sends and receives datagrams through a SOCKS5 UDP relay. Each datagram is prefixed
+// with a header holding the address it's to or from.
+type packetConn struct {
+	udp  *net.UDPConn // Connected to the relay.
+	ctrl net.Conn     // The association ends when it's closed.
+}
+
+// watch closes the connection when the proxy ends the association.
+func (c *packetConn) watch() {
+	io.Copy(ioutil.Discard, c.ctrl)
+	c.udp.Close()
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err := c.udp.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Fragmented datagrams are dropped, as RFC 1928 allows.
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		addr, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		from, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), from, nil
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	buf, err := appendAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.udp.Write(append(buf, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	c.ctrl.Close()
+	return c.udp.Close()
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.udp.SetDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	return c.udp.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return c.udp.SetWriteDeadline(t)
+}
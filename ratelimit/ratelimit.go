@@ -0,0 +1,128 @@
+// Package ratelimit implements token bucket rate limiters for byte streams.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter lets bytes through at a steady rate. Up to a second's worth of bytes may pass at once
+// after a quiet period. Its rate can be changed at any time, also while others are waiting on it.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    int64   // Bytes per second, unlimited if 0.
+	tokens  float64 // Bytes that may pass right now, negative if borrowed from the future.
+	last    time.Time
+	changed chan struct{} // Closed when the rate changes.
+}
+
+// NewLimiter returns a limiter letting rate bytes per second through. A rate of 0 or less means no
+// limit.
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{changed: make(chan struct{})}
+	l.SetRate(rate)
+	return l
+}
+
+// Rate returns the rate in bytes per second, 0 if there's no limit.
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate changes the rate to rate bytes per second. A rate of 0 or less removes the limit.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	if rate == l.rate {
+		return
+	}
+	l.advance(time.Now())
+	if l.rate == 0 {
+		// A fresh limit starts with a full bucket.
+		l.tokens = float64(rate)
+	}
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// advance adds the tokens that came in since the last call.
+func (l *Limiter) advance(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// WaitN takes n bytes from the limiter, blocking until the rate allows them through or ctx is
+// cancelled. Bytes beyond what's available are borrowed from the future, so n may be larger than
+// a second's worth.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.advance(time.Now())
+	l.tokens -= float64(n)
+	wait, changed := l.wait()
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-changed:
+		}
+		// The rate changed while waiting, so the wait is worked out again.
+		l.mu.Lock()
+		l.advance(time.Now())
+		wait, changed = l.wait()
+		l.mu.Unlock()
+		if wait <= 0 {
+			return nil
+		}
+		resetTimer(timer, wait)
+	}
+}
+
+// wait returns how long until the borrowed tokens are paid back, and the channel signalling a
+// change of rate. l.mu must be held.
+func (l *Limiter) wait() (time.Duration, <-chan struct{}) {
+	if l.rate == 0 || l.tokens >= 0 {
+		return 0, l.changed
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second)), l.changed
+}
+
+// resetTimer stops t, drains it if it already fired and rearms it to fire after d.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnlimited(t *testing.T) {
+	assert := assert.New(t)
+	l := NewLimiter(0)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		assert.Nil(l.WaitN(context.Background(), 1<<20))
+	}
+	assert.True(time.Since(start) < 100*time.Millisecond)
+	assert.Equal(int64(0), l.Rate())
+}
+
+func TestWaitN(t *testing.T) {
+	assert := assert.New(t)
+	l := NewLimiter(10000)
+	start := time.Now()
+	// The first second's worth passes right away.
+	assert.Nil(l.WaitN(context.Background(), 10000))
+	assert.True(time.Since(start) < 100*time.Millisecond)
+	// Anything more is held back.
+	assert.Nil(l.WaitN(context.Background(), 3000))
+	elapsed := time.Since(start)
+	assert.True(elapsed > 250*time.Millisecond && elapsed < time.Second, "took %v", elapsed)
+}
+
+func TestWaitNCancel(t *testing.T) {
+	l := NewLimiter(1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l.WaitN(ctx, 10000))
+}
+
+func TestSetRate(t *testing.T) {
+	assert := assert.New(t)
+	l := NewLimiter(1000)
+	done := make(chan error)
+	go func() {
+		// Ten seconds at the old rate.
+		done <- l.WaitN(context.Background(), 11000)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.SetRate(0)
+	select {
+	case err := <-done:
+		assert.Nil(err)
+	case <-time.After(time.Second):
+		t.Fatal("waiter not released when the limit was removed")
+	}
+	assert.Equal(int64(0), l.Rate())
+	l.SetRate(-5)
+	assert.Equal(int64(0), l.Rate())
+}
@@ -0,0 +1,151 @@
+// Package stream serves the files of a client's torrents over HTTP while they download. Players can
+// seek around in a file with Range requests, and the pieces they read are downloaded first.
+//
+// The index lists every torrent, /<info hash>/ lists the files of a torrent and
+// /<info hash>/<index>/<name> serves a file.
+package stream
+
+import (
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saicheems/gotorrent/client"
+)
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<title>gotorrent</title>
+<h1>Torrents</h1>
+<ul>
+{{range .}}<li><a href="/{{.Hash}}/">{{.Name}}</a> {{.Progress}}</li>
+{{end}}</ul>
+`))
+
+var torrentTemplate = template.Must(template.New("torrent").Parse(`<!DOCTYPE html>
+<title>{{.Name}}</title>
+<h1>{{.Name}}</h1>
+{{if .Files}}<ul>
+{{range .Files}}<li><a href="{{.URL}}">{{.Path}}</a> {{.Length}} bytes</li>
+{{end}}</ul>
+{{else}}<p>Fetching metadata...</p>
+{{end}}`))
+
+type torrentEntry struct {
+	Hash     string
+	Name     string
+	Progress string
+}
+
+type fileEntry struct {
+	URL    string
+	Path   string
+	Length int64
+}
+
+// Handler serves the torrents of a client.
+type Handler struct {
+	c *client.Client
+}
+
+// NewHandler returns a handler serving the torrents of c.
+func NewHandler(c *client.Client) *Handler {
+	return &Handler{c: c}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		h.serveIndex(w)
+		return
+	}
+	parts := strings.SplitN(path, "/", 3)
+	infoHash, err := hex.DecodeString(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	t, ok := h.c.Torrent(string(infoHash))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		h.serveTorrent(w, t)
+		return
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.serveFile(w, r, t, index)
+}
+
+// serveIndex lists every torrent.
+func (h *Handler) serveIndex(w http.ResponseWriter) {
+	var entries []torrentEntry
+	for _, t := range h.c.Torrents() {
+		e := torrentEntry{Hash: hex.EncodeToString([]byte(t.InfoHash())), Name: t.Name()}
+		if s := t.Stats(); s.NumPieces > 0 {
+			e.Progress = strconv.Itoa(100*s.PiecesComplete/s.NumPieces) + "%"
+		}
+		entries = append(entries, e)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTemplate.Execute(w, entries)
+}
+
+// serveTorrent lists the files of a torrent.
+func (h *Handler) serveTorrent(w http.ResponseWriter, t *client.Torrent) {
+	hash := hex.EncodeToString([]byte(t.InfoHash()))
+	var files []fileEntry
+	for i, f := range t.Files() {
+		files = append(files, fileEntry{
+			URL:    "/" + hash + "/" + strconv.Itoa(i) + "/" + url.PathEscape(f.Path[len(f.Path)-1]),
+			Path:   strings.Join(f.Path, "/"),
+			Length: f.Length,
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	torrentTemplate.Execute(w, struct {
+		Name  string
+		Files []fileEntry
+	}{t.Name(), files})
+}
+
+// serveFile serves a file of a torrent as it downloads. Reads block until the pieces they need
+// are in, so the response trickles out at the speed of the download.
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, t *client.Torrent, index int) {
+	ctx := r.Context()
+	select {
+	case <-t.GotInfo():
+	case <-ctx.Done():
+		return
+	}
+	files := t.Files()
+	if index < 0 || index >= len(files) {
+		http.NotFound(w, r)
+		return
+	}
+	rd, err := t.NewReader(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rd.Close()
+	// A client going away aborts a read that's waiting for pieces.
+	go func() {
+		<-ctx.Done()
+		rd.Close()
+	}()
+	path := files[index].Path
+	http.ServeContent(w, r, path[len(path)-1], time.Time{}, rd)
+}
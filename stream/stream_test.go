@@ -0,0 +1,60 @@
+package stream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/saicheems/gotorrent/internal/testclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, url string, header map[string]string) (*http.Response, []byte) {
+	req, _ := http.NewRequest("GET", url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, body
+}
+
+func TestHandler(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 100000)
+	rand.Read(data)
+	c, tor := testclient.Seed(t, "movie.mp4", data)
+	defer c.Close()
+	hash := hex.EncodeToString([]byte(tor.InfoHash()))
+	ts := httptest.NewServer(NewHandler(c))
+	defer ts.Close()
+
+	resp, body := get(t, ts.URL+"/", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(strings.Contains(string(body), `<a href="/`+hash+`/">movie.mp4</a> 100%`), string(body))
+	resp, body = get(t, ts.URL+"/"+hash+"/", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(strings.Contains(string(body), `<a href="/`+hash+`/0/movie.mp4">movie.mp4</a> 100000 bytes`), string(body))
+
+	resp, body = get(t, ts.URL+"/"+hash+"/0/movie.mp4", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("video/mp4", resp.Header.Get("Content-Type"))
+	assert.Equal(data, body)
+	resp, body = get(t, ts.URL+"/"+hash+"/0/movie.mp4", map[string]string{"Range": "bytes=20000-50000"})
+	assert.Equal(http.StatusPartialContent, resp.StatusCode)
+	assert.Equal("bytes 20000-50000/100000", resp.Header.Get("Content-Range"))
+	assert.Equal(data[20000:50001], body)
+
+	for _, path := range []string{"/nothex/", "/" + strings.Repeat("00", 20) + "/", "/" + hash + "/1/x", "/" + hash + "/x/y"} {
+		resp, _ = get(t, ts.URL+path, nil)
+		assert.Equal(http.StatusNotFound, resp.StatusCode, path)
+	}
+}
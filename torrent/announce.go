@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -26,10 +27,29 @@ type AnnounceResponse struct {
 // Announce sends an announce signal to a url and returns an AnnounceResponse. If there's a failure
 // then the appropriate error is returned.
 func Announce(url string) (*AnnounceResponse, error) {
-	res, err := http.Get(url)
+	return AnnounceContext(context.Background(), url)
+}
+
+// AnnounceContext is like Announce but gives up once ctx is done.
+func AnnounceContext(ctx context.Context, url string) (*AnnounceResponse, error) {
+	return AnnounceClient(ctx, http.DefaultClient, url)
+}
+
+// AnnounceClient is like AnnounceContext but sends the request with client, e.g. to go through a
+// proxy.
+func AnnounceClient(ctx context.Context, client *http.Client, url string) (*AnnounceResponse, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if l := debugLogger(); l != nil {
+		l.Debug("announcing", "url", url)
+	}
+	res, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(res.Body)
 	annRes := new(AnnounceResponse)
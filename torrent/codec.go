@@ -0,0 +1,289 @@
+package torrent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Message IDs.
+const (
+	chokeID         = 0
+	unchokeID       = 1
+	interestedID    = 2
+	notInterestedID = 3
+	haveID          = 4
+	bitfieldID      = 5
+	requestID       = 6
+	pieceID         = 7
+	cancelID        = 8
+	suggestPieceID  = 0x0d
+	haveAllID       = 0x0e
+	haveNoneID      = 0x0f
+	rejectRequestID = 0x10
+	allowedFastID   = 0x11
+	extendedID      = 20
+)
+
+const (
+	// DefaultMaxMessageLength is the maximum message length used when the torrent isn't known,
+	// enough for 16 KiB blocks and metadata pieces.
+	DefaultMaxMessageLength = 1 << 15
+	// extendedOverhead leaves room for the bencoded header of extension messages.
+	extendedOverhead = 1 << 10
+)
+
+// MessageTooLongError is returned when a message's length prefix exceeds the maximum we accept.
+// The message isn't read, so the stream can't be used afterwards.
+type MessageTooLongError struct {
+	Length uint32
+	Max    uint32
+}
+
+func (e *MessageTooLongError) Error() string {
+	return fmt.Sprintf("message length %d exceeds maximum %d", e.Length, e.Max)
+}
+
+// MalformedMessageError is returned when a message's length isn't valid for its ID. The message
+// has been consumed, so the stream is still in sync.
+type MalformedMessageError struct {
+	ID     uint8
+	Length uint32
+}
+
+func (e *MalformedMessageError) Error() string {
+	return fmt.Sprintf("malformed message: id %d with length %d", e.ID, e.Length)
+}
+
+// UnknownMessageError is returned for message IDs we don't understand. Peers are expected to
+// ignore these, and the message has been consumed so the stream is still in sync.
+type UnknownMessageError struct {
+	ID     uint8
+	Length uint32
+}
+
+func (e *UnknownMessageError) Error() string {
+	return fmt.Sprintf("unknown message id %d", e.ID)
+}
+
+// MaxMessageLength returns the largest message a peer may send for a torrent with numPieces pieces
+// when blocks of at most blockSize bytes are requested: either a full bitfield, a block or a
+// metadata piece.
+func MaxMessageLength(numPieces int, blockSize int) uint32 {
+	max := uint32(2 + MetadataPieceSize + extendedOverhead)
+	if n := uint32(1 + (numPieces+7)/8); n > max {
+		max = n
+	}
+	if n := uint32(9 + blockSize); n > max {
+		max = n
+	}
+	return max
+}
+
+// MessageReader reads length prefixed messages from a buffered stream.
+type MessageReader struct {
+	r      *bufio.Reader
+	header [5]byte
+	// MaxLength is the largest message length accepted, including the ID byte.
+	MaxLength uint32
+}
+
+// NewMessageReader returns a MessageReader reading from r that rejects messages longer than
+// maxLength.
+func NewMessageReader(r io.Reader, maxLength uint32) *MessageReader {
+	return &MessageReader{r: bufio.NewReader(r), MaxLength: maxLength}
+}
+
+// ReadMessage reads the next message off the stream. Errors from the underlying reader are
+// returned as is, malformed messages as one of the message error types.
+func (mr *MessageReader) ReadMessage() (Message, error) {
+	return readMessage(mr.r, mr.header[:], mr.MaxLength)
+}
+
+// ReadMessage reads a single message from r without buffering, rejecting messages longer than
+// DefaultMaxMessageLength.
+func ReadMessage(r io.Reader) (Message, error) {
+	return readMessage(r, make([]byte, 5), DefaultMaxMessageLength)
+}
+
+func readMessage(r io.Reader, header []byte, max uint32) (Message, error) {
+	m, err := decodeMessage(r, header, max)
+	if l := debugLogger(); l != nil {
+		if err != nil {
+			l.Debug("read message failed", "err", err)
+		} else {
+			l.Debug("read message", "type", fmt.Sprintf("%T", m))
+		}
+	}
+	return m, err
+}
+
+func decodeMessage(r io.Reader, header []byte, max uint32) (Message, error) {
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length == 0 {
+		return KeepAlive{}, nil
+	}
+	if length > max {
+		return nil, &MessageTooLongError{Length: length, Max: max}
+	}
+	if _, err := io.ReadFull(r, header[4:5]); err != nil {
+		return nil, noEOF(err)
+	}
+	id := header[4]
+	size := length - 1
+	if !validLength(id, size) {
+		// Skip the payload so the next message can still be read.
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return nil, noEOF(err)
+		}
+		if _, ok := payloadLengths[id]; !ok {
+			return nil, &UnknownMessageError{ID: id, Length: length}
+		}
+		return nil, &MalformedMessageError{ID: id, Length: length}
+	}
+	// The payload is handed to the caller, so it gets its own buffer.
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, noEOF(err)
+	}
+	return parsePayload(id, payload), nil
+}
+
+// noEOF turns EOF in the middle of a message into ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// payloadLengths gives the minimum payload length for every message ID we know, and whether the
+// payload must be exactly that long.
+var payloadLengths = map[uint8]struct {
+	min   uint32
+	exact bool
+}{
+	chokeID:         {0, true},
+	unchokeID:       {0, true},
+	interestedID:    {0, true},
+	notInterestedID: {0, true},
+	haveID:          {4, true},
+	bitfieldID:      {0, false},
+	requestID:       {12, true},
+	pieceID:         {8, false},
+	cancelID:        {12, true},
+	suggestPieceID:  {4, true},
+	haveAllID:       {0, true},
+	haveNoneID:      {0, true},
+	rejectRequestID: {12, true},
+	allowedFastID:   {4, true},
+	extendedID:      {1, false},
+}
+
+// validLength returns whether a payload of size bytes is valid for message id.
+func validLength(id uint8, size uint32) bool {
+	l, ok := payloadLengths[id]
+	if !ok {
+		return false
+	}
+	if l.exact {
+		return size == l.min
+	}
+	return size >= l.min
+}
+
+// parsePayload builds the message for a payload whose length has been validated.
+func parsePayload(id uint8, payload []byte) Message {
+	switch id {
+	case chokeID:
+		return Choke{}
+	case unchokeID:
+		return Unchoke{}
+	case interestedID:
+		return Interested{}
+	case notInterestedID:
+		return NotInterested{}
+	case haveID:
+		return Have{PieceIndex: binary.BigEndian.Uint32(payload[0:4])}
+	case bitfieldID:
+		return Bitfield{Data: payload}
+	case requestID, cancelID, rejectRequestID:
+		index := binary.BigEndian.Uint32(payload[0:4])
+		begin := binary.BigEndian.Uint32(payload[4:8])
+		length := binary.BigEndian.Uint32(payload[8:12])
+		switch id {
+		case requestID:
+			return Request{Index: index, Begin: begin, Length: length}
+		case cancelID:
+			return Cancel{Index: index, Begin: begin, Length: length}
+		}
+		return RejectRequest{Index: index, Begin: begin, Length: length}
+	case pieceID:
+		index := binary.BigEndian.Uint32(payload[0:4])
+		begin := binary.BigEndian.Uint32(payload[4:8])
+		return Piece{Index: index, Begin: begin, Block: payload[8:]}
+	case suggestPieceID:
+		return SuggestPiece{Index: binary.BigEndian.Uint32(payload[0:4])}
+	case haveAllID:
+		return HaveAll{}
+	case haveNoneID:
+		return HaveNone{}
+	case allowedFastID:
+		return AllowedFast{Index: binary.BigEndian.Uint32(payload[0:4])}
+	case extendedID:
+		return Extended{ID: payload[0], Payload: payload[1:]}
+	}
+	return nil
+}
+
+// ParseMessage returns a struct that implements Message containing all relevant information for a
+// peer message, including its length prefix. It returns an error if the data isn't exactly one
+// well formed message.
+func ParseMessage(data []byte) (Message, error) {
+	if len(data) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	if uint64(length) != uint64(len(data)-4) {
+		return nil, &MalformedMessageError{Length: length}
+	}
+	if length == 0 {
+		return KeepAlive{}, nil
+	}
+	id := data[4]
+	if !validLength(id, length-1) {
+		if _, ok := payloadLengths[id]; !ok {
+			return nil, &UnknownMessageError{ID: id, Length: length}
+		}
+		return nil, &MalformedMessageError{ID: id, Length: length}
+	}
+	return parsePayload(id, data[5:]), nil
+}
+
+// MessageWriter writes messages to a buffered stream. Messages aren't sent until Flush is called.
+type MessageWriter struct {
+	w *bufio.Writer
+}
+
+// NewMessageWriter returns a MessageWriter writing to w.
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	return &MessageWriter{w: bufio.NewWriter(w)}
+}
+
+// WriteMessage buffers a message for writing.
+func (mw *MessageWriter) WriteMessage(m Message) error {
+	if l := debugLogger(); l != nil {
+		l.Debug("sending message", "type", fmt.Sprintf("%T", m))
+	}
+	_, err := mw.w.Write(m.Format())
+	return err
+}
+
+// Flush writes any buffered messages to the underlying writer.
+func (mw *MessageWriter) Flush() error {
+	return mw.w.Flush()
+}
@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageReader(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	buf.Write(KeepAlive{}.Format())
+	buf.Write(Have{PieceIndex: 7}.Format())
+	// Unknown ID, skipped without losing the stream.
+	buf.Write([]byte{0, 0, 0, 13, 99, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	// Request with a short payload.
+	buf.Write([]byte{0, 0, 0, 5, 6, 0, 0, 0, 1})
+	// Bitfields of large torrents don't fit the default limit.
+	bitfield := Bitfield{Data: make([]byte, 1<<16)}
+	buf.Write(bitfield.Format())
+	buf.Write(Piece{Index: 1, Begin: 2, Block: []byte{3, 4, 5}}.Format())
+	buf.Write([]byte{0, 0, 0, 9, 7, 0})
+
+	mr := NewMessageReader(&buf, MaxMessageLength(1<<19, 1<<14))
+	m, err := mr.ReadMessage()
+	assert.NoError(err)
+	assert.Equal(KeepAlive{}, m)
+	m, err = mr.ReadMessage()
+	assert.NoError(err)
+	assert.Equal(Have{PieceIndex: 7}, m)
+	_, err = mr.ReadMessage()
+	assert.Equal(&UnknownMessageError{ID: 99, Length: 13}, err)
+	_, err = mr.ReadMessage()
+	assert.Equal(&MalformedMessageError{ID: 6, Length: 5}, err)
+	m, err = mr.ReadMessage()
+	assert.NoError(err)
+	assert.Equal(bitfield, m)
+	m, err = mr.ReadMessage()
+	assert.NoError(err)
+	assert.Equal(Piece{Index: 1, Begin: 2, Block: []byte{3, 4, 5}}, m)
+	_, err = mr.ReadMessage()
+	assert.Equal(io.ErrUnexpectedEOF, err)
+	_, err = mr.ReadMessage()
+	assert.Equal(io.EOF, err)
+}
+
+func TestMessageReaderTooLong(t *testing.T) {
+	assert := assert.New(t)
+	mr := NewMessageReader(bytes.NewReader([]byte{0, 1, 0, 1, 5}), 1<<15)
+	_, err := mr.ReadMessage()
+	assert.Equal(&MessageTooLongError{Length: 1<<16 + 1, Max: 1 << 15}, err)
+}
+
+func TestParseMessageMalformed(t *testing.T) {
+	assert := assert.New(t)
+	inputs := [][]byte{
+		{},
+		{0, 0, 0},
+		{0, 0, 0, 1},
+		{0, 0, 0, 13, 99},
+		{0, 0, 0, 13, 99, 0, 0, 0, 1},
+		{0, 0, 0, 1, 4},
+		{0, 0, 0, 2, 0, 1},
+		{0, 0, 0, 1, 7},
+		{0, 0, 0, 1, 20},
+		{0xff, 0xff, 0xff, 0xff, 5},
+	}
+	for _, in := range inputs {
+		m, err := ParseMessage(in)
+		assert.Nil(m, "%v", in)
+		assert.Error(err, "%v", in)
+	}
+	_, err := ParseMessage([]byte{0, 0, 0, 1, 99})
+	assert.Equal(&UnknownMessageError{ID: 99, Length: 1}, err)
+}
+
+func TestMessageWriter(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	mw := NewMessageWriter(&buf)
+	assert.NoError(mw.WriteMessage(Interested{}))
+	assert.NoError(mw.WriteMessage(Request{Index: 1, Begin: 2, Length: 3}))
+	assert.Equal(0, buf.Len())
+	assert.NoError(mw.Flush())
+	assert.Equal([]byte{0, 0, 0, 1, 2, 0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}, buf.Bytes())
+}
+
+func TestMaxMessageLength(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(uint32(2+MetadataPieceSize+extendedOverhead), MaxMessageLength(100, 1<<14))
+	assert.Equal(uint32(9+1<<17), MaxMessageLength(100, 1<<17))
+	assert.Equal(uint32(1+1<<17), MaxMessageLength(1<<20, 1<<14))
+}
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+	var buf, out bytes.Buffer
+	mw := NewMessageWriter(&buf)
+	SetLogger(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer SetLogger(nil)
+	mw.WriteMessage(Have{PieceIndex: 1})
+	mw.Flush()
+	ReadMessage(&buf)
+	assert.True(strings.Contains(out.String(), "msg=\"sending message\" type=torrent.Have"), out.String())
+	assert.True(strings.Contains(out.String(), "msg=\"read message\" type=torrent.Have"), out.String())
+
+	// Nothing is logged above debug level.
+	out.Reset()
+	SetLogger(slog.New(slog.NewTextHandler(&out, nil)))
+	mw.WriteMessage(Have{PieceIndex: 1})
+	mw.Flush()
+	ReadMessage(&buf)
+	assert.Equal("", out.String())
+}
@@ -0,0 +1,177 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	// ExtendedHandshakeID is the extended message ID reserved for the extension handshake.
+	ExtendedHandshakeID = 0
+	// MetadataPieceSize is the size of every ut_metadata piece but the last.
+	MetadataPieceSize = 1 << 14
+
+	// ut_metadata message types.
+	MetadataRequest = 0
+	MetadataData    = 1
+	MetadataReject  = 2
+)
+
+// MalformedExtensionError is returned when an extension protocol payload couldn't be parsed.
+var MalformedExtensionError = errors.New("malformed extension message")
+
+// Extended implements an extension protocol message (BEP 10). ID is the extended message ID the
+// receiver assigned to the extension in its handshake, or ExtendedHandshakeID for the handshake.
+type Extended struct {
+	ID      uint8
+	Payload []byte
+}
+
+func (m Extended) Format() []byte {
+	buf := uint32ToByteSlice(uint32(2 + len(m.Payload)))
+	buf = append(buf, 20, m.ID)
+	return append(buf, m.Payload...)
+}
+
+// ExtendedHandshake contains the fields of an extension handshake that we care about. M maps
+// extension names to the IDs the sender wants to receive them with.
+type ExtendedHandshake struct {
+	M            map[string]int
+	V            string
+	MetadataSize int
+}
+
+// Message returns the handshake as an Extended message ready to be sent.
+func (h ExtendedHandshake) Message() Extended {
+	m := make(map[string]interface{})
+	for name, id := range h.M {
+		m[name] = id
+	}
+	d := map[string]interface{}{"m": m}
+	if h.V != "" {
+		d["v"] = h.V
+	}
+	if h.MetadataSize > 0 {
+		d["metadata_size"] = h.MetadataSize
+	}
+	var buf bytes.Buffer
+	bencode.Marshal(&buf, d)
+	return Extended{ID: ExtendedHandshakeID, Payload: buf.Bytes()}
+}
+
+// ParseExtendedHandshake parses the payload of an extension handshake. Unknown keys are ignored.
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	obj, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, MalformedExtensionError
+	}
+	d, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, MalformedExtensionError
+	}
+	h := &ExtendedHandshake{M: make(map[string]int)}
+	if m, ok := d["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if id, ok := id.(int64); ok && id >= 0 && id < 256 {
+				h.M[name] = int(id)
+			}
+		}
+	}
+	h.V, _ = d["v"].(string)
+	if size, ok := d["metadata_size"].(int64); ok && size > 0 {
+		h.MetadataSize = int(size)
+	}
+	return h, nil
+}
+
+// MetadataMessage implements a ut_metadata message (BEP 9). Data holds the metadata piece for
+// MetadataData messages and is sent after the bencoded dictionary.
+type MetadataMessage struct {
+	Type      int
+	Piece     int
+	TotalSize int
+	Data      []byte
+}
+
+// Payload returns the extended message payload for the message.
+func (m MetadataMessage) Payload() []byte {
+	d := map[string]interface{}{"msg_type": m.Type, "piece": m.Piece}
+	if m.Type == MetadataData {
+		d["total_size"] = m.TotalSize
+	}
+	var buf bytes.Buffer
+	bencode.Marshal(&buf, d)
+	return append(buf.Bytes(), m.Data...)
+}
+
+// ParseMetadataMessage parses the payload of a ut_metadata message.
+func ParseMetadataMessage(payload []byte) (*MetadataMessage, error) {
+	end, err := bencodeEnd(payload, 0)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := bencode.Decode(bytes.NewReader(payload[:end]))
+	if err != nil {
+		return nil, MalformedExtensionError
+	}
+	d, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, MalformedExtensionError
+	}
+	msgType, ok1 := d["msg_type"].(int64)
+	piece, ok2 := d["piece"].(int64)
+	if !ok1 || !ok2 || piece < 0 {
+		return nil, MalformedExtensionError
+	}
+	m := &MetadataMessage{Type: int(msgType), Piece: int(piece)}
+	if size, ok := d["total_size"].(int64); ok {
+		m.TotalSize = int(size)
+	}
+	if m.Type == MetadataData {
+		m.Data = payload[end:]
+	}
+	return m, nil
+}
+
+// bencodeEnd returns the offset just past the bencoded value starting at data[i]. ut_metadata data
+// messages append raw bytes after the dictionary, so we need to know where it stops.
+func bencodeEnd(data []byte, i int) (int, error) {
+	if i >= len(data) {
+		return 0, MalformedExtensionError
+	}
+	switch c := data[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[i:], 'e')
+		if end < 0 {
+			return 0, MalformedExtensionError
+		}
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+		for i < len(data) && data[i] != 'e' {
+			next, err := bencodeEnd(data, i)
+			if err != nil {
+				return 0, err
+			}
+			i = next
+		}
+		if i >= len(data) {
+			return 0, MalformedExtensionError
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data[i:], ':')
+		if colon < 0 {
+			return 0, MalformedExtensionError
+		}
+		n, err := strconv.Atoi(string(data[i : i+colon]))
+		if err != nil || n < 0 || i+colon+1+n > len(data) {
+			return 0, MalformedExtensionError
+		}
+		return i + colon + 1 + n, nil
+	}
+	return 0, MalformedExtensionError
+}
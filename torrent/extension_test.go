@@ -0,0 +1,41 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtendedHandshake(t *testing.T) {
+	assert := assert.New(t)
+	h := ExtendedHandshake{M: map[string]int{"ut_metadata": 3}, V: "gotorrent", MetadataSize: 31235}
+	msg := h.Message()
+	assert.Equal(uint8(ExtendedHandshakeID), msg.ID)
+	assert.Equal("d1:md11:ut_metadatai3ee13:metadata_sizei31235e1:v9:gotorrente", string(msg.Payload))
+
+	res, err := ParseExtendedHandshake(msg.Payload)
+	assert.Nil(err)
+	assert.Equal(&h, res)
+
+	_, err = ParseExtendedHandshake([]byte("i3e"))
+	assert.Equal(MalformedExtensionError, err)
+}
+
+func TestMetadataMessage(t *testing.T) {
+	assert := assert.New(t)
+	tests := map[string]*MetadataMessage{
+		"d8:msg_typei0e5:piecei0ee":                        &MetadataMessage{Type: MetadataRequest},
+		"d8:msg_typei1e5:piecei1e10:total_sizei16390eeabc": &MetadataMessage{Type: MetadataData, Piece: 1, TotalSize: 16390, Data: []byte("abc")},
+		"d8:msg_typei2e5:piecei4ee":                        &MetadataMessage{Type: MetadataReject, Piece: 4},
+	}
+
+	for key, val := range tests {
+		assert.Equal(key, string(val.Payload()))
+		res, err := ParseMetadataMessage([]byte(key))
+		assert.Nil(err)
+		assert.Equal(val, res)
+	}
+
+	_, err := ParseMetadataMessage([]byte("d8:msg_typei1e5:piece"))
+	assert.Equal(MalformedExtensionError, err)
+}
@@ -0,0 +1,48 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// AllowedFastSet generates the canonical set of k pieces (BEP 6) a peer at ip may request from us
+// while choked, for a torrent with numPieces pieces. The set is only defined for IPv4 peers, nil is
+// returned for others.
+func AllowedFastSet(k int, ip net.IP, infoHash string, numPieces int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	// Peers in the same /24 get the same set, so they can't collect more pieces by using more
+	// addresses.
+	x := make([]byte, 0, 4+len(infoHash))
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash...)
+	set := make([]int, 0, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !ContainsPiece(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// ContainsPiece returns whether index is in set, a set of pieces like the ones AllowedFastSet
+// returns.
+func ContainsPiece(set []int, index int) bool {
+	for _, i := range set {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
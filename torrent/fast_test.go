@@ -0,0 +1,22 @@
+package torrent
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	assert := assert.New(t)
+	// The example from BEP 6.
+	infoHash := strings.Repeat("\xaa", 20)
+	ip := net.ParseIP("80.4.4.200")
+	assert.Equal([]int{1059, 431, 808, 1217, 287, 376, 1188}, AllowedFastSet(7, ip, infoHash, 1313))
+	assert.Equal([]int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, AllowedFastSet(9, ip, infoHash, 1313))
+	// Same /24, same set.
+	assert.Equal(AllowedFastSet(7, ip, infoHash, 1313), AllowedFastSet(7, net.ParseIP("80.4.4.1"), infoHash, 1313))
+	assert.Len(AllowedFastSet(10, ip, infoHash, 3), 3)
+	assert.Nil(AllowedFastSet(7, net.ParseIP("::1"), infoHash, 1313))
+}
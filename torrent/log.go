@@ -0,0 +1,41 @@
+package torrent
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// logger holds the *slog.Logger the package logs to.
+var logger atomic.Value
+
+func init() {
+	logger.Store(slog.New(discardHandler{}))
+}
+
+// SetLogger sets the logger the package writes debug output about messages and announces to. The
+// package is silent until it's called. A nil l makes it silent again.
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(discardHandler{})
+	}
+	logger.Store(l)
+}
+
+// debugLogger returns the package's logger if it logs debug output, and nil otherwise, so callers
+// can skip building attributes nobody reads.
+func debugLogger() *slog.Logger {
+	l := logger.Load().(*slog.Logger)
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
+		return nil
+	}
+	return l
+}
+
+// discardHandler is a slog.Handler that drops everything.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
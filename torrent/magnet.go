@@ -0,0 +1,70 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// MalformedMagnetError is the error returned when a magnet link couldn't be parsed.
+var MalformedMagnetError = errors.New("malformed magnet link")
+
+// Magnet contains the information carried by a magnet link. Only the info hash is required, the
+// metadata itself has to be fetched from peers.
+type Magnet struct {
+	InfoHash    string
+	DisplayName string
+	Trackers    []string
+}
+
+// ParseMagnet parses a magnet URI of the form magnet:?xt=urn:btih:<hash>&dn=<name>&tr=<tracker>.
+// The info hash may be hex or base32 encoded.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "magnet" {
+		return nil, MalformedMagnetError
+	}
+	q := u.Query()
+	m := new(Magnet)
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		hash := xt[len("urn:btih:"):]
+		var raw []byte
+		switch len(hash) {
+		case 40:
+			raw, err = hex.DecodeString(hash)
+		case 32:
+			raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = MalformedMagnetError
+		}
+		if err != nil {
+			return nil, MalformedMagnetError
+		}
+		m.InfoHash = string(raw)
+		break
+	}
+	if m.InfoHash == "" {
+		return nil, MalformedMagnetError
+	}
+	m.DisplayName = q.Get("dn")
+	m.Trackers = q["tr"]
+	return m, nil
+}
+
+// MetaInfo returns a MetaInfo holding everything the magnet link knows about the torrent. The info
+// dictionary is left empty until the metadata is fetched from peers.
+func (m *Magnet) MetaInfo() *MetaInfo {
+	mi := new(MetaInfo)
+	mi.InfoHash = m.InfoHash
+	mi.Info.Name = m.DisplayName
+	if len(m.Trackers) > 0 {
+		mi.Announce = m.Trackers[0]
+		mi.AnnounceList = [][]string{m.Trackers}
+	}
+	return mi
+}
@@ -0,0 +1,37 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMagnet(t *testing.T) {
+	tests := map[string]*Magnet{
+		"magnet:?xt=urn:btih:6162636465666768696a6b6c6d6e6f7071727374&dn=test&tr=http%3A%2F%2Fsai.com%2Fannounce": &Magnet{InfoHash: "abcdefghijklmnopqrst", DisplayName: "test", Trackers: []string{"http://sai.com/announce"}},
+		"magnet:?xt=urn:btih:MFRGGZDFMZTWQ2LKNNWG23TPOBYXE43U":                                                    &Magnet{InfoHash: "abcdefghijklmnopqrst"},
+	}
+
+	for key, val := range tests {
+		m, err := ParseMagnet(key)
+
+		assert := assert.New(t)
+		assert.Nil(err)
+		assert.Equal(m, val)
+	}
+}
+
+func TestParseMagnetError(t *testing.T) {
+	tests := []string{
+		"http://sai.com/?xt=urn:btih:6162636465666768696a6b6c6d6e6f7071727374",
+		"magnet:?dn=test",
+		"magnet:?xt=urn:btih:abcd",
+	}
+
+	for _, test := range tests {
+		_, err := ParseMagnet(test)
+
+		assert := assert.New(t)
+		assert.Equal(MalformedMagnetError, err)
+	}
+}
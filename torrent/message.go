@@ -120,6 +120,61 @@ func (m Cancel) Format() []byte {
 	return append(buf, uint32ToByteSlice(m.Length)...)
 }
 
+// SuggestPiece implements a suggest piece message (BEP 6).
+type SuggestPiece struct {
+	Index uint32
+}
+
+func (m SuggestPiece) Format() []byte {
+	buf := uint32ToByteSlice(5)
+	buf = append(buf, 0x0d)
+	return append(buf, uint32ToByteSlice(m.Index)...)
+}
+
+// HaveAll implements a have all message (BEP 6).
+type HaveAll struct {
+}
+
+func (m HaveAll) Format() []byte {
+	buf := uint32ToByteSlice(1)
+	return append(buf, 0x0e)
+}
+
+// HaveNone implements a have none message (BEP 6).
+type HaveNone struct {
+}
+
+func (m HaveNone) Format() []byte {
+	buf := uint32ToByteSlice(1)
+	return append(buf, 0x0f)
+}
+
+// RejectRequest implements a reject request message (BEP 6).
+type RejectRequest struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+func (m RejectRequest) Format() []byte {
+	buf := uint32ToByteSlice(13)
+	buf = append(buf, 0x10)
+	buf = append(buf, uint32ToByteSlice(m.Index)...)
+	buf = append(buf, uint32ToByteSlice(m.Begin)...)
+	return append(buf, uint32ToByteSlice(m.Length)...)
+}
+
+// AllowedFast implements an allowed fast message (BEP 6).
+type AllowedFast struct {
+	Index uint32
+}
+
+func (m AllowedFast) Format() []byte {
+	buf := uint32ToByteSlice(5)
+	buf = append(buf, 0x11)
+	return append(buf, uint32ToByteSlice(m.Index)...)
+}
+
 func uint32ToByteSlice(v uint32) []byte {
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, v)
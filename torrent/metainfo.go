@@ -24,6 +24,10 @@ type MetaInfo struct {
 	Encoding     string     "encoding"
 
 	InfoHash string
+	// URLList holds the web seeds from url-list (BEP 19), which may be a single URL or a list.
+	URLList []string
+	// HTTPSeeds holds the web seeds from httpseeds (BEP 17).
+	HTTPSeeds []string
 }
 
 // InfoDict implements the info dictionary portion of a .torrent metainfo.
@@ -44,9 +48,54 @@ type FileDict struct {
 	Path   []string "path"
 }
 
+// File is one of the files a torrent's content is stored in. The content of a torrent is every
+// file laid end to end, in the order of the info dictionary.
+type File struct {
+	// Path is the path of the file relative to the download directory. For multi-file torrents
+	// it starts with the directory named after the torrent.
+	Path   []string
+	Length int64
+	// Offset is where the file starts in the torrent's content.
+	Offset int64
+}
+
+// FileList returns the files of the torrent, which is a single file named after the torrent unless
+// it's a multi-file torrent.
+func (d *InfoDict) FileList() []File {
+	if d.Files == nil {
+		return []File{{Path: []string{d.Name}, Length: d.Length}}
+	}
+	files := make([]File, len(d.Files))
+	var off int64
+	for i, f := range d.Files {
+		files[i] = File{Path: append([]string{d.Name}, f.Path...), Length: f.Length, Offset: off}
+		off += f.Length
+	}
+	return files
+}
+
+// TotalLength returns the length of the torrent's content.
+func (d *InfoDict) TotalLength() int64 {
+	if d.Files == nil {
+		return d.Length
+	}
+	var n int64
+	for _, f := range d.Files {
+		n += f.Length
+	}
+	return n
+}
+
 // Parse returns a MetaInfo struct filled in with data from the input stream. The input stream
 // should be a bencoded torrent file. An error is raised if there is a problem in parsing.
 func Parse(r io.Reader) (*MetaInfo, error) {
+	m, _, err := ParseRaw(r)
+	return m, err
+}
+
+// ParseRaw is like Parse but also returns the bencoded info dictionary that the info hash was
+// computed from. This is the exact encoding peers exchange when sharing metadata.
+func ParseRaw(r io.Reader) (*MetaInfo, []byte, error) {
 	m := new(MetaInfo)
 	// TODO: This will backfire if the torrent file is for some reason too large to fit in
 	// memory.
@@ -55,34 +104,70 @@ func Parse(r io.Reader) (*MetaInfo, error) {
 	err := bencode.Unmarshal(bytes.NewReader(buf.Bytes()), m)
 	obj, err := bencode.Decode(bytes.NewReader(buf.Bytes()))
 	if err != nil {
-		return nil, MalformedTorrentError
+		return nil, nil, MalformedTorrentError
 	}
-	m.InfoHash, err = computeSha1Hash(obj)
+	info, err := encodeInfo(obj)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	// TODO: Support this!
-	if m.Info.Files != nil {
-		return nil, errors.New("no support for multi-file torrents yet :(")
+	m.InfoHash = computeSha1Hash(info)
+	top := obj.(map[string]interface{})
+	m.URLList = stringList(top["url-list"])
+	m.HTTPSeeds = stringList(top["httpseeds"])
+	return m, info, nil
+}
+
+// ParseInfo returns the InfoDict encoded in a bencoded info dictionary, such as one fetched from
+// peers for a magnet link. An error is raised if its hash doesn't match infoHash.
+func ParseInfo(info []byte, infoHash string) (*InfoDict, error) {
+	if computeSha1Hash(info) != infoHash {
+		return nil, errors.New("info dictionary doesn't match info hash")
+	}
+	d := new(InfoDict)
+	err := bencode.Unmarshal(bytes.NewReader(info), d)
+	if err != nil {
+		return nil, MalformedTorrentError
 	}
-	return m, nil
+	return d, nil
 }
 
-// computeSha1Hash finds the info dict in bencoded dictionary and returns its sha1 hash.
-func computeSha1Hash(obj interface{}) (string, error) {
-	// Calculate sha1 hash of the info map.
+// encodeInfo finds the info dict in bencoded dictionary and returns its bencoding.
+func encodeInfo(obj interface{}) ([]byte, error) {
 	top, ok := obj.(map[string]interface{})
 	if !ok {
-		return "", MalformedTorrentError
+		return nil, MalformedTorrentError
 	}
 	info, ok := top["info"]
 	if !ok {
-		return "", MalformedTorrentError
+		return nil, MalformedTorrentError
 	}
 	var b bytes.Buffer
 	bencode.Marshal(&b, info)
-	// Generate the info hash.
+	return b.Bytes(), nil
+}
+
+// stringList returns the strings in a bencoded list, or the string itself if it isn't a list. Empty
+// strings and anything that isn't a string are skipped.
+func stringList(obj interface{}) []string {
+	var l []string
+	switch v := obj.(type) {
+	case string:
+		if v != "" {
+			l = append(l, v)
+		}
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok && s != "" {
+				l = append(l, s)
+			}
+		}
+	}
+	return l
+}
+
+// computeSha1Hash returns the sha1 hash of a bencoded info dict.
+func computeSha1Hash(info []byte) string {
 	hash := sha1.New()
-	hash.Write(b.Bytes())
-	return string(hash.Sum(nil)), nil
+	hash.Write(info)
+	return string(hash.Sum(nil))
 }
@@ -29,3 +29,30 @@ func TestParseError(t *testing.T) {
 	assert := assert.New(t)
 	assert.NotNil(err)
 }
+
+func TestParseWebSeeds(t *testing.T) {
+	assert := assert.New(t)
+	m, err := Parse(strings.NewReader("d9:httpseedsl17:http://a.com/seede4:infod4:name1:x12:piece lengthi4ee8:url-list13:http://b.com/e"))
+	assert.Nil(err)
+	assert.Equal([]string{"http://b.com/"}, m.URLList)
+	assert.Equal([]string{"http://a.com/seed"}, m.HTTPSeeds)
+	m, err = Parse(strings.NewReader("d4:infod4:name1:x12:piece lengthi4ee8:url-listl13:http://b.com/0:13:http://c.com/ee"))
+	assert.Nil(err)
+	assert.Equal([]string{"http://b.com/", "http://c.com/"}, m.URLList)
+	assert.Nil(m.HTTPSeeds)
+}
+
+func TestFileList(t *testing.T) {
+	assert := assert.New(t)
+	m, err := Parse(strings.NewReader("d4:infod5:filesld6:lengthi3e4:pathl1:aeed6:lengthi5e4:pathl3:dir1:beee4:name4:root12:piece lengthi4eee"))
+	assert.Nil(err)
+	assert.Equal([]File{
+		{Path: []string{"root", "a"}, Length: 3, Offset: 0},
+		{Path: []string{"root", "dir", "b"}, Length: 5, Offset: 3},
+	}, m.Info.FileList())
+	assert.Equal(int64(8), m.Info.TotalLength())
+
+	single := InfoDict{Name: "x", Length: 7}
+	assert.Equal([]File{{Path: []string{"x"}, Length: 7}}, single.FileList())
+	assert.Equal(int64(7), single.TotalLength())
+}
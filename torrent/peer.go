@@ -1,9 +1,7 @@
 package torrent
 
 import (
-	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"time"
@@ -24,126 +22,95 @@ func Connect(raddr string) (net.Conn, error) {
 	return conn, nil
 }
 
-// Handshake completes a handshake with a peer. It returns an error if it is not successful in any
-// part of the process.
-func Handshake(conn net.Conn, infoHash string, peerID string) error {
-	err := sendHandshake(conn, infoHash, peerID)
-	if err != nil {
-		return err
-	}
-	err = receiveHandshake(conn, infoHash)
-	if err != nil {
-		return err
-	}
-	return nil
+// Reserved holds the reserved bytes of a handshake, which peers use to advertise the protocol
+// extensions they support.
+type Reserved [8]byte
+
+// SupportsExtensions returns whether the extension protocol (BEP 10) bit is set.
+func (r Reserved) SupportsExtensions() bool {
+	return r[5]&0x10 != 0
 }
 
-// SendMessage writes the byte formatted Message to the provided connection. It returns an error if
-// there was a problem sending the data.
-func SendMessage(conn net.Conn, msg Message) error {
-	_, err := conn.Write(msg.Format())
-	return err
+// SetExtensions sets the extension protocol (BEP 10) bit.
+func (r *Reserved) SetExtensions() {
+	r[5] |= 0x10
+}
+
+// SupportsFast returns whether the Fast Extension (BEP 6) bit is set.
+func (r Reserved) SupportsFast() bool {
+	return r[7]&0x04 != 0
+}
+
+// SetFast sets the Fast Extension (BEP 6) bit.
+func (r *Reserved) SetFast() {
+	r[7] |= 0x04
+}
+
+// SupportsDHT returns whether the DHT (BEP 5) bit is set.
+func (r Reserved) SupportsDHT() bool {
+	return r[7]&0x01 != 0
+}
+
+// PeerHandshake contains what a peer told us about itself in its handshake.
+type PeerHandshake struct {
+	Reserved Reserved
+	InfoHash string
+	PeerID   string
 }
 
-func ReadMessage(conn net.Conn) (Message, error) {
-	lenBuf := make([]byte, 4)
-	_, err := io.ReadFull(conn, lenBuf)
+// Handshake completes a handshake with a peer we connected to: our handshake is sent first and
+// the peer has to answer for the same torrent. It returns the peer's handshake, or an error if it
+// is not successful in any part of the process.
+func Handshake(conn net.Conn, infoHash string, peerID string, reserved Reserved) (*PeerHandshake, error) {
+	err := SendHandshake(conn, infoHash, peerID, reserved)
 	if err != nil {
 		return nil, err
 	}
-	length := binary.BigEndian.Uint32(lenBuf[0:4])
-	// We should kill connections for messages that have absurd length.
-	if length > 1<<15 {
-		fmt.Println("Got message of length", length)
-		return nil, errors.New("length is too large")
-	}
-	buf := make([]byte, length)
-	// TODO: Check if read length is equal to actual length?
-	n, err := io.ReadFull(conn, buf)
-	fmt.Println(n, err)
+	h, err := ReadHandshake(conn)
 	if err != nil {
 		return nil, err
 	}
-	return ParseMessage(append(lenBuf, buf...)), nil
+	if h.InfoHash != infoHash {
+		return nil, errors.New("received info_hash incorrect")
+	}
+	return h, nil
 }
 
-// ParseMessage returns a struct that implements Message containing all relevant information for a
-// peer message. TODO: Currently returns nil if the parse fails. Should return some kind of error I
-// think instead.
-func ParseMessage(data []byte) Message {
-	// Can't possibly be good data if we don't even have a length.
-	if len(data) < 4 {
-		return nil
-	}
-	length := binary.BigEndian.Uint32(data[0:4])
-	if length == 0 {
-		return KeepAlive{}
-	}
-	// If the length isn't what it says it is, then fail.
-	if length != uint32(len(data[4:])) {
-		return nil
-	}
-	if length == 1 {
-		switch data[4] {
-		case 0: // choke
-			return Choke{}
-		case 1: // unchoke
-			return Unchoke{}
-		case 2: // interested
-			return Interested{}
-		case 3: // not interested
-			return NotInterested{}
-		}
-	} else if length == 5 {
-		if data[4] == 4 {
-			pieceIndex := binary.BigEndian.Uint32(data[5:9])
-			return Have{PieceIndex: pieceIndex}
-		}
-	} else if length == 13 {
-		index := binary.BigEndian.Uint32(data[5:9])
-		begin := binary.BigEndian.Uint32(data[9:13])
-		length := binary.BigEndian.Uint32(data[13:17])
-		if data[4] == 6 {
-			return Request{Index: index, Begin: begin, Length: length}
-		} else if data[4] == 8 {
-			return Cancel{Index: index, Begin: begin, Length: length}
-		}
-	}
-	if data[4] == 5 {
-		return Bitfield{Data: data[5 : 5+length-1]}
-	} else if data[4] == 7 {
-		index := binary.BigEndian.Uint32(data[5:9])
-		begin := binary.BigEndian.Uint32(data[9:13])
-		return Piece{Index: index, Begin: begin, Block: data[13 : 13+length-9]}
-	}
-	return nil
+// SendMessage writes the byte formatted Message to the provided connection. It returns an error if
+// there was a problem sending the data.
+func SendMessage(conn net.Conn, msg Message) error {
+	_, err := conn.Write(msg.Format())
+	return err
 }
 
-func sendHandshake(conn net.Conn, infoHash string, peerID string) error {
-	magic := fmt.Sprintf("%s%s", string(len(pStr)), pStr)
-	msg := fmt.Sprintf("%s%s%s%s", magic, "00000000", infoHash, peerID)
-	_, err := conn.Write([]byte(msg))
-	if err != nil {
-		return err
-	}
-	return nil
+// SendHandshake writes our half of a handshake to the connection.
+func SendHandshake(conn net.Conn, infoHash string, peerID string, reserved Reserved) error {
+	msg := make([]byte, 0, 49+len(pStr))
+	msg = append(msg, byte(len(pStr)))
+	msg = append(msg, pStr...)
+	msg = append(msg, reserved[:]...)
+	msg = append(msg, infoHash...)
+	msg = append(msg, peerID...)
+	_, err := conn.Write(msg)
+	return err
 }
 
-func receiveHandshake(conn net.Conn, infoHash string) error {
-	reply := make([]byte, 68)
-	_, err := conn.Read(reply)
+// ReadHandshake reads a peer's half of a handshake off the connection.
+func ReadHandshake(conn net.Conn) (*PeerHandshake, error) {
+	reply := make([]byte, 49+len(pStr))
+	_, err := io.ReadFull(conn, reply)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if reply[0] != byte(len(pStr)) {
-		return errors.New("received pstr not expected length")
+		return nil, errors.New("received pstr not expected length")
 	}
 	if string(reply[1:20]) != pStr {
-		return errors.New("received pstr incorrect")
-	}
-	if string(reply[28:48]) != infoHash {
-		return errors.New("received info_hash incorrect")
+		return nil, errors.New("received pstr incorrect")
 	}
-	// reply[48:68] is the peerID of the connected peer.
-	return nil
+	h := new(PeerHandshake)
+	copy(h.Reserved[:], reply[20:28])
+	h.InfoHash = string(reply[28:48])
+	h.PeerID = string(reply[48:68])
+	return h, nil
 }
@@ -1,7 +1,6 @@
 package torrent
 
 import (
-	"fmt"
 	"net"
 	"testing"
 
@@ -29,28 +28,34 @@ func TestHandshake(t *testing.T) {
 	if err != nil {
 		t.Fatalf("coudln't start listener")
 	}
+	var reserved Reserved
+	reserved.SetExtensions()
 	go func() {
 		conn, err := ln.Accept()
 		defer conn.Close()
 		if err != nil {
-			t.Fatalf("couldn't accept connection", err)
+			t.Errorf("couldn't accept connection: %v", err)
 		}
-		msg := fmt.Sprintf("%s%s", string(19), "BitTorrent protocol00000000abcdefghijklmnopqrstabcdefghijklmnopqrst")
+		msg := "\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x01abcdefghijklmnopqrstABCDEFGHIJKLMNOPQRST"
 		conn.Write([]byte(msg))
 		data := make([]byte, 128)
 		conn.Read(data)
-		if string(data[0:68]) != msg {
-			t.Fatalf(string(data) + " != " + msg)
+		expect := "\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x00abcdefghijklmnopqrstabcdefghijklmnopqrst"
+		if string(data[0:68]) != expect {
+			t.Errorf("%q != %q", data[0:68], expect)
 		}
 		done <- true
 	}()
 	conn, err := Connect(":8080")
 	defer conn.Close()
 	if err != nil {
-		t.Fatalf("couldn't connect", err)
+		t.Fatalf("couldn't connect: %v", err)
 	}
-	err = Handshake(conn, "abcdefghijklmnopqrst", "abcdefghijklmnopqrst")
+	h, err := Handshake(conn, "abcdefghijklmnopqrst", "abcdefghijklmnopqrst", reserved)
 	assert.Nil(err)
+	assert.Equal("ABCDEFGHIJKLMNOPQRST", h.PeerID)
+	assert.True(h.Reserved.SupportsExtensions())
+	assert.True(h.Reserved.SupportsDHT())
 	<-done
 }
 
@@ -93,28 +98,62 @@ func TestSendMessage(t *testing.T) {
 	testSendMessage(t, Request{Index: 1, Begin: 2, Length: 3}, []byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
 	testSendMessage(t, Piece{Index: 1, Begin: 2, Block: []byte{3, 4, 5}}, []byte{0, 0, 0, 12, 7, 0, 0, 0, 1, 0, 0, 0, 2, 3, 4, 5})
 	testSendMessage(t, Cancel{Index: 1, Begin: 2, Length: 3}, []byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	testSendMessage(t, Extended{ID: 1, Payload: []byte{3, 4, 5}}, []byte{0, 0, 0, 5, 20, 1, 3, 4, 5})
+	testSendMessage(t, SuggestPiece{Index: 123456}, []byte{0, 0, 0, 5, 0x0d, 0x0, 0x01, 0xe2, 0x40})
+	testSendMessage(t, HaveAll{}, []byte{0, 0, 0, 1, 0x0e})
+	testSendMessage(t, HaveNone{}, []byte{0, 0, 0, 1, 0x0f})
+	testSendMessage(t, RejectRequest{Index: 1, Begin: 2, Length: 3}, []byte{0, 0, 0, 13, 0x10, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	testSendMessage(t, AllowedFast{Index: 123456}, []byte{0, 0, 0, 5, 0x11, 0x0, 0x01, 0xe2, 0x40})
 }
 
 func TestReceiveMessage(t *testing.T) {
 	assert := assert.New(t)
-	res := ParseMessage([]byte{0, 0, 0, 0})
+	res, err := ParseMessage([]byte{0, 0, 0, 0})
+	assert.NoError(err)
 	assert.Equal(res.(KeepAlive), KeepAlive{})
-	res = ParseMessage([]byte{0, 0, 0, 1, 0})
+	res, err = ParseMessage([]byte{0, 0, 0, 1, 0})
+	assert.NoError(err)
 	assert.Equal(res.(Choke), Choke{})
-	res = ParseMessage([]byte{0, 0, 0, 1, 1})
+	res, err = ParseMessage([]byte{0, 0, 0, 1, 1})
+	assert.NoError(err)
 	assert.Equal(res.(Unchoke), Unchoke{})
-	res = ParseMessage([]byte{0, 0, 0, 1, 2})
+	res, err = ParseMessage([]byte{0, 0, 0, 1, 2})
+	assert.NoError(err)
 	assert.Equal(res.(Interested), Interested{})
-	res = ParseMessage([]byte{0, 0, 0, 1, 3})
+	res, err = ParseMessage([]byte{0, 0, 0, 1, 3})
+	assert.NoError(err)
 	assert.Equal(res.(NotInterested), NotInterested{})
-	res = ParseMessage([]byte{0, 0, 0, 5, 4, 0x0, 0x01, 0xe2, 0x40})
+	res, err = ParseMessage([]byte{0, 0, 0, 5, 4, 0x0, 0x01, 0xe2, 0x40})
+	assert.NoError(err)
 	assert.Equal(res.(Have), Have{PieceIndex: 123456})
-	res = ParseMessage([]byte{0, 0, 0, 5, 5, 1, 2, 3, 4})
+	res, err = ParseMessage([]byte{0, 0, 0, 5, 5, 1, 2, 3, 4})
+	assert.NoError(err)
 	assert.Equal(res.(Bitfield), Bitfield{Data: []byte{1, 2, 3, 4}})
-	res = ParseMessage([]byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	res, err = ParseMessage([]byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	assert.NoError(err)
 	assert.Equal(res.(Request), Request{Index: 1, Begin: 2, Length: 3})
-	res = ParseMessage([]byte{0, 0, 0, 12, 7, 0, 0, 0, 1, 0, 0, 0, 2, 3, 4, 5})
+	res, err = ParseMessage([]byte{0, 0, 0, 12, 7, 0, 0, 0, 1, 0, 0, 0, 2, 3, 4, 5})
+	assert.NoError(err)
 	assert.Equal(res.(Piece), Piece{Index: 1, Begin: 2, Block: []byte{3, 4, 5}})
-	res = ParseMessage([]byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	res, err = ParseMessage([]byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	assert.NoError(err)
 	assert.Equal(res.(Cancel), Cancel{Index: 1, Begin: 2, Length: 3})
+	res, err = ParseMessage([]byte{0, 0, 0, 5, 20, 1, 3, 4, 5})
+	assert.NoError(err)
+	assert.Equal(res.(Extended), Extended{ID: 1, Payload: []byte{3, 4, 5}})
+	res, err = ParseMessage([]byte{0, 0, 0, 5, 0x0d, 0x0, 0x01, 0xe2, 0x40})
+	assert.NoError(err)
+	assert.Equal(res.(SuggestPiece), SuggestPiece{Index: 123456})
+	res, err = ParseMessage([]byte{0, 0, 0, 1, 0x0e})
+	assert.NoError(err)
+	assert.Equal(res.(HaveAll), HaveAll{})
+	res, err = ParseMessage([]byte{0, 0, 0, 1, 0x0f})
+	assert.NoError(err)
+	assert.Equal(res.(HaveNone), HaveNone{})
+	res, err = ParseMessage([]byte{0, 0, 0, 13, 0x10, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	assert.NoError(err)
+	assert.Equal(res.(RejectRequest), RejectRequest{Index: 1, Begin: 2, Length: 3})
+	res, err = ParseMessage([]byte{0, 0, 0, 5, 0x11, 0x0, 0x01, 0xe2, 0x40})
+	assert.NoError(err)
+	assert.Equal(res.(AllowedFast), AllowedFast{Index: 123456})
 }
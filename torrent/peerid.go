@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"strconv"
+	"strings"
+)
+
+// azureusClients names the clients behind the two letter codes of Azureus style peer IDs.
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GT": "gotorrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"WW": "WebTorrent",
+}
+
+// shadowClients names the clients behind the letters of Shadow style peer IDs.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// ParsePeerID identifies the client that generated a peer ID from its Azureus style ("-AZ2060-"
+// followed by random bytes) or Shadow style ("S58B-----" followed by random bytes) prefix. Codes
+// we don't know are returned as the client name. ok is false if the ID follows neither style.
+func ParsePeerID(id string) (client string, version string, ok bool) {
+	if len(id) != 20 {
+		return "", "", false
+	}
+	if id[0] == '-' && id[7] == '-' && isAlnum(id[1]) && isAlnum(id[2]) {
+		var parts []string
+		for i := 3; i < 7; i++ {
+			if !isAlnum(id[i]) {
+				return "", "", false
+			}
+			parts = append(parts, string(id[i]))
+		}
+		// Trailing zeros are left out, so -AZ2060- is version 2.0.6.
+		for len(parts) > 2 && parts[len(parts)-1] == "0" {
+			parts = parts[:len(parts)-1]
+		}
+		code := id[1:3]
+		client, ok := azureusClients[code]
+		if !ok {
+			client = code
+		}
+		return client, strings.Join(parts, "."), true
+	}
+	client, known := shadowClients[id[0]]
+	if !known {
+		return "", "", false
+	}
+	// Up to five version digits in base 64 follow, padded with dashes.
+	var parts []string
+	i := 1
+	for ; i < 6 && id[i] != '-'; i++ {
+		d := shadowDigit(id[i])
+		if d < 0 {
+			return "", "", false
+		}
+		parts = append(parts, strconv.Itoa(d))
+	}
+	if len(parts) == 0 || id[i] != '-' {
+		return "", "", false
+	}
+	return client, strings.Join(parts, "."), true
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// shadowDigit returns the value of a Shadow style version digit, or -1 if c isn't one.
+func shadowDigit(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'A' <= c && c <= 'Z':
+		return int(c-'A') + 10
+	case 'a' <= c && c <= 'z':
+		return int(c-'a') + 36
+	case c == '.':
+		return 62
+	}
+	return -1
+}
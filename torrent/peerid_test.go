@@ -0,0 +1,36 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePeerID(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		id      string
+		client  string
+		version string
+		ok      bool
+	}{
+		{"-AZ2060-abcdefghijkl", "Vuze", "2.0.6", true},
+		{"-qB4250-abcdefghijkl", "qBittorrent", "4.2.5", true},
+		{"-GT0001-abcdefghijkl", "gotorrent", "0.0.0.1", true},
+		{"-XX1000-abcdefghijkl", "XX", "1.0", true},
+		{"S58B-----abcdefghijk", "Shadow", "5.8.11", true},
+		{"T03I--abcdefghijklmn", "BitTornado", "0.3.18", true},
+		{"A2a.0-abcdefghijklmn", "ABC", "2.36.62.0", true},
+		{"-AZ2060-short", "", "", false},
+		{"-AZ2*60-abcdefghijkl", "", "", false},
+		{"T03I!-abcdefghijklmn", "", "", false},
+		{"T-abcdefghijklmnopqr", "", "", false},
+		{"abcdefghijklmnopqrst", "", "", false},
+	}
+	for _, tt := range tests {
+		client, version, ok := ParsePeerID(tt.id)
+		assert.Equal(tt.ok, ok, tt.id)
+		assert.Equal(tt.client, client, tt.id)
+		assert.Equal(tt.version, version, tt.id)
+	}
+}
@@ -28,6 +28,11 @@ func New(peerID string, localPort string, r io.Reader) (*Torrent, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewFromMetaInfo(peerID, localPort, m), nil
+}
+
+// NewFromMetaInfo returns an initialized torrent object for already parsed metainfo.
+func NewFromMetaInfo(peerID string, localPort string, m *MetaInfo) *Torrent {
 	t := new(Torrent)
 	t.PeerID = peerID
 	t.LocalPort = localPort
@@ -35,5 +40,5 @@ func New(peerID string, localPort string, r io.Reader) (*Torrent, error) {
 	t.Event = "started"
 	t.InfoHash = m.InfoHash
 	t.MetaInfo = m
-	return t, nil
+	return t
 }
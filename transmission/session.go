@@ -0,0 +1,148 @@
+package transmission
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/saicheems/gotorrent/client"
+)
+
+// sessionLimitNames are the arguments of session-set changing the client-wide speed limits.
+var sessionLimitNames = [4]string{"speed-limit-down", "speed-limit-down-enabled", "speed-limit-up", "speed-limit-up-enabled"}
+
+// encryptionNames maps encryption policies to Transmission's names for them.
+var encryptionNames = map[client.EncryptionPolicy]string{
+	client.EncryptionPreferred: "preferred",
+	client.EncryptionRequired:  "required",
+	client.EncryptionDisabled:  "tolerated",
+}
+
+// sessionGet describes the session. The "fields" argument picks the keys to return, every key is
+// returned if it's missing.
+func (h *Handler) sessionGet(args map[string]json.RawMessage) (map[string]interface{}, error) {
+	var fields []string
+	if _, err := decode(args, "fields", &fields); err != nil {
+		return nil, err
+	}
+	cfg := h.c.Config()
+	dir := cfg.DownloadDir
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	port := 0
+	addr := cfg.ListenAddr
+	if ln := h.c.ListenAddr(); ln != nil {
+		addr = ln.String()
+	}
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		port, _ = strconv.Atoi(p)
+	}
+	up, down := h.c.RateLimits()
+	h.mu.Lock()
+	downLimit, downOn := getLimit(down, h.session.down)
+	upLimit, upOn := getLimit(up, h.session.up)
+	h.mu.Unlock()
+	session := map[string]interface{}{
+		"version":                    version,
+		"rpc-version":                rpcVersion,
+		"rpc-version-minimum":        rpcVersionMinimum,
+		"rpc-version-semver":         rpcVersionSemver,
+		"session-id":                 h.sessionID,
+		"download-dir":               dir,
+		"peer-port":                  port,
+		"peer-limit-global":          cfg.MaxTotalConnections,
+		"peer-limit-per-torrent":     cfg.MaxConnections,
+		"encryption":                 encryptionNames[cfg.Encryption],
+		"utp-enabled":                !cfg.DisableUTP,
+		"blocklist-enabled":          len(cfg.Blocklists) > 0,
+		"speed-limit-down":           downLimit,
+		"speed-limit-down-enabled":   downOn,
+		"speed-limit-up":             upLimit,
+		"speed-limit-up-enabled":     upOn,
+		"alt-speed-enabled":          false,
+		"alt-speed-down":             0,
+		"alt-speed-up":               0,
+		"start-added-torrents":       true,
+		"dht-enabled":                false,
+		"pex-enabled":                false,
+		"lpd-enabled":                false,
+		"port-forwarding-enabled":    false,
+		"download-queue-enabled":     false,
+		"seed-queue-enabled":         false,
+		"seedRatioLimited":           false,
+		"idle-seeding-limit-enabled": false,
+		"incomplete-dir-enabled":     false,
+		"rename-partial-files":       false,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  speedBytes,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+	if len(fields) == 0 {
+		return session, nil
+	}
+	picked := make(map[string]interface{})
+	for _, f := range fields {
+		if v, ok := session[f]; ok {
+			picked[f] = v
+		}
+	}
+	return picked, nil
+}
+
+// sessionSet changes the client-wide speed limits. Other settings are ignored.
+func (h *Handler) sessionSet(args map[string]json.RawMessage) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	up, down := h.c.RateLimits()
+	up, down, err := setLimits(args, sessionLimitNames, &h.session, up, down)
+	if err != nil {
+		return err
+	}
+	h.c.SetRateLimits(up, down)
+	return nil
+}
+
+// sessionStats sums up the transfers of every torrent. Since totals aren't kept across runs, the
+// cumulative stats are those of the current session, which started with the handler.
+func (h *Handler) sessionStats() map[string]interface{} {
+	var active, paused int
+	var downRate, upRate, downloaded, uploaded int64
+	torrents := h.torrents()
+	for _, e := range torrents {
+		s := e.t.Stats()
+		if s.Running {
+			active++
+		} else {
+			paused++
+		}
+		downRate += s.DownloadRate
+		upRate += s.UploadRate
+		downloaded += s.Downloaded
+		uploaded += s.Uploaded
+	}
+	stats := map[string]interface{}{
+		"uploadedBytes":   uploaded,
+		"downloadedBytes": downloaded,
+		"filesAdded":      atomic.LoadInt64(&h.added),
+		"sessionCount":    1,
+		"secondsActive":   int64(time.Since(h.started).Seconds()),
+	}
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(torrents),
+		"downloadSpeed":      downRate,
+		"uploadSpeed":        upRate,
+		"cumulative-stats":   stats,
+		"current-stats":      stats,
+	}
+}
@@ -0,0 +1,625 @@
+package transmission
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/saicheems/gotorrent/client"
+)
+
+// Torrent statuses.
+const (
+	statusStopped     = 0
+	statusDownloading = 4
+	statusSeeding     = 6
+)
+
+// Torrent errors.
+const (
+	errorNone  = 0
+	errorLocal = 3
+)
+
+// torrentLimitNames are the arguments of torrent-set changing a torrent's speed limits.
+var torrentLimitNames = [4]string{"downloadLimit", "downloadLimited", "uploadLimit", "uploadLimited"}
+
+// transmissionPriorities maps file priorities to Transmission's. Skipped files are unwanted and
+// have normal priority.
+var transmissionPriorities = map[client.Priority]int{
+	client.PrioritySkip:   0,
+	client.PriorityLow:    -1,
+	client.PriorityNormal: 0,
+	client.PriorityHigh:   1,
+}
+
+// view is what torrent-get knows about a torrent, gathered once per torrent and request.
+type view struct {
+	h *Handler
+	entry
+	hash               string
+	stats              client.Stats
+	priorities         []client.Priority
+	completed          []int64 // Bytes of each file in pieces we have.
+	sizeWhenDone, left int64
+}
+
+func (h *Handler) newView(e entry) *view {
+	v := &view{h: h, entry: e, hash: hex.EncodeToString([]byte(e.t.InfoHash())), stats: e.t.Stats()}
+	v.priorities = e.t.FilePriorities()
+	files := e.t.Files()
+	have := e.t.BitSet()
+	pieceLength := e.t.MetaInfo().Info.PieceLength
+	for i, f := range files {
+		var done int64
+		if have != nil && f.Length > 0 {
+			for index := int(f.Offset / pieceLength); index <= int((f.Offset+f.Length-1)/pieceLength); index++ {
+				if !have.Check(index) {
+					continue
+				}
+				start, end := int64(index)*pieceLength, int64(index+1)*pieceLength
+				if start < f.Offset {
+					start = f.Offset
+				}
+				if end > f.Offset+f.Length {
+					end = f.Offset + f.Length
+				}
+				done += end - start
+			}
+		}
+		v.completed = append(v.completed, done)
+		if v.priorities[i] != client.PrioritySkip {
+			v.sizeWhenDone += f.Length
+			v.left += f.Length - done
+		}
+	}
+	return v
+}
+
+// hasMetadata returns whether the torrent's metadata is known.
+func (v *view) hasMetadata() bool {
+	return v.priorities != nil
+}
+
+func (v *view) status() int {
+	switch {
+	case !v.stats.Running:
+		return statusStopped
+	case v.hasMetadata() && v.left == 0:
+		return statusSeeding
+	}
+	return statusDownloading
+}
+
+func (v *view) percentDone() float64 {
+	if v.sizeWhenDone == 0 {
+		if v.hasMetadata() {
+			return 1
+		}
+		return 0
+	}
+	return float64(v.sizeWhenDone-v.left) / float64(v.sizeWhenDone)
+}
+
+func (v *view) eta() int64 {
+	if v.status() != statusDownloading || v.stats.DownloadRate <= 0 {
+		return -1
+	}
+	return v.left / v.stats.DownloadRate
+}
+
+func (v *view) ratio() float64 {
+	base := v.stats.Downloaded
+	if v.stats.BytesCompleted > base {
+		base = v.stats.BytesCompleted
+	}
+	if base == 0 {
+		return -1
+	}
+	return float64(v.stats.Uploaded) / float64(base)
+}
+
+func (v *view) magnetLink() string {
+	q := url.Values{}
+	q.Set("dn", v.t.Name())
+	m := v.t.MetaInfo()
+	if m.Announce != "" {
+		q.Set("tr", m.Announce)
+	}
+	return "magnet:?xt=urn:btih:" + v.hash + "&" + q.Encode()
+}
+
+func (v *view) files() []map[string]interface{} {
+	files := make([]map[string]interface{}, 0)
+	for i, f := range v.t.Files() {
+		files = append(files, map[string]interface{}{
+			"name":           strings.Join(f.Path, "/"),
+			"length":         f.Length,
+			"bytesCompleted": v.completed[i],
+		})
+	}
+	return files
+}
+
+func (v *view) fileStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0)
+	for i, p := range v.priorities {
+		stats = append(stats, map[string]interface{}{
+			"bytesCompleted": v.completed[i],
+			"wanted":         p != client.PrioritySkip,
+			"priority":       transmissionPriorities[p],
+		})
+	}
+	return stats
+}
+
+func (v *view) wanted() []int {
+	wanted := make([]int, 0)
+	for _, p := range v.priorities {
+		if p == client.PrioritySkip {
+			wanted = append(wanted, 0)
+		} else {
+			wanted = append(wanted, 1)
+		}
+	}
+	return wanted
+}
+
+func (v *view) filePriorities() []int {
+	priorities := make([]int, 0)
+	for _, p := range v.priorities {
+		priorities = append(priorities, transmissionPriorities[p])
+	}
+	return priorities
+}
+
+func (v *view) peers() []map[string]interface{} {
+	peers := make([]map[string]interface{}, 0)
+	for _, p := range v.t.Peers() {
+		host, port, _ := net.SplitHostPort(p.Addr.String())
+		portNum, _ := strconv.Atoi(port)
+		name := strings.TrimSpace(p.Client + " " + p.ClientVersion)
+		peers = append(peers, map[string]interface{}{
+			"address":            host,
+			"port":               portNum,
+			"clientName":         name,
+			"clientIsChoked":     p.PeerChoking,
+			"clientIsInterested": p.AmInterested,
+			"peerIsChoked":       p.AmChoking,
+			"peerIsInterested":   p.PeerInterested,
+			"isEncrypted":        false,
+			"isIncoming":         false,
+			"progress":           0,
+			"rateToClient":       0,
+			"rateToPeer":         0,
+			"flagStr":            "",
+		})
+	}
+	return peers
+}
+
+// peersSending returns the number of peers we're downloading from, or, if sending is false, the
+// number we're uploading to.
+func (v *view) peersSending(sending bool) int {
+	n := 0
+	for _, p := range v.t.Peers() {
+		if sending && p.AmInterested && !p.PeerChoking || !sending && p.PeerInterested && !p.AmChoking {
+			n++
+		}
+	}
+	return n
+}
+
+func (v *view) trackers() []map[string]interface{} {
+	trackers := make([]map[string]interface{}, 0)
+	for i, tr := range v.t.Trackers() {
+		trackers = append(trackers, map[string]interface{}{"id": i, "announce": tr.URL, "scrape": "", "tier": i})
+	}
+	return trackers
+}
+
+func (v *view) trackerStats() []map[string]interface{} {
+	stats := make([]map[string]interface{}, 0)
+	for i, tr := range v.t.Trackers() {
+		host := tr.URL
+		if u, err := url.Parse(tr.URL); err == nil {
+			host = u.Scheme + "://" + u.Host
+		}
+		var last, next int64
+		if !tr.LastAnnounce.IsZero() {
+			last = tr.LastAnnounce.Unix()
+		}
+		result := ""
+		if tr.Err != nil {
+			result = tr.Err.Error()
+		} else if last != 0 {
+			result = "Success"
+		}
+		announceState := 0 // Inactive.
+		if !tr.NextAnnounce.IsZero() {
+			next = tr.NextAnnounce.Unix()
+			announceState = 1 // Waiting.
+		}
+		stats = append(stats, map[string]interface{}{
+			"id":                    i,
+			"tier":                  i,
+			"announce":              tr.URL,
+			"host":                  host,
+			"scrape":                "",
+			"isBackup":              false,
+			"hasAnnounced":          last != 0 || tr.Err != nil,
+			"lastAnnounceTime":      last,
+			"lastAnnounceSucceeded": tr.Err == nil && last != 0,
+			"lastAnnounceResult":    result,
+			"lastAnnouncePeerCount": tr.Peers,
+			"nextAnnounceTime":      next,
+			"announceState":         announceState,
+			"seederCount":           tr.Seeders,
+			"leecherCount":          tr.Leechers,
+			"downloadCount":         -1,
+			"hasScraped":            false,
+			"scrapeState":           0,
+		})
+	}
+	return stats
+}
+
+// limits returns the torrent's speed limits in kB/s and whether they're enabled.
+func (v *view) limits() (down int64, downOn bool, up int64, upOn bool) {
+	upForce, downForce := v.t.RateLimits()
+	v.h.mu.Lock()
+	defer v.h.mu.Unlock()
+	l := v.h.limits[v.t.InfoHash()]
+	if l == nil {
+		l = new(limits)
+	}
+	down, downOn = getLimit(downForce, l.down)
+	up, upOn = getLimit(upForce, l.up)
+	return down, downOn, up, upOn
+}
+
+// torrentFields are the fields torrent-get knows about. Unknown fields are left out of responses.
+var torrentFields = map[string]func(v *view) interface{}{
+	"id":         func(v *view) interface{} { return v.id },
+	"hashString": func(v *view) interface{} { return v.hash },
+	"name":       func(v *view) interface{} { return v.t.Name() },
+	"addedDate":  func(v *view) interface{} { return v.t.Added().Unix() },
+	"status":     func(v *view) interface{} { return v.status() },
+	"error": func(v *view) interface{} {
+		if v.t.Err() != nil {
+			return errorLocal
+		}
+		return errorNone
+	},
+	"errorString": func(v *view) interface{} {
+		if err := v.t.Err(); err != nil {
+			return err.Error()
+		}
+		return ""
+	},
+	"totalSize":     func(v *view) interface{} { return v.stats.Length },
+	"sizeWhenDone":  func(v *view) interface{} { return v.sizeWhenDone },
+	"leftUntilDone": func(v *view) interface{} { return v.left },
+	"haveValid":     func(v *view) interface{} { return v.stats.BytesCompleted },
+	"haveUnchecked": func(v *view) interface{} { return 0 },
+	"percentDone":   func(v *view) interface{} { return v.percentDone() },
+	"metadataPercentComplete": func(v *view) interface{} {
+		if v.hasMetadata() {
+			return 1
+		}
+		return 0
+	},
+	"recheckProgress":     func(v *view) interface{} { return 0 },
+	"isFinished":          func(v *view) interface{} { return false },
+	"isStalled":           func(v *view) interface{} { return false },
+	"rateDownload":        func(v *view) interface{} { return v.stats.DownloadRate },
+	"rateUpload":          func(v *view) interface{} { return v.stats.UploadRate },
+	"downloadedEver":      func(v *view) interface{} { return v.stats.Downloaded },
+	"uploadedEver":        func(v *view) interface{} { return v.stats.Uploaded },
+	"uploadRatio":         func(v *view) interface{} { return v.ratio() },
+	"eta":                 func(v *view) interface{} { return v.eta() },
+	"peersConnected":      func(v *view) interface{} { return v.stats.Peers },
+	"peersSendingToUs":    func(v *view) interface{} { return v.peersSending(true) },
+	"peersGettingFromUs":  func(v *view) interface{} { return v.peersSending(false) },
+	"webseedsSendingToUs": func(v *view) interface{} { return 0 },
+	"queuePosition":       func(v *view) interface{} { return v.id - 1 },
+	"downloadDir": func(v *view) interface{} {
+		dir := v.h.c.Config().DownloadDir
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		return dir
+	},
+	"pieceCount":   func(v *view) interface{} { return v.stats.NumPieces },
+	"pieceSize":    func(v *view) interface{} { return v.t.MetaInfo().Info.PieceLength },
+	"comment":      func(v *view) interface{} { return v.t.MetaInfo().Comment },
+	"creator":      func(v *view) interface{} { return v.t.MetaInfo().CreatedBy },
+	"dateCreated":  func(v *view) interface{} { return v.t.MetaInfo().CreationDate },
+	"magnetLink":   func(v *view) interface{} { return v.magnetLink() },
+	"files":        func(v *view) interface{} { return v.files() },
+	"fileStats":    func(v *view) interface{} { return v.fileStats() },
+	"wanted":       func(v *view) interface{} { return v.wanted() },
+	"priorities":   func(v *view) interface{} { return v.filePriorities() },
+	"peers":        func(v *view) interface{} { return v.peers() },
+	"trackers":     func(v *view) interface{} { return v.trackers() },
+	"trackerStats": func(v *view) interface{} { return v.trackerStats() },
+	"downloadLimit": func(v *view) interface{} {
+		down, _, _, _ := v.limits()
+		return down
+	},
+	"downloadLimited": func(v *view) interface{} {
+		_, on, _, _ := v.limits()
+		return on
+	},
+	"uploadLimit": func(v *view) interface{} {
+		_, _, up, _ := v.limits()
+		return up
+	},
+	"uploadLimited": func(v *view) interface{} {
+		_, _, _, on := v.limits()
+		return on
+	},
+}
+
+// torrentGet describes the torrents picked by "ids" with the requested "fields". With "format"
+// set to "table" the torrents are a list of rows following a row of the field names.
+func (h *Handler) torrentGet(args map[string]json.RawMessage) (map[string]interface{}, error) {
+	var fields []string
+	if _, err := decode(args, "fields", &fields); err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no fields specified")
+	}
+	var format string
+	if _, err := decode(args, "format", &format); err != nil {
+		return nil, err
+	}
+	entries, err := h.selectTorrents(args)
+	if err != nil {
+		return nil, err
+	}
+	var known []string
+	for _, f := range fields {
+		if _, ok := torrentFields[f]; ok {
+			known = append(known, f)
+		}
+	}
+	if format == "table" {
+		rows := []interface{}{known}
+		for _, e := range entries {
+			v := h.newView(e)
+			row := make([]interface{}, len(known))
+			for i, f := range known {
+				row[i] = torrentFields[f](v)
+			}
+			rows = append(rows, row)
+		}
+		return map[string]interface{}{"torrents": rows, "removed": []int{}}, nil
+	}
+	torrents := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		v := h.newView(e)
+		obj := make(map[string]interface{}, len(known))
+		for _, f := range known {
+			obj[f] = torrentFields[f](v)
+		}
+		torrents = append(torrents, obj)
+	}
+	return map[string]interface{}{"torrents": torrents, "removed": []int{}}, nil
+}
+
+// torrentAdd adds a torrent from a magnet link, URL or path on the server in "filename", or from
+// a base64 encoded .torrent file in "metainfo". It's started unless "paused" is true. The file
+// arguments of torrent-set apply to torrents whose metadata is known.
+func (h *Handler) torrentAdd(r *http.Request, args map[string]json.RawMessage) (map[string]interface{}, error) {
+	var filename, metainfo, dir string
+	var paused bool
+	for name, v := range map[string]interface{}{"filename": &filename, "metainfo": &metainfo, "download-dir": &dir, "paused": &paused} {
+		if _, err := decode(args, name, v); err != nil {
+			return nil, err
+		}
+	}
+	if dir != "" {
+		want, _ := filepath.Abs(h.c.Config().DownloadDir)
+		if got, _ := filepath.Abs(dir); got != want {
+			return nil, errors.New("torrents can only be added to the session's download-dir")
+		}
+	}
+	var t *client.Torrent
+	var err error
+	switch {
+	case metainfo != "":
+		data, derr := base64.StdEncoding.DecodeString(metainfo)
+		if derr != nil {
+			return nil, errors.New("invalid metainfo: " + derr.Error())
+		}
+		t, err = h.c.AddTorrentReader(bytes.NewReader(data))
+	case strings.HasPrefix(filename, "magnet:"):
+		t, err = h.c.AddMagnet(filename)
+	case strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://"):
+		t, err = h.c.AddTorrentURL(r.Context(), filename)
+	case filename != "":
+		t, err = h.c.AddTorrentFile(filename)
+	default:
+		return nil, errors.New("no filename or metainfo specified")
+	}
+	if err == client.ErrDuplicateTorrent {
+		return map[string]interface{}{"torrent-duplicate": h.summary(t)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&h.added, 1)
+	if t.Files() != nil {
+		if err := h.setFiles(t, args); err != nil {
+			return nil, err
+		}
+	}
+	if !paused {
+		if err := t.Start(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"torrent-added": h.summary(t)}, nil
+}
+
+// summary returns the ID, name and info hash of t, as returned by torrent-add.
+func (h *Handler) summary(t *client.Torrent) map[string]interface{} {
+	hash := t.InfoHash()
+	id := 0
+	for _, e := range h.torrents() {
+		if e.t.InfoHash() == hash {
+			id = e.id
+		}
+	}
+	return map[string]interface{}{"id": id, "name": t.Name(), "hashString": hex.EncodeToString([]byte(hash))}
+}
+
+// torrentSet changes the files to download, their priorities and the speed limits of the
+// torrents picked by "ids". Other settings are ignored.
+func (h *Handler) torrentSet(args map[string]json.RawMessage) error {
+	entries, err := h.selectTorrents(args)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := h.setFiles(e.t, args); err != nil {
+			return err
+		}
+		up, down := e.t.RateLimits()
+		h.mu.Lock()
+		l := h.limits[e.t.InfoHash()]
+		if l == nil {
+			l = new(limits)
+			h.limits[e.t.InfoHash()] = l
+		}
+		up, down, err = setLimits(args, torrentLimitNames, l, up, down)
+		h.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		e.t.SetRateLimits(up, down)
+	}
+	return nil
+}
+
+// setFiles applies the files-wanted, files-unwanted, priority-high, priority-low and
+// priority-normal arguments, lists of file indexes, to t. An empty list means every file. Files
+// that are made wanted get normal priority, and priorities only change for wanted files since
+// skipped files don't have one.
+func (h *Handler) setFiles(t *client.Torrent, args map[string]json.RawMessage) error {
+	priorities := t.FilePriorities()
+	changed := false
+	for _, arg := range []struct {
+		name   string
+		apply  func(p client.Priority) client.Priority
+		wanted bool
+	}{
+		{"files-wanted", func(p client.Priority) client.Priority {
+			if p == client.PrioritySkip {
+				return client.PriorityNormal
+			}
+			return p
+		}, false},
+		{"files-unwanted", func(client.Priority) client.Priority { return client.PrioritySkip }, false},
+		{"priority-high", func(client.Priority) client.Priority { return client.PriorityHigh }, true},
+		{"priority-low", func(client.Priority) client.Priority { return client.PriorityLow }, true},
+		{"priority-normal", func(client.Priority) client.Priority { return client.PriorityNormal }, true},
+	} {
+		var indexes []int
+		ok, err := decode(args, arg.name, &indexes)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if priorities == nil {
+			return client.ErrNoMetadata
+		}
+		if len(indexes) == 0 {
+			for i := range priorities {
+				indexes = append(indexes, i)
+			}
+		}
+		for _, i := range indexes {
+			if i < 0 || i >= len(priorities) {
+				return client.ErrNoSuchFile
+			}
+			if arg.wanted && priorities[i] == client.PrioritySkip {
+				continue
+			}
+			priorities[i] = arg.apply(priorities[i])
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	for i, p := range priorities {
+		if err := t.SetFilePriority(i, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// torrentStart starts the torrents picked by "ids".
+func (h *Handler) torrentStart(args map[string]json.RawMessage) error {
+	entries, err := h.selectTorrents(args)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := e.t.Start(context.Background()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// torrentStop pauses the torrents picked by "ids".
+func (h *Handler) torrentStop(args map[string]json.RawMessage) error {
+	entries, err := h.selectTorrents(args)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		e.t.Pause()
+	}
+	return nil
+}
+
+// torrentRemove removes the torrents picked by "ids", deleting their files if
+// "delete-local-data" is true.
+func (h *Handler) torrentRemove(args map[string]json.RawMessage) error {
+	entries, err := h.selectTorrents(args)
+	if err != nil {
+		return err
+	}
+	var deleteData bool
+	if _, err := decode(args, "delete-local-data", &deleteData); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		remove := e.t.Stop
+		if deleteData {
+			remove = e.t.Remove
+		}
+		if err := remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
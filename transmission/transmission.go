@@ -0,0 +1,335 @@
+// Package transmission serves a subset of the Transmission RPC protocol for a client, so scripts,
+// dashboards and web UIs written for Transmission can drive it. The supported methods are
+// session-get, session-set, session-stats, torrent-get, torrent-add, torrent-set, torrent-start,
+// torrent-start-now, torrent-stop and torrent-remove.
+//
+// Requests go through Transmission's CSRF handshake: a request without the current
+// X-Transmission-Session-Id header is answered with 409 Conflict and the header to retry with.
+// Without credentials, requests must also name the server by an IP address, localhost or one of
+// the allowed host names, so a web page can't reach it through a DNS name of its own.
+// Speeds are in kB/s of 1000 bytes, as in Transmission.
+package transmission
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saicheems/gotorrent/client"
+)
+
+const (
+	// SessionIDHeader is the header of the CSRF handshake.
+	SessionIDHeader = "X-Transmission-Session-Id"
+
+	rpcVersion        = 17
+	rpcVersionMinimum = 14
+	rpcVersionSemver  = "5.3.0"
+	version           = "4.0.0 (gotorrent)"
+
+	// speedBytes is the number of bytes in a kB of the speeds in requests and responses.
+	speedBytes = 1000
+	// maxRequestSize bounds the size of a request, which may hold a base64 encoded .torrent file.
+	maxRequestSize = 16 << 20
+)
+
+// ErrUnknownMethod is the result of requests for methods that aren't supported.
+var ErrUnknownMethod = errors.New("method name not recognized")
+
+// request is an RPC request.
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// response is an RPC response. Result is "success" or an error message.
+type response struct {
+	Result    string                 `json:"result"`
+	Arguments map[string]interface{} `json:"arguments"`
+	Tag       json.RawMessage        `json:"tag,omitempty"`
+}
+
+// limits remembers the speed limits set for a client or torrent. The client only knows the limits
+// in force, so these are what's put back in force when a limit is enabled again.
+type limits struct {
+	down, up int64 // kB/s.
+}
+
+// Handler serves the Transmission RPC protocol for a client.
+type Handler struct {
+	c                  *client.Client
+	username, password string
+	hosts              map[string]bool // Lower cased host names allowed without credentials.
+	sessionID          string
+	started            time.Time
+	added              int64 // Torrents added over RPC, accessed atomically.
+
+	mu      sync.Mutex
+	ids     map[string]int // Transmission's torrent IDs by info hash.
+	nextID  int
+	session limits
+	limits  map[string]*limits // Speed limits of torrents by info hash.
+}
+
+// NewHandler returns a handler serving RPC requests for c. If username or password is set,
+// requests must carry them with HTTP basic authentication. Otherwise their Host header must be an
+// IP address, localhost or one of hosts.
+func NewHandler(c *client.Client, username, password string, hosts ...string) *Handler {
+	id := make([]byte, 24)
+	rand.Read(id)
+	h := &Handler{
+		c:         c,
+		username:  username,
+		password:  password,
+		hosts:     map[string]bool{"localhost": true},
+		sessionID: hex.EncodeToString(id),
+		started:   time.Now(),
+		ids:       make(map[string]int),
+		nextID:    1,
+		limits:    make(map[string]*limits),
+	}
+	for _, host := range hosts {
+		h.hosts[strings.ToLower(strings.TrimSuffix(host, "."))] = true
+	}
+	up, down := c.RateLimits()
+	h.session = limits{down: down / speedBytes, up: up / speedBytes}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.allowedHost(r) {
+		http.Error(w, "unrecognized host "+r.Host, http.StatusMisdirectedRequest)
+		return
+	}
+	if r.Header.Get(SessionIDHeader) != h.sessionID {
+		w.Header().Set(SessionIDHeader, h.sessionID)
+		http.Error(w, "invalid session id", http.StatusConflict)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args, err := h.call(r, req.Method, req.Arguments)
+	resp := response{Result: "success", Arguments: args, Tag: req.Tag}
+	if err != nil {
+		resp.Result = err.Error()
+	}
+	if resp.Arguments == nil {
+		resp.Arguments = make(map[string]interface{})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(SessionIDHeader, h.sessionID)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// authorized returns whether r carries the configured credentials, if there are any.
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.username == "" && h.password == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(h.username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(h.password)) == 1
+	return ok && userOK && passOK
+}
+
+// allowedHost returns whether r may be served going by its Host header. With credentials any host
+// is, as a page reaching the server through DNS rebinding doesn't have them.
+func (h *Handler) allowedHost(r *http.Request) bool {
+	if h.username != "" || h.password != "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host // No port.
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return net.ParseIP(host) != nil || h.hosts[strings.ToLower(host)]
+}
+
+// call runs the method with the raw JSON arguments.
+func (h *Handler) call(r *http.Request, method string, raw json.RawMessage) (map[string]interface{}, error) {
+	var args map[string]json.RawMessage
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, fmt.Errorf("invalid arguments: %v", err)
+		}
+	}
+	switch method {
+	case "session-get":
+		return h.sessionGet(args)
+	case "session-set":
+		return nil, h.sessionSet(args)
+	case "session-stats":
+		return h.sessionStats(), nil
+	case "torrent-get":
+		return h.torrentGet(args)
+	case "torrent-add":
+		return h.torrentAdd(r, args)
+	case "torrent-set":
+		return nil, h.torrentSet(args)
+	case "torrent-start", "torrent-start-now":
+		return nil, h.torrentStart(args)
+	case "torrent-stop":
+		return nil, h.torrentStop(args)
+	case "torrent-remove":
+		return nil, h.torrentRemove(args)
+	}
+	return nil, ErrUnknownMethod
+}
+
+// entry is a torrent along with its Transmission ID.
+type entry struct {
+	id int
+	t  *client.Torrent
+}
+
+// torrents returns every torrent of the client ordered by ID. Torrents are given IDs in the order
+// they were added the first time they're seen, and keep them for as long as they're around.
+func (h *Handler) torrents() []entry {
+	torrents := h.c.Torrents()
+	sort.Slice(torrents, func(i, j int) bool {
+		a, b := torrents[i], torrents[j]
+		if !a.Added().Equal(b.Added()) {
+			return a.Added().Before(b.Added())
+		}
+		return a.InfoHash() < b.InfoHash()
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	present := make(map[string]bool)
+	entries := make([]entry, 0, len(torrents))
+	for _, t := range torrents {
+		present[t.InfoHash()] = true
+		id, ok := h.ids[t.InfoHash()]
+		if !ok {
+			id = h.nextID
+			h.nextID++
+			h.ids[t.InfoHash()] = id
+		}
+		entries = append(entries, entry{id, t})
+	}
+	for hash := range h.ids {
+		if !present[hash] {
+			delete(h.ids, hash)
+			delete(h.limits, hash)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	return entries
+}
+
+// selectTorrents returns the torrents picked by the "ids" argument: an ID, a hex info hash or a
+// list of them. Every torrent is picked if it's missing or "recently-active".
+func (h *Handler) selectTorrents(args map[string]json.RawMessage) ([]entry, error) {
+	all := h.torrents()
+	raw, ok := args["ids"]
+	if !ok {
+		return all, nil
+	}
+	var ids []interface{}
+	var single interface{}
+	if err := json.Unmarshal(raw, &single); err != nil {
+		return nil, fmt.Errorf("invalid ids: %v", err)
+	}
+	switch v := single.(type) {
+	case string:
+		if v == "recently-active" {
+			return all, nil
+		}
+		ids = []interface{}{v}
+	case float64:
+		ids = []interface{}{v}
+	case []interface{}:
+		ids = v
+	default:
+		return nil, errors.New("invalid ids")
+	}
+	var picked []entry
+	for _, e := range all {
+		hash := hex.EncodeToString([]byte(e.t.InfoHash()))
+		for _, id := range ids {
+			if n, ok := id.(float64); ok && int(n) == e.id {
+				picked = append(picked, e)
+				break
+			}
+			if s, ok := id.(string); ok && s == hash {
+				picked = append(picked, e)
+				break
+			}
+		}
+	}
+	return picked, nil
+}
+
+// decode unmarshals the argument name into v if it's present, and returns whether it was.
+func decode(args map[string]json.RawMessage, name string, v interface{}) (bool, error) {
+	raw, ok := args[name]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// setLimits applies the speed limit arguments in names, the down limit, whether it's enabled, the
+// up limit and whether it's enabled, to the limits in force in bytes per second. l remembers the
+// limits while they're off. It returns the limits to put in force.
+func setLimits(args map[string]json.RawMessage, names [4]string, l *limits, up, down int64) (int64, int64, error) {
+	downOn, upOn := down > 0, up > 0
+	if downOn {
+		l.down = down / speedBytes
+	}
+	if upOn {
+		l.up = up / speedBytes
+	}
+	for i, v := range []interface{}{&l.down, &downOn, &l.up, &upOn} {
+		if _, err := decode(args, names[i], v); err != nil {
+			return 0, 0, err
+		}
+	}
+	if l.down < 0 || l.up < 0 {
+		return 0, 0, errors.New("speed limits can't be negative")
+	}
+	down, up = 0, 0
+	if downOn {
+		down = l.down * speedBytes
+	}
+	if upOn {
+		up = l.up * speedBytes
+	}
+	return up, down, nil
+}
+
+// getLimit returns the limit in kB/s to report for one in force in bytes per second, and whether
+// it's enabled. The remembered limit is reported while it's off.
+func getLimit(inForce, remembered int64) (int64, bool) {
+	if inForce > 0 {
+		return inForce / speedBytes, true
+	}
+	return remembered, false
+}
@@ -0,0 +1,257 @@
+package transmission
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saicheems/gotorrent/client"
+	"github.com/saicheems/gotorrent/internal/testclient"
+	"github.com/saicheems/gotorrent/internal/testtorrent"
+	"github.com/stretchr/testify/assert"
+)
+
+// rpcClient sends RPC requests the way Transmission's clients do, going through the CSRF
+// handshake when the session ID is missing or stale.
+type rpcClient struct {
+	t         *testing.T
+	url       string
+	sessionID string
+}
+
+// call sends a request and returns the result and arguments of the response.
+func (rc *rpcClient) call(method string, args interface{}) (string, map[string]interface{}) {
+	body, _ := json.Marshal(map[string]interface{}{"method": method, "arguments": args, "tag": 7})
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", rc.url, bytes.NewReader(body))
+		req.Header.Set(SessionIDHeader, rc.sessionID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			rc.t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusConflict {
+			rc.sessionID = resp.Header.Get(SessionIDHeader)
+			resp.Body.Close()
+			continue
+		}
+		var r struct {
+			Result    string                 `json:"result"`
+			Arguments map[string]interface{} `json:"arguments"`
+			Tag       int                    `json:"tag"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		if err != nil {
+			rc.t.Fatal(err)
+		}
+		if r.Tag != 7 {
+			rc.t.Errorf("got tag %d, want 7", r.Tag)
+		}
+		return r.Result, r.Arguments
+	}
+	rc.t.Fatal("no session id")
+	return "", nil
+}
+
+// torrents returns the torrents of a torrent-get response.
+func torrents(args map[string]interface{}) []map[string]interface{} {
+	var list []map[string]interface{}
+	for _, t := range args["torrents"].([]interface{}) {
+		list = append(list, t.(map[string]interface{}))
+	}
+	return list
+}
+
+func TestHandshake(t *testing.T) {
+	assert := assert.New(t)
+	c, err := client.NewClient(&client.Config{ListenAddr: "127.0.0.1:0"})
+	assert.Nil(err)
+	defer c.Close()
+	ts := httptest.NewServer(NewHandler(c, "user", "pass"))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL, "application/json", bytes.NewReader([]byte(`{"method":"session-get"}`)))
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest("POST", ts.URL, bytes.NewReader([]byte(`{"method":"session-get"}`)))
+	req.SetBasicAuth("user", "pass")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+	id := resp.Header.Get(SessionIDHeader)
+	assert.NotEqual("", id)
+
+	req, _ = http.NewRequest("POST", ts.URL, bytes.NewReader([]byte(`{"method":"session-get","arguments":{"fields":["rpc-version","session-id"]}}`)))
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set(SessionIDHeader, id)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.JSONEq(`{"result":"success","arguments":{"rpc-version":17,"session-id":"`+id+`"}}`, string(body))
+}
+
+func TestHost(t *testing.T) {
+	assert := assert.New(t)
+	c, err := client.NewClient(&client.Config{ListenAddr: "127.0.0.1:0"})
+	assert.Nil(err)
+	defer c.Close()
+
+	status := func(h *Handler, host string) int {
+		req := httptest.NewRequest("POST", "/transmission/rpc", bytes.NewReader([]byte(`{"method":"session-get"}`)))
+		req.Host = host
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	// Without credentials, only IP addresses, localhost and the allowed names are served.
+	h := NewHandler(c, "", "", "nas.lan")
+	for _, host := range []string{"127.0.0.1:9091", "[::1]:9091", "192.168.1.5", "localhost:9091", "LocalHost.", "nas.lan:9091", "NAS.lan."} {
+		assert.Equal(http.StatusConflict, status(h, host), host)
+	}
+	for _, host := range []string{"evil.example:9091", "evil.example", "localhost.evil.example", ""} {
+		assert.Equal(http.StatusMisdirectedRequest, status(h, host), host)
+	}
+	// With them, any host is.
+	h = NewHandler(c, "user", "pass")
+	assert.Equal(http.StatusConflict, status(h, "evil.example:9091"))
+}
+
+func TestSession(t *testing.T) {
+	assert := assert.New(t)
+	c, err := client.NewClient(&client.Config{ListenAddr: "127.0.0.1:0"})
+	assert.Nil(err)
+	defer c.Close()
+	ts := httptest.NewServer(NewHandler(c, "", ""))
+	defer ts.Close()
+	rc := &rpcClient{t: t, url: ts.URL}
+
+	result, args := rc.call("session-get", nil)
+	assert.Equal("success", result)
+	assert.Equal(float64(rpcVersion), args["rpc-version"])
+	assert.Equal(false, args["speed-limit-down-enabled"])
+
+	result, _ = rc.call("session-set", map[string]interface{}{"speed-limit-down": 100, "speed-limit-down-enabled": true, "speed-limit-up": 20})
+	assert.Equal("success", result)
+	up, down := c.RateLimits()
+	assert.Equal([]int64{0, 100000}, []int64{up, down})
+	_, args = rc.call("session-get", map[string]interface{}{"fields": []string{"speed-limit-down", "speed-limit-down-enabled", "speed-limit-up", "speed-limit-up-enabled"}})
+	assert.Equal(map[string]interface{}{"speed-limit-down": 100.0, "speed-limit-down-enabled": true, "speed-limit-up": 20.0, "speed-limit-up-enabled": false}, args)
+
+	// Turning a limit off and on again brings it back.
+	rc.call("session-set", map[string]interface{}{"speed-limit-down-enabled": false})
+	up, down = c.RateLimits()
+	assert.Equal([]int64{0, 0}, []int64{up, down})
+	_, args = rc.call("session-get", map[string]interface{}{"fields": []string{"speed-limit-down", "speed-limit-down-enabled"}})
+	assert.Equal(map[string]interface{}{"speed-limit-down": 100.0, "speed-limit-down-enabled": false}, args)
+	rc.call("session-set", map[string]interface{}{"speed-limit-down-enabled": true})
+	up, down = c.RateLimits()
+	assert.Equal([]int64{0, 100000}, []int64{up, down})
+
+	result, _ = rc.call("session-set", map[string]interface{}{"speed-limit-up": -1})
+	assert.NotEqual("success", result)
+	result, _ = rc.call("torrent-verify", nil)
+	assert.Equal(ErrUnknownMethod.Error(), result)
+
+	result, args = rc.call("session-stats", nil)
+	assert.Equal("success", result)
+	assert.Equal(0.0, args["torrentCount"])
+}
+
+func TestTorrents(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 100000)
+	rand.Read(data)
+	c, seeded := testclient.Seed(t, "seeded.bin", data)
+	seededHash := hex.EncodeToString([]byte(seeded.InfoHash()))
+	defer c.Close()
+	ts := httptest.NewServer(NewHandler(c, "", ""))
+	defer ts.Close()
+	rc := &rpcClient{t: t, url: ts.URL}
+
+	fields := []string{"id", "hashString", "name", "status", "percentDone", "totalSize", "leftUntilDone", "files", "fileStats", "wanted", "priorities", "downloadLimited", "trackers"}
+	result, args := rc.call("torrent-get", map[string]interface{}{"fields": fields})
+	assert.Equal("success", result)
+	list := torrents(args)
+	if assert.Equal(1, len(list)) {
+		assert.Equal(map[string]interface{}{
+			"id":              1.0,
+			"hashString":      seededHash,
+			"name":            "seeded.bin",
+			"status":          float64(statusSeeding),
+			"percentDone":     1.0,
+			"totalSize":       100000.0,
+			"leftUntilDone":   0.0,
+			"files":           []interface{}{map[string]interface{}{"name": "seeded.bin", "length": 100000.0, "bytesCompleted": 100000.0}},
+			"fileStats":       []interface{}{map[string]interface{}{"bytesCompleted": 100000.0, "wanted": true, "priority": 0.0}},
+			"wanted":          []interface{}{1.0},
+			"priorities":      []interface{}{0.0},
+			"downloadLimited": false,
+			"trackers":        []interface{}{},
+		}, list[0])
+	}
+
+	// A multi-file torrent added paused from its metainfo.
+	files := []testtorrent.File{
+		{Path: []string{"a.bin"}, Data: make([]byte, 20000)},
+		{Path: []string{"b.bin"}, Data: make([]byte, 30000)},
+	}
+	metainfo, infoHash := testtorrent.MakeMultiFile("multi", files, 1<<14, nil)
+	hash := hex.EncodeToString([]byte(infoHash))
+	add := map[string]interface{}{"metainfo": base64.StdEncoding.EncodeToString(metainfo), "paused": true}
+	result, args = rc.call("torrent-add", add)
+	assert.Equal("success", result)
+	assert.Equal(map[string]interface{}{"id": 2.0, "name": "multi", "hashString": hash}, args["torrent-added"])
+	_, args = rc.call("torrent-add", add)
+	assert.Equal(map[string]interface{}{"id": 2.0, "name": "multi", "hashString": hash}, args["torrent-duplicate"])
+	result, _ = rc.call("torrent-add", map[string]interface{}{"filename": "magnet:?xt=urn:btih:" + hash, "download-dir": "/elsewhere"})
+	assert.NotEqual("success", result)
+
+	result, _ = rc.call("torrent-set", map[string]interface{}{"ids": []interface{}{hash}, "files-unwanted": []int{1}, "priority-high": []int{}, "downloadLimit": 50, "downloadLimited": true})
+	assert.Equal("success", result)
+	_, args = rc.call("torrent-get", map[string]interface{}{"ids": 2, "fields": []string{"status", "wanted", "priorities", "sizeWhenDone", "downloadLimit", "downloadLimited"}})
+	assert.Equal([]map[string]interface{}{{
+		"status":          float64(statusStopped),
+		"wanted":          []interface{}{1.0, 0.0},
+		"priorities":      []interface{}{1.0, 0.0},
+		"sizeWhenDone":    20000.0,
+		"downloadLimit":   50.0,
+		"downloadLimited": true,
+	}}, torrents(args))
+	tor, _ := c.Torrent(infoHash)
+	assert.Equal([]client.Priority{client.PriorityHigh, client.PrioritySkip}, tor.FilePriorities())
+	_, down := tor.RateLimits()
+	assert.Equal(int64(50000), down)
+	result, _ = rc.call("torrent-set", map[string]interface{}{"ids": 2, "files-wanted": []int{5}})
+	assert.NotEqual("success", result)
+
+	// Stopping and starting.
+	rc.call("torrent-stop", map[string]interface{}{"ids": 1})
+	_, args = rc.call("torrent-get", map[string]interface{}{"ids": []int{1}, "fields": []string{"status"}})
+	assert.Equal([]map[string]interface{}{{"status": float64(statusStopped)}}, torrents(args))
+	rc.call("torrent-start", map[string]interface{}{"ids": []int{1}})
+	_, args = rc.call("torrent-get", map[string]interface{}{"ids": []int{1}, "fields": []string{"status"}, "format": "table"})
+	assert.Equal([]interface{}{[]interface{}{"status"}, []interface{}{float64(statusSeeding)}}, args["torrents"])
+
+	_, args = rc.call("session-stats", nil)
+	assert.Equal(2.0, args["torrentCount"])
+	assert.Equal(1.0, args["activeTorrentCount"])
+
+	result, _ = rc.call("torrent-remove", map[string]interface{}{"ids": []int{2}, "delete-local-data": true})
+	assert.Equal("success", result)
+	_, ok := c.Torrent(infoHash)
+	assert.False(ok)
+	_, args = rc.call("torrent-get", map[string]interface{}{"fields": []string{"id"}})
+	assert.Equal([]map[string]interface{}{{"id": 1.0}}, torrents(args))
+}
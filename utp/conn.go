@@ -0,0 +1,721 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPayload keeps packets within the MTU of most paths.
+	maxPayload = 1400 - headerSize
+	// maxRecvBuffer is the most data we buffer for the reader, which is the window we advertise.
+	maxRecvBuffer = 1 << 20
+	// maxSendBuffer is the most written data waiting to go out before Write blocks.
+	maxSendBuffer = 1 << 20
+
+	// LEDBAT parameters: the queuing delay we aim for and how fast the window may grow.
+	targetDelay          = 100000 // µs
+	maxCwndIncreasePerRT = 3000
+	minCwnd              = 2 * maxPayload
+	maxCwnd              = maxRecvBuffer
+	baseDelayInterval    = time.Minute
+
+	minTimeout  = 500 * time.Millisecond
+	maxTimeout  = 8 * time.Second
+	initTimeout = time.Second
+	// maxTimeouts is how many timeouts in a row we take before giving up on the peer.
+	maxTimeouts = 8
+	// dupAckThreshold is how many packets past a missing one have to be acked before it's
+	// considered lost.
+	dupAckThreshold = 3
+	// maxSackSize is the largest selective ack bitmask we send.
+	maxSackSize = 64
+)
+
+var (
+	// ErrConnReset is returned when the peer reset the connection.
+	ErrConnReset = errors.New("utp: connection reset by peer")
+	// ErrTimeout is returned when the peer stopped acknowledging what we send.
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+type connState int
+
+const (
+	stateNew connState = iota
+	stateSynSent
+	stateConnected
+)
+
+// outPacket is a packet we've sent that hasn't been acknowledged yet.
+type outPacket struct {
+	typ           uint8
+	seq           uint16
+	payload       []byte
+	sent          time.Time
+	transmissions int
+	acked         bool
+	fastResent    bool
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	recvID uint16
+	sendID uint16
+
+	connected chan struct{} // Closed once the handshake is done.
+	done      chan struct{} // Closed once the connection failed.
+
+	mu       sync.Mutex
+	state    connState
+	err      error // Why the connection failed.
+	closed   bool  // Close has been called.
+	synSent  time.Time
+	synTries int
+
+	// Sending.
+	seq           uint16 // Next sequence number to send.
+	unsent        []byte // Written data not yet sent.
+	finPending    bool   // A FIN goes out once unsent is empty.
+	finSent       bool
+	inflight      []*outPacket // Unacknowledged packets in sequence order.
+	inflightBytes int
+	lastAck       uint16
+	dupAcks       int
+	cwnd          int
+	peerWnd       int
+	rtt, rttVar   time.Duration
+	rto           time.Duration
+	timeouts      int
+	cutSeq        uint16 // The window is halved at most once until this sequence number is acked.
+
+	// LEDBAT delay tracking, in µs.
+	replyMicro     uint32 // How long the peer's last packet took to reach us, echoed back.
+	baseDelay      uint32
+	prevBaseDelay  uint32
+	baseDelayValid bool
+	baseDelayReset time.Time
+
+	// Receiving.
+	ack        uint16            // Last sequence number received in order.
+	readBuf    []byte            // Data ready for Read.
+	outOfOrder map[uint16][]byte // Packets received past ack, FINs as empty payloads.
+	oooBytes   int
+	gotFin     bool
+	finSeq     uint16
+	eof        bool // Everything up to the peer's FIN has been received.
+
+	readable      chan struct{}
+	writable      chan struct{}
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:              s,
+		raddr:          raddr,
+		recvID:         recvID,
+		sendID:         sendID,
+		connected:      make(chan struct{}),
+		done:           make(chan struct{}),
+		cwnd:           minCwnd,
+		peerWnd:        maxPayload,
+		rto:            initTimeout,
+		outOfOrder:     make(map[uint16][]byte),
+		readable:       make(chan struct{}, 1),
+		writable:       make(chan struct{}, 1),
+		baseDelayReset: time.Now(),
+	}
+}
+
+// epoch is what our timestamps count from.
+var epoch = time.Now()
+
+func nowMicro() uint32 {
+	return uint32(time.Since(epoch) / time.Microsecond)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Read reads data from the connection. It returns io.EOF once the peer has closed its side and
+// everything it sent has been read.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.readBuf) > 0 {
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		var err error
+		switch {
+		case c.closed:
+			err = net.ErrClosed
+		case c.eof:
+			err = io.EOF
+		case c.err != nil:
+			err = c.err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := wait(c.readable, c.done, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to the connection. It blocks while the send buffer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		c.mu.Lock()
+		var err error
+		switch {
+		case c.closed:
+			err = net.ErrClosed
+		case c.err != nil:
+			err = c.err
+		}
+		if err != nil {
+			c.mu.Unlock()
+			return written, err
+		}
+		if space := maxSendBuffer - len(c.unsent); space > 0 {
+			n := len(b) - written
+			if n > space {
+				n = space
+			}
+			c.unsent = append(c.unsent, b[written:written+n]...)
+			written += n
+			c.flush()
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+		if written == len(b) {
+			return written, nil
+		}
+		if err := wait(c.writable, c.done, deadline); err != nil {
+			return written, err
+		}
+	}
+}
+
+// wait blocks until ch is signalled, done is closed or the deadline passes.
+func wait(ch chan struct{}, done chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+	case <-done:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Close sends whatever has been written and closes the connection. Pending reads and writes are
+// unblocked with an error.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	if c.state == stateConnected && c.err == nil {
+		// The connection lingers until the FIN is acknowledged or times out.
+		c.finPending = true
+		c.flush()
+		c.mu.Unlock()
+	} else {
+		c.mu.Unlock()
+		c.fail(net.ErrClosed)
+	}
+	notify(c.readable)
+	notify(c.writable)
+	return nil
+}
+
+// LocalAddr returns the address of the socket.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for Read calls, including ones already blocked.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls, including ones already blocked.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
+
+// fail tears the connection down with err.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.mu.Unlock()
+	c.s.remove(c)
+}
+
+func (c *Conn) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// sendSyn starts or retries the handshake of an outgoing connection.
+func (c *Conn) sendSyn() {
+	c.state = stateSynSent
+	c.seq = 1
+	c.synSent = time.Now()
+	c.synTries++
+	c.s.send(&packet{typ: stSyn, connID: c.recvID, timestamp: nowMicro(), wnd: c.window(), seq: c.seq}, c.raddr)
+}
+
+// sendState acknowledges what we've received, including packets past a gap.
+func (c *Conn) sendState() {
+	p := c.header(stState)
+	p.sack = c.selectiveAck()
+	c.s.send(p, c.raddr)
+}
+
+// header returns a packet of type typ with the current acknowledgement and window.
+func (c *Conn) header(typ uint8) *packet {
+	return &packet{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     nowMicro(),
+		timestampDiff: c.replyMicro,
+		wnd:           c.window(),
+		seq:           c.seq,
+		ack:           c.ack,
+	}
+}
+
+// window returns how much more data we're willing to buffer.
+func (c *Conn) window() uint32 {
+	free := maxRecvBuffer - len(c.readBuf) - c.oooBytes
+	if free < 0 {
+		free = 0
+	}
+	return uint32(free)
+}
+
+// selectiveAck returns the bitmask of packets received past a gap, or nil if there's no gap.
+func (c *Conn) selectiveAck() []byte {
+	if len(c.outOfOrder) == 0 {
+		return nil
+	}
+	// Bit i stands for packet ack+2+i.
+	bits := 0
+	for seq := range c.outOfOrder {
+		if n := int(seq - c.ack - 1); n > bits {
+			bits = n
+		}
+	}
+	size := (bits + 31) / 32 * 4
+	if size > maxSackSize {
+		size = maxSackSize
+	}
+	mask := make([]byte, size)
+	for seq := range c.outOfOrder {
+		i := int(seq - c.ack - 2)
+		if i >= 0 && i < size*8 {
+			mask[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return mask
+}
+
+// flush sends as much unsent data as the congestion and receive windows allow, followed by a FIN
+// if the connection is closing.
+func (c *Conn) flush() {
+	if c.state != stateConnected || c.err != nil {
+		return
+	}
+	window := c.cwnd
+	if c.peerWnd < window {
+		window = c.peerWnd
+	}
+	for len(c.unsent) > 0 {
+		n := len(c.unsent)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		// Something is always allowed in flight so a zero window gets probed.
+		if c.inflightBytes > 0 && c.inflightBytes+n > window {
+			return
+		}
+		payload := append([]byte(nil), c.unsent[:n]...)
+		c.unsent = c.unsent[n:]
+		if len(c.unsent) == 0 {
+			c.unsent = nil
+		}
+		c.transmit(&outPacket{typ: stData, seq: c.seq, payload: payload})
+		notify(c.writable)
+	}
+	if c.finPending && !c.finSent {
+		c.finSent = true
+		c.transmit(&outPacket{typ: stFin, seq: c.seq})
+	}
+}
+
+// transmit sends a new packet and keeps it until it's acknowledged.
+func (c *Conn) transmit(op *outPacket) {
+	c.seq++
+	c.inflight = append(c.inflight, op)
+	c.inflightBytes += len(op.payload)
+	c.resend(op)
+}
+
+func (c *Conn) resend(op *outPacket) {
+	p := c.header(op.typ)
+	p.seq = op.seq
+	p.payload = op.payload
+	op.sent = time.Now()
+	op.transmissions++
+	c.s.send(p, c.raddr)
+}
+
+// handle processes a packet from the peer.
+func (c *Conn) handle(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	switch p.typ {
+	case stReset:
+		c.mu.Unlock()
+		c.fail(ErrConnReset)
+		c.mu.Lock()
+		return
+	case stSyn:
+		if c.state == stateNew {
+			var b [2]byte
+			rand.Read(b[:])
+			c.seq = binary.BigEndian.Uint16(b[:])
+			c.ack = p.seq
+			c.lastAck = c.seq - 1
+			c.state = stateConnected
+			close(c.connected)
+		}
+		// Retransmitted SYNs mean our answer got lost.
+		c.replyMicro = nowMicro() - p.timestamp
+		c.peerWnd = int(p.wnd)
+		c.sendState()
+		c.flush()
+		return
+	}
+	c.replyMicro = nowMicro() - p.timestamp
+	c.peerWnd = int(p.wnd)
+	if c.state == stateSynSent {
+		if p.typ != stState || p.ack != c.seq {
+			return
+		}
+		// The answer to our SYN: the peer's first data packet will carry this sequence number.
+		c.ack = p.seq - 1
+		c.seq++
+		c.lastAck = p.ack
+		c.state = stateConnected
+		close(c.connected)
+	} else if c.state != stateConnected {
+		return
+	}
+
+	c.processAck(p)
+	if p.typ == stData || p.typ == stFin {
+		c.receive(p)
+		c.sendState()
+	}
+	c.flush()
+	if c.closed && c.finSent && len(c.inflight) == 0 {
+		// Everything including our FIN has been delivered.
+		c.mu.Unlock()
+		c.fail(net.ErrClosed)
+		c.mu.Lock()
+	}
+}
+
+// processAck drops the packets the peer acknowledged, detects losses and adjusts the window.
+func (c *Conn) processAck(p *packet) {
+	now := time.Now()
+	acked := 0
+	ackOne := func(op *outPacket) {
+		if op.acked {
+			return
+		}
+		op.acked = true
+		acked += len(op.payload)
+		c.inflightBytes -= len(op.payload)
+		if op.transmissions == 1 {
+			c.updateRTT(now.Sub(op.sent))
+		}
+	}
+	for _, op := range c.inflight {
+		if seqLess(p.ack, op.seq) {
+			break
+		}
+		ackOne(op)
+	}
+	for len(c.inflight) > 0 && c.inflight[0].acked {
+		c.inflight = c.inflight[1:]
+	}
+	// Packets in flight have consecutive sequence numbers, so they can be found by offset.
+	for i := 0; i < len(p.sack)*8 && len(c.inflight) > 0; i++ {
+		if p.sack[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+		if j := int(p.ack + 2 + uint16(i) - c.inflight[0].seq); j >= 0 && j < len(c.inflight) {
+			ackOne(c.inflight[j])
+		}
+	}
+	if acked > 0 {
+		c.timeouts = 0
+		c.dupAcks = 0
+	} else if p.typ == stState && p.ack == c.lastAck && len(c.inflight) > 0 {
+		c.dupAcks++
+	}
+	c.lastAck = p.ack
+	if p.timestampDiff != 0 {
+		c.updateBaseDelay(p.timestampDiff, now)
+	}
+	if acked > 0 {
+		c.congestionControl(acked, p.timestampDiff)
+	}
+
+	// A packet is lost once enough packets sent after it got through.
+	var lost []*outPacket
+	later := 0
+	for i := len(c.inflight) - 1; i >= 0; i-- {
+		op := c.inflight[i]
+		if op.acked {
+			later++
+			continue
+		}
+		if op.fastResent {
+			continue
+		}
+		if later >= dupAckThreshold || (i == 0 && c.dupAcks >= dupAckThreshold) {
+			lost = append(lost, op)
+		}
+	}
+	for i := len(lost) - 1; i >= 0; i-- {
+		lost[i].fastResent = true
+		c.lossDetected()
+		c.resend(lost[i])
+	}
+	if acked > 0 {
+		notify(c.writable)
+	}
+}
+
+// lossDetected halves the window, at most once per window of data.
+func (c *Conn) lossDetected() {
+	if len(c.inflight) > 0 && seqLess(c.inflight[0].seq, c.cutSeq) {
+		return
+	}
+	c.cutSeq = c.seq
+	c.cwnd /= 2
+	if c.cwnd < minCwnd {
+		c.cwnd = minCwnd
+	}
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minTimeout {
+		c.rto = minTimeout
+	}
+}
+
+// updateBaseDelay tracks the lowest delay seen over the last couple of minutes, which is taken to
+// be the delay without any queuing.
+func (c *Conn) updateBaseDelay(delay uint32, now time.Time) {
+	if now.Sub(c.baseDelayReset) > baseDelayInterval {
+		c.prevBaseDelay = c.baseDelay
+		c.baseDelay = delay
+		c.baseDelayReset = now
+	}
+	if !c.baseDelayValid {
+		c.baseDelay, c.prevBaseDelay, c.baseDelayValid = delay, delay, true
+	}
+	if int32(delay-c.baseDelay) < 0 {
+		c.baseDelay = delay
+	}
+}
+
+// congestionControl grows or shrinks the window depending on how far the queuing delay our packets
+// see is from the target (LEDBAT).
+func (c *Conn) congestionControl(acked int, delay uint32) {
+	offTarget := 1.0
+	if delay != 0 && c.baseDelayValid {
+		base := c.baseDelay
+		if int32(c.prevBaseDelay-base) < 0 {
+			base = c.prevBaseDelay
+		}
+		ourDelay := int64(int32(delay - base))
+		if ourDelay < 0 {
+			ourDelay = 0
+		}
+		offTarget = float64(targetDelay-ourDelay) / targetDelay
+	}
+	windowFactor := float64(acked) / float64(c.cwnd)
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	c.cwnd += int(maxCwndIncreasePerRT * windowFactor * offTarget)
+	if c.cwnd < minCwnd {
+		c.cwnd = minCwnd
+	}
+	if c.cwnd > maxCwnd {
+		c.cwnd = maxCwnd
+	}
+}
+
+// receive delivers a data or FIN packet in order, holding on to packets that arrive early.
+func (c *Conn) receive(p *packet) {
+	if c.gotFin && seqLess(c.finSeq, p.seq) {
+		return
+	}
+	if p.typ == stFin {
+		c.gotFin = true
+		c.finSeq = p.seq
+	}
+	if p.seq != c.ack+1 {
+		if seqLess(c.ack, p.seq) && int(p.seq-c.ack) < maxRecvBuffer/maxPayload {
+			if _, ok := c.outOfOrder[p.seq]; !ok && c.oooBytes+len(p.payload) <= maxRecvBuffer {
+				c.outOfOrder[p.seq] = p.payload
+				c.oooBytes += len(p.payload)
+			}
+		}
+		return
+	}
+	c.readBuf = append(c.readBuf, p.payload...)
+	c.ack++
+	for {
+		payload, ok := c.outOfOrder[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.outOfOrder, c.ack+1)
+		c.oooBytes -= len(payload)
+		c.readBuf = append(c.readBuf, payload...)
+		c.ack++
+	}
+	if c.gotFin && c.ack == c.finSeq {
+		c.eof = true
+	}
+	notify(c.readable)
+}
+
+// tick retransmits what has timed out.
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	var err error
+	switch {
+	case c.err != nil:
+	case c.state == stateSynSent:
+		if now.Sub(c.synSent) > c.rto {
+			if c.synTries >= maxTimeouts/2 {
+				err = ErrTimeout
+				break
+			}
+			c.rto *= 2
+			c.sendSyn()
+		}
+	case len(c.inflight) > 0:
+		var oldest *outPacket
+		for _, op := range c.inflight {
+			if !op.acked {
+				oldest = op
+				break
+			}
+		}
+		if oldest == nil || now.Sub(oldest.sent) < c.rto {
+			break
+		}
+		c.timeouts++
+		if c.timeouts > maxTimeouts {
+			err = ErrTimeout
+			break
+		}
+		c.rto *= 2
+		if c.rto > maxTimeout {
+			c.rto = maxTimeout
+		}
+		c.cwnd = minCwnd
+		c.cutSeq = c.seq
+		c.resend(oldest)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+}
@@ -0,0 +1,100 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Packet types.
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+	// extSelectiveAck is the extension carrying a bitmask of packets received past ack.
+	extSelectiveAck = 1
+)
+
+var errMalformedPacket = errors.New("utp: malformed packet")
+
+// packet is a uTP packet. Timestamps are in microseconds.
+type packet struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wnd           uint32
+	seq           uint16
+	ack           uint16
+	// sack has bit i set if packet ack+2+i was received. Its length is a multiple of 4.
+	sack    []byte
+	payload []byte
+}
+
+func (p *packet) marshal() []byte {
+	size := headerSize + len(p.payload)
+	if p.sack != nil {
+		size += 2 + len(p.sack)
+	}
+	b := make([]byte, headerSize, size)
+	b[0] = p.typ<<4 | version
+	if p.sack != nil {
+		b[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(b[2:], p.connID)
+	binary.BigEndian.PutUint32(b[4:], p.timestamp)
+	binary.BigEndian.PutUint32(b[8:], p.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:], p.wnd)
+	binary.BigEndian.PutUint16(b[16:], p.seq)
+	binary.BigEndian.PutUint16(b[18:], p.ack)
+	if p.sack != nil {
+		b = append(b, 0, byte(len(p.sack)))
+		b = append(b, p.sack...)
+	}
+	return append(b, p.payload...)
+}
+
+// unmarshal parses a packet. The payload is copied, so b may be reused.
+func unmarshal(b []byte) (*packet, error) {
+	if len(b) < headerSize || b[0]&0x0f != version || b[0]>>4 > stSyn {
+		return nil, errMalformedPacket
+	}
+	p := &packet{
+		typ:           b[0] >> 4,
+		connID:        binary.BigEndian.Uint16(b[2:]),
+		timestamp:     binary.BigEndian.Uint32(b[4:]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:]),
+		wnd:           binary.BigEndian.Uint32(b[12:]),
+		seq:           binary.BigEndian.Uint16(b[16:]),
+		ack:           binary.BigEndian.Uint16(b[18:]),
+	}
+	ext := b[1]
+	b = b[headerSize:]
+	for ext != 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errMalformedPacket
+		}
+		next, data := b[0], b[2:2+int(b[1])]
+		if ext == extSelectiveAck {
+			if len(data) == 0 || len(data)%4 != 0 {
+				return nil, errMalformedPacket
+			}
+			p.sack = append([]byte(nil), data...)
+		}
+		// Unknown extensions are skipped.
+		ext, b = next, b[2+len(data):]
+	}
+	p.payload = append([]byte(nil), b...)
+	return p, nil
+}
+
+// seqLess returns whether sequence number a comes before b, allowing for wraparound.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
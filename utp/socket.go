@@ -0,0 +1,310 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), a reliable stream protocol over
+// UDP with delay based congestion control. A Socket owns a UDP socket and is both a net.Listener
+// for incoming connections and a dialer for outgoing ones. Packets that aren't uTP can be handed to
+// another protocol sharing the socket, such as the DHT.
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// acceptBacklog is the number of incoming connections waiting for Accept before more are
+	// reset.
+	acceptBacklog = 32
+	// tickInterval is how often connections check their timers.
+	tickInterval = 50 * time.Millisecond
+	// maxPacketSize is the size of the largest UDP datagram we read.
+	maxPacketSize = 1 << 16
+)
+
+// ErrSocketClosed is returned by Accept and Dial once the socket has been closed.
+var ErrSocketClosed = errors.New("utp: socket closed")
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket.
+type Socket struct {
+	pc      net.PacketConn
+	backlog chan *Conn
+	closing chan struct{}
+	once    sync.Once
+	wake    chan struct{} // Signalled when a connection is added.
+
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	err     error
+	handler func(b []byte, addr net.Addr)
+}
+
+// Listen opens a UDP socket on addr and returns a Socket using it. network must be "udp", "udp4"
+// or "udp6".
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket returns a Socket using pc. The Socket takes pc over and reads from it until closed.
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:      pc,
+		backlog: make(chan *Conn, acceptBacklog),
+		closing: make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+		conns:   make(map[connKey]*Conn),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// HandleOther sets a function that is handed every datagram that isn't a uTP packet. b is only
+// valid until the function returns.
+func (s *Socket) HandleOther(f func(b []byte, addr net.Addr)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = f
+}
+
+// WriteTo sends a datagram that isn't part of a uTP connection over the socket.
+func (s *Socket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return s.pc.WriteTo(b, addr)
+}
+
+// Accept waits for and returns the next incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.closing:
+		return nil, ErrSocketClosed
+	}
+}
+
+// Addr returns the address of the UDP socket.
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the UDP socket and every connection using it.
+func (s *Socket) Close() error {
+	err := ErrSocketClosed
+	s.once.Do(func() {
+		close(s.closing)
+		err = s.pc.Close()
+	})
+	return err
+}
+
+// Dial connects to the uTP peer at addr.
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to the uTP peer at addr. The connection attempt is abandoned when ctx is
+// done.
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.newConn(raddr)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.sendSyn()
+	c.mu.Unlock()
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, c.failure()
+	case <-ctx.Done():
+		c.fail(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// newConn registers an outgoing connection to raddr with a free connection ID.
+func (s *Socket) newConn(raddr *net.UDPAddr) (*Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	for {
+		var b [2]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		id := binary.BigEndian.Uint16(b[:])
+		// Our peer will receive on id+1, so neither may be taken.
+		if s.conns[connKey{raddr.String(), id}] != nil || s.conns[connKey{raddr.String(), id + 1}] != nil {
+			continue
+		}
+		c := newConn(s, raddr, id, id+1)
+		s.add(connKey{raddr.String(), id}, c)
+		return c, nil
+	}
+}
+
+// add registers a connection under key, waking the tick loop. s.mu must be held.
+func (s *Socket) add(key connKey, c *Conn) {
+	s.conns[key] = c
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// remove forgets a connection that has finished.
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) send(p *packet, addr net.Addr) {
+	s.pc.WriteTo(p.marshal(), addr)
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.shutdown()
+			return
+		}
+		p, err := unmarshal(buf[:n])
+		if err != nil {
+			s.mu.Lock()
+			handler := s.handler
+			s.mu.Unlock()
+			if handler != nil {
+				handler(buf[:n], addr)
+			}
+			continue
+		}
+		s.dispatch(p, addr)
+	}
+}
+
+// dispatch hands a packet to the connection it belongs to, setting up new connections for SYNs.
+func (s *Socket) dispatch(p *packet, addr net.Addr) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	a := addr.String()
+	var c *Conn
+	switch p.typ {
+	case stSyn:
+		// The initiator receives on the ID it sent, we receive on the next one.
+		c = s.conns[connKey{a, p.connID + 1}]
+		if c == nil {
+			c = newConn(s, addr, p.connID+1, p.connID)
+			select {
+			case s.backlog <- c:
+				s.add(connKey{a, p.connID + 1}, c)
+			default:
+				s.mu.Unlock()
+				s.send(&packet{typ: stReset, connID: p.connID, ack: p.seq}, addr)
+				return
+			}
+		}
+	case stReset:
+		// Resets may carry either of the connection's IDs.
+		c = s.conns[connKey{a, p.connID}]
+		if c == nil {
+			c = s.conns[connKey{a, p.connID - 1}]
+		}
+		if c == nil {
+			c = s.conns[connKey{a, p.connID + 1}]
+		}
+	default:
+		c = s.conns[connKey{a, p.connID}]
+	}
+	s.mu.Unlock()
+	if c == nil {
+		if p.typ != stReset {
+			s.send(&packet{typ: stReset, connID: p.connID, ack: p.seq}, addr)
+		}
+		return
+	}
+	c.handle(p)
+}
+
+// tickLoop has the connections check their timers. The socket sits idle while it has none, until
+// one is added.
+func (s *Socket) tickLoop() {
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-s.wake:
+		}
+		if !s.tickConns() {
+			return
+		}
+	}
+}
+
+// tickConns ticks the connections every tickInterval until there are none left. It returns false
+// if the socket was closed.
+func (s *Socket) tickConns() bool {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return false
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			if len(conns) == 0 {
+				return true
+			}
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
+
+// shutdown fails every connection once the UDP socket is gone.
+func (s *Socket) shutdown() {
+	s.Close()
+	s.mu.Lock()
+	s.err = ErrSocketClosed
+	conns := s.conns
+	s.conns = make(map[connKey]*Conn)
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.fail(ErrSocketClosed)
+	}
+}
@@ -0,0 +1,215 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSocket(t *testing.T) *Socket {
+	s, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// lossyConn drops every nth datagram written and holds back every mth one until the next write,
+// reordering it.
+type lossyConn struct {
+	net.PacketConn
+	n, m int
+
+	mu      sync.Mutex
+	count   int
+	delayed []byte
+	addr    net.Addr
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count++
+	if c.count%c.n == 0 {
+		return len(b), nil
+	}
+	if c.count%c.m == 0 && c.delayed == nil {
+		c.delayed, c.addr = append([]byte(nil), b...), addr
+		return len(b), nil
+	}
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if c.delayed != nil {
+		c.PacketConn.WriteTo(c.delayed, c.addr)
+		c.delayed = nil
+	}
+	return n, err
+}
+
+func transfer(t *testing.T, a, b *Socket, size int) {
+	assert := assert.New(t)
+	data := make([]byte, size)
+	rand.Read(data)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := b.Accept()
+		assert.Nil(err)
+		accepted <- conn
+	}()
+	ca, err := a.Dial(b.Addr().String())
+	if !assert.Nil(err) {
+		return
+	}
+	cb := <-accepted
+	go func() {
+		n, err := ca.Write(data)
+		assert.Nil(err)
+		assert.Equal(len(data), n)
+		assert.Nil(ca.Close())
+	}()
+	cb.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := ioutil.ReadAll(cb)
+	assert.Nil(err)
+	assert.True(bytes.Equal(data, got), "received %d of %d bytes", len(got), len(data))
+	assert.Nil(cb.Close())
+}
+
+func TestTransfer(t *testing.T) {
+	a, b := newSocket(t), newSocket(t)
+	defer a.Close()
+	defer b.Close()
+	transfer(t, a, b, 4<<20)
+	// Both sides can dial on the same sockets.
+	transfer(t, b, a, 100000)
+}
+
+func TestLossyTransfer(t *testing.T) {
+	pa, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewSocket(&lossyConn{PacketConn: pa, n: 10, m: 7})
+	b := NewSocket(&lossyConn{PacketConn: pb, n: 13, m: 11})
+	defer a.Close()
+	defer b.Close()
+	transfer(t, a, b, 1<<20)
+
+	// Once the connections are gone the sockets stop ticking, and start again for new ones, which
+	// need it to recover from losses.
+	idle := func(s *Socket) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.conns) == 0
+	}
+	for i := 0; i < 200 && !(idle(a) && idle(b)); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, idle(a) && idle(b))
+	transfer(t, b, a, 100000)
+}
+
+func TestReset(t *testing.T) {
+	assert := assert.New(t)
+	a, b := newSocket(t), newSocket(t)
+	defer a.Close()
+	go b.Accept()
+	ca, err := a.Dial(b.Addr().String())
+	assert.Nil(err)
+	// The peer forgets the connection, so it answers with a reset.
+	b.Close()
+	b2, err := Listen("udp", b.Addr().String())
+	if err != nil {
+		t.Skip("couldn't reopen socket:", err)
+	}
+	defer b2.Close()
+	ca.Write([]byte("hello"))
+	ca.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ca.Read(make([]byte, 1))
+	assert.Equal(ErrConnReset, err)
+}
+
+func TestDialTimeout(t *testing.T) {
+	assert := assert.New(t)
+	a := newSocket(t)
+	defer a.Close()
+	// Nothing answers from a socket that isn't speaking uTP.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = a.DialContext(ctx, pc.LocalAddr().String())
+	assert.Equal(context.DeadlineExceeded, err)
+}
+
+func TestDeadline(t *testing.T) {
+	assert := assert.New(t)
+	a, b := newSocket(t), newSocket(t)
+	defer a.Close()
+	defer b.Close()
+	go b.Accept()
+	ca, err := a.Dial(b.Addr().String())
+	assert.Nil(err)
+	ca.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = ca.Read(make([]byte, 1))
+	ne, ok := err.(net.Error)
+	assert.True(ok && ne.Timeout())
+	assert.Nil(ca.Close())
+	_, err = ca.Read(make([]byte, 1))
+	assert.Equal(net.ErrClosed, err)
+}
+
+func TestHandleOther(t *testing.T) {
+	assert := assert.New(t)
+	a := newSocket(t)
+	defer a.Close()
+	got := make(chan string, 1)
+	a.HandleOther(func(b []byte, addr net.Addr) {
+		got <- string(b)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.WriteTo([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"), a.Addr())
+	select {
+	case s := <-got:
+		assert.Equal("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe", s)
+	case <-time.After(5 * time.Second):
+		t.Fatal("datagram not delivered")
+	}
+}
+
+func TestPacket(t *testing.T) {
+	assert := assert.New(t)
+	p := &packet{typ: stState, connID: 1, timestamp: 2, timestampDiff: 3, wnd: 4, seq: 5, ack: 6,
+		sack: []byte{1, 2, 3, 4}, payload: []byte("data")}
+	got, err := unmarshal(p.marshal())
+	assert.Nil(err)
+	assert.Equal(p, got)
+	p.sack = nil
+	got, err = unmarshal(p.marshal())
+	assert.Nil(err)
+	assert.Equal(p, got)
+
+	_, err = unmarshal([]byte("short"))
+	assert.Equal(errMalformedPacket, err)
+	// Extension running past the end.
+	b := (&packet{typ: stData}).marshal()
+	b[1] = extSelectiveAck
+	_, err = unmarshal(append(b, 0, 8, 1))
+	assert.Equal(errMalformedPacket, err)
+}
@@ -0,0 +1,162 @@
+// Package watch adds the torrents dropped into a directory to a client. A .torrent file is added
+// as is, a .magnet file holds a magnet link. Once a file has been handled it's moved to the done
+// subdirectory, or to the failed one if it couldn't be added, so it isn't picked up again.
+package watch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/saicheems/gotorrent/client"
+)
+
+const (
+	// DoneDir and FailedDir are the subdirectories handled files are moved to.
+	DoneDir   = "done"
+	FailedDir = "failed"
+
+	// defaultInterval is how often the directory is scanned.
+	defaultInterval = 2 * time.Second
+	// defaultSettle is how long a file must go unmodified before it's picked up, so files that
+	// are still being written aren't read half way.
+	defaultSettle = time.Second
+)
+
+// Watcher adds the torrents in a directory to a client.
+type Watcher struct {
+	c   *client.Client
+	dir string
+	// Start starts the torrents once they're added, e.g. to select files first. They're started
+	// with Torrent.Start if it's nil.
+	Start func(t *client.Torrent) error
+
+	interval time.Duration
+	settle   time.Duration
+	log      *slog.Logger
+}
+
+// New returns a watcher adding the torrents in dir to c.
+func New(c *client.Client, dir string) *Watcher {
+	return &Watcher{
+		c:        c,
+		dir:      dir,
+		interval: defaultInterval,
+		settle:   defaultSettle,
+		log:      c.Config().Logger.With("subsystem", "watch", "dir", dir),
+	}
+}
+
+// Run scans the directory until ctx is cancelled. It only returns early if the directory can't be
+// set up.
+func (w *Watcher) Run(ctx context.Context) error {
+	for _, sub := range []string{DoneDir, FailedDir} {
+		if err := os.MkdirAll(filepath.Join(w.dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.Scan(ctx); err != nil {
+			w.log.Error("couldn't scan directory", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan handles the files in the directory once.
+func (w *Watcher) Scan(ctx context.Context) error {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if ctx.Err() != nil {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(fi.Name()))
+		if !fi.Mode().IsRegular() || (ext != ".torrent" && ext != ".magnet") {
+			continue
+		}
+		if time.Since(fi.ModTime()) < w.settle {
+			continue
+		}
+		w.handle(fi.Name())
+	}
+	return nil
+}
+
+// handle adds the torrent in the file name and moves it out of the way.
+func (w *Watcher) handle(name string) {
+	log := w.log.With("file", name)
+	t, err := w.add(filepath.Join(w.dir, name))
+	sub := DoneDir
+	switch {
+	case err == client.ErrDuplicateTorrent:
+		log.Info("torrent already added", "torrent", t.Name())
+	case err != nil:
+		log.Error("couldn't add torrent", "err", err)
+		sub = FailedDir
+	default:
+		log.Info("added torrent", "torrent", t.Name())
+	}
+	if err := move(filepath.Join(w.dir, name), filepath.Join(w.dir, sub)); err != nil {
+		log.Error("couldn't move file", "err", err)
+	}
+}
+
+// add adds and starts the torrent in the file at path.
+func (w *Watcher) add(path string) (*client.Torrent, error) {
+	var t *client.Torrent
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".magnet") {
+		var b []byte
+		if b, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+		t, err = w.c.AddMagnet(strings.TrimSpace(string(b)))
+	} else {
+		t, err = w.c.AddTorrentFile(path)
+	}
+	if err != nil {
+		return t, err
+	}
+	if w.Start != nil {
+		err = w.Start(t)
+	} else {
+		err = t.Start(context.Background())
+	}
+	if err != nil {
+		t.Stop()
+		return nil, err
+	}
+	return t, nil
+}
+
+// move moves the file at path into dir. A file of the same name that's already there is kept, and
+// the moved one gets a numbered name instead.
+func move(path, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	dst := filepath.Join(dir, base)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(base, ext), i, ext))
+	}
+	return os.Rename(path, dst)
+}
@@ -0,0 +1,114 @@
+package watch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saicheems/gotorrent/client"
+	"github.com/saicheems/gotorrent/internal/testtorrent"
+	"github.com/stretchr/testify/assert"
+)
+
+// list returns the names of the files in dir.
+func list(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestScan(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gotorrent")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	watchDir := filepath.Join(dir, "watch")
+	os.Mkdir(watchDir, 0755)
+	c, err := client.NewClient(&client.Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+	metainfo, _ := testtorrent.Make("a.bin", make([]byte, 1000), 1<<14, "")
+
+	write := func(name string, data []byte) {
+		if err := ioutil.WriteFile(filepath.Join(watchDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.torrent", metainfo)
+	write("b.magnet", []byte("magnet:?xt=urn:btih:"+strings.Repeat("ab", 20)+"&dn=b.bin\n"))
+	write("bad.torrent", []byte("garbage"))
+	write("notes.txt", []byte("ignored"))
+
+	var started []string
+	w := New(c, watchDir)
+	w.Start = func(t *client.Torrent) error {
+		started = append(started, t.Name())
+		return nil
+	}
+	// Files are left alone until they've settled.
+	assert.Nil(w.Scan(context.Background()))
+	assert.Equal(0, len(c.Torrents()))
+
+	w.settle = 0
+	assert.Nil(w.Scan(context.Background()))
+	sort.Strings(started)
+	assert.Equal([]string{"a.bin", "b.bin"}, started)
+	assert.Equal(2, len(c.Torrents()))
+	assert.Equal([]string{"done", "failed", "notes.txt"}, list(t, watchDir))
+	assert.Equal([]string{"a.torrent", "b.magnet"}, list(t, filepath.Join(watchDir, DoneDir)))
+	assert.Equal([]string{"bad.torrent"}, list(t, filepath.Join(watchDir, FailedDir)))
+
+	// A torrent that's already added is done, and doesn't overwrite the earlier file.
+	write("a.torrent", metainfo)
+	assert.Nil(w.Scan(context.Background()))
+	assert.Equal(2, len(started))
+	assert.Equal([]string{"a.1.torrent", "a.torrent", "b.magnet"}, list(t, filepath.Join(watchDir, DoneDir)))
+}
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "gotorrent")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	c, err := client.NewClient(&client.Config{ListenAddr: "127.0.0.1:0", DownloadDir: dir})
+	assert.Nil(err)
+	defer c.Close()
+	metainfo, _ := testtorrent.Make("a.bin", make([]byte, 1000), 1<<14, "")
+
+	w := New(c, dir)
+	w.interval, w.settle = 10*time.Millisecond, 0
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan error)
+	go func() { exited <- w.Run(ctx) }()
+	// The file is renamed into place so it's never seen half written.
+	ioutil.WriteFile(filepath.Join(dir, "a.tmp"), metainfo, 0644)
+	os.Rename(filepath.Join(dir, "a.tmp"), filepath.Join(dir, "a.torrent"))
+	done := filepath.Join(dir, DoneDir, "a.torrent")
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(done); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	assert.Nil(<-exited)
+	if assert.Equal(1, len(c.Torrents())) {
+		assert.True(c.Torrents()[0].Stats().Running)
+	}
+	_, err = os.Stat(done)
+	assert.Nil(err)
+
+	// A file can't be watched.
+	assert.NotNil(New(c, done).Run(context.Background()))
+}